@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"emaildrip-be/services"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+const webhooksUsage = `Usage:
+  emaildrip-be webhooks list [-resource ID] [-event NAME] [-status STATUS] [-since T] [-until T] [-limit N]
+  emaildrip-be webhooks show <event-id>
+  emaildrip-be webhooks replay [-id N] [-resource ID] [-event NAME] [-since T] [-until T] [-dry-run]
+
+Timestamps are RFC 3339, e.g. 2024-05-01T00:00:00Z.`
+
+// runWebhooksCommand implements the "webhooks" admin subcommand for
+// inspecting and replaying stored LemonSqueezy webhook events.
+func runWebhooksCommand(args []string, lemonSqueezy *services.LemonSqueezyService) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%s", webhooksUsage)
+	}
+
+	switch args[0] {
+	case "list":
+		filter, _, err := parseWebhookFlags("list", args[1:])
+		if err != nil {
+			return err
+		}
+		if filter.Limit == 0 {
+			filter.Limit = 100
+		}
+		events, err := lemonSqueezy.ListWebhookEvents(filter)
+		if err != nil {
+			return err
+		}
+		for _, event := range events {
+			fmt.Printf("%d\t%s\t%s\t%s\t%s\t%s\n", event.ID, event.ReceivedAt.Format(time.RFC3339),
+				event.EventName, event.ResourceID, event.Status, event.Error)
+		}
+		return nil
+
+	case "show":
+		if len(args) != 2 {
+			return fmt.Errorf("%s", webhooksUsage)
+		}
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid event ID %q", args[1])
+		}
+		event, err := lemonSqueezy.GetWebhookEvent(id)
+		if err != nil {
+			return err
+		}
+		return printJSON(event)
+
+	case "replay":
+		filter, dryRun, err := parseWebhookFlags("replay", args[1:])
+		if err != nil {
+			return err
+		}
+		if filter.ID == 0 && filter.ResourceID == "" && filter.Since == nil && filter.Until == nil {
+			return fmt.Errorf("select events with -id, -resource or -since/-until")
+		}
+		results, err := lemonSqueezy.ReplayWebhookEvents(services.AuditActor{Type: services.AuditActorSystem, ID: "cli"}, filter, dryRun)
+		if printErr := printJSON(results); printErr != nil {
+			return printErr
+		}
+		return err
+	}
+
+	return fmt.Errorf("%s", webhooksUsage)
+}
+
+const usageUsage = `Usage:
+  emaildrip-be usage report      report metered usage to LemonSqueezy now
+  emaildrip-be usage reconcile   compare local and reported usage`
+
+// runUsageCommand implements the "usage" admin subcommand for usage-based
+// subscriptions.
+func runUsageCommand(args []string, lemonSqueezy *services.LemonSqueezyService) error {
+	if len(args) != 1 {
+		return fmt.Errorf("%s", usageUsage)
+	}
+
+	switch args[0] {
+	case "report":
+		return lemonSqueezy.ReportUsage(context.Background())
+
+	case "reconcile":
+		results, err := lemonSqueezy.ReconcileUsage(context.Background())
+		if printErr := printJSON(results); printErr != nil {
+			return printErr
+		}
+		return err
+	}
+
+	return fmt.Errorf("%s", usageUsage)
+}
+
+func parseWebhookFlags(name string, args []string) (services.WebhookEventFilter, bool, error) {
+	var filter services.WebhookEventFilter
+	var since, until string
+	var dryRun bool
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Int64Var(&filter.ID, "id", 0, "event ID")
+	flags.StringVar(&filter.ResourceID, "resource", "", "subscription or order ID")
+	flags.StringVar(&filter.EventName, "event", "", "event name")
+	flags.StringVar(&filter.Status, "status", "", "processing status")
+	flags.StringVar(&since, "since", "", "received at or after (RFC 3339)")
+	flags.StringVar(&until, "until", "", "received before (RFC 3339)")
+	flags.IntVar(&filter.Limit, "limit", 0, "maximum number of events")
+	flags.BoolVar(&dryRun, "dry-run", false, "report changes without applying them")
+	if err := flags.Parse(args); err != nil {
+		return filter, false, err
+	}
+
+	bounds := []struct {
+		value string
+		dest  **time.Time
+	}{{since, &filter.Since}, {until, &filter.Until}}
+	for _, bound := range bounds {
+		if bound.value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, bound.value)
+		if err != nil {
+			return filter, false, fmt.Errorf("invalid timestamp %q", bound.value)
+		}
+		*bound.dest = &parsed
+	}
+
+	return filter, dryRun, nil
+}
+
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
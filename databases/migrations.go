@@ -0,0 +1,610 @@
+package databases
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// migrations are applied in order on every startup, so each statement must be
+// safe to run again against a database that already has it. Data migrations
+// too costly to repeat are wrapped in once.
+var migrations = []string{
+	// Data migrations that have run, by name; see once
+	`CREATE TABLE IF NOT EXISTS data_migrations (
+		name TEXT PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	// Users were originally created by another service; fresh databases get
+	// the table here and users are added on their first authenticated request.
+	`CREATE TABLE IF NOT EXISTS users (
+		id UUID PRIMARY KEY,
+		email TEXT,
+		is_pro BOOLEAN NOT NULL DEFAULT FALSE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	// Rewrites and LemonSqueezy subscriptions, as the other service created
+	// them; later columns are added below
+	`CREATE TABLE IF NOT EXISTS emails (
+		id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+		user_id UUID NOT NULL REFERENCES users(id),
+		original TEXT NOT NULL,
+		rewritten TEXT NOT NULL,
+		roast TEXT,
+		tone TEXT NOT NULL,
+		roast_mode BOOLEAN NOT NULL DEFAULT FALSE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE TABLE IF NOT EXISTS subscriptions (
+		id BIGSERIAL PRIMARY KEY,
+		user_id UUID REFERENCES users(id),
+		lemonsqueezy_subscription_id TEXT UNIQUE,
+		lemonsqueezy_customer_id TEXT,
+		status TEXT NOT NULL,
+		current_period_start TIMESTAMPTZ,
+		current_period_end TIMESTAMPTZ,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+
+	// Each rewrite reserves a unit of quota before the AI call and settles it
+	// afterwards, so concurrent requests can't all pass the limit check.
+	`CREATE TABLE IF NOT EXISTS usage_reservations (
+		id BIGSERIAL PRIMARY KEY,
+		user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		status TEXT NOT NULL DEFAULT 'pending',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		settled_at TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS usage_reservations_user_created_idx
+		ON usage_reservations (user_id, created_at)`,
+
+	// Plans define quota and feature entitlements. A NULL request_limit means
+	// unlimited; period is either 'daily' or 'monthly'.
+	`CREATE TABLE IF NOT EXISTS plans (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		period TEXT NOT NULL DEFAULT 'daily',
+		request_limit INTEGER,
+		allow_roast BOOLEAN NOT NULL DEFAULT TRUE,
+		max_input_length INTEGER NOT NULL DEFAULT 5000
+	)`,
+	`INSERT INTO plans (id, name, period, request_limit, allow_roast, max_input_length)
+	VALUES
+		('free', 'Free', 'daily', 5, TRUE, 5000),
+		('pro', 'Pro', 'monthly', NULL, TRUE, 20000),
+		('team', 'Team', 'monthly', NULL, TRUE, 20000),
+		('custom', 'Custom', 'monthly', NULL, TRUE, 50000)
+	ON CONFLICT (id) DO NOTHING`,
+	// Rewrites have no variants or batches for these flags to gate
+	`ALTER TABLE plans DROP COLUMN IF EXISTS allow_variants`,
+	`ALTER TABLE plans DROP COLUMN IF EXISTS allow_batch`,
+	// Maps LemonSqueezy variant IDs to the plan they grant
+	`CREATE TABLE IF NOT EXISTS plan_variants (
+		lemonsqueezy_variant_id INTEGER PRIMARY KEY,
+		plan_id TEXT NOT NULL REFERENCES plans(id)
+	)`,
+	`INSERT INTO plan_variants (lemonsqueezy_variant_id, plan_id)
+	VALUES (859702, 'pro')
+	ON CONFLICT (lemonsqueezy_variant_id) DO NOTHING`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS plan_id TEXT NOT NULL DEFAULT 'free' REFERENCES plans(id)`,
+	// Existing pro users predate plans
+	`UPDATE users SET plan_id = 'pro' WHERE is_pro AND plan_id = 'free'`,
+
+	// Quota windows are computed per user: calendar windows reset at local
+	// midnight, rolling windows count the trailing period.
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS timezone TEXT NOT NULL DEFAULT 'UTC'`,
+	`ALTER TABLE plans ADD COLUMN IF NOT EXISTS window_policy TEXT NOT NULL DEFAULT 'calendar'`,
+	// The calendar window a user was in when they last changed timezone
+	// stays in effect until it ends
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS quota_window_held_from TIMESTAMPTZ`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS quota_window_held_until TIMESTAMPTZ`,
+
+	// Prepaid credits are an append-only ledger of grants (positive) and
+	// consumptions (negative); the balance is the sum of a user's rows.
+	`CREATE TABLE IF NOT EXISTS credit_ledger (
+		id BIGSERIAL PRIMARY KEY,
+		user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		amount INTEGER NOT NULL,
+		reason TEXT NOT NULL,
+		reference TEXT,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS credit_ledger_reference_idx
+		ON credit_ledger (reason, reference)`,
+	`CREATE INDEX IF NOT EXISTS credit_ledger_user_idx ON credit_ledger (user_id, created_at)`,
+	// One-time purchase variants and the credits they grant
+	`CREATE TABLE IF NOT EXISTS credit_packs (
+		lemonsqueezy_variant_id INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		credits INTEGER NOT NULL CHECK (credits > 0)
+	)`,
+	// Whether a reservation was paid for from the plan quota or with a credit
+	`ALTER TABLE usage_reservations ADD COLUMN IF NOT EXISTS source TEXT NOT NULL DEFAULT 'quota'`,
+
+	// Usage history aggregates a user's emails by day
+	`CREATE INDEX IF NOT EXISTS emails_user_created_idx ON emails (user_id, created_at)`,
+
+	// Every verified webhook delivery, deduplicated by a hash of its body
+	`CREATE TABLE IF NOT EXISTS webhook_events (
+		id BIGSERIAL PRIMARY KEY,
+		provider TEXT NOT NULL DEFAULT 'lemonsqueezy',
+		delivery_key TEXT NOT NULL UNIQUE,
+		event_name TEXT NOT NULL,
+		resource_id TEXT NOT NULL DEFAULT '',
+		payload JSONB NOT NULL,
+		received_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		status TEXT NOT NULL DEFAULT 'pending',
+		error TEXT,
+		processed_at TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS webhook_events_resource_idx ON webhook_events (resource_id, received_at)`,
+	// Times an event was applied, by live deliveries and replays
+	`ALTER TABLE webhook_events ADD COLUMN IF NOT EXISTS attempts INTEGER NOT NULL DEFAULT 0`,
+	// The LemonSqueezy updated_at of the last event applied, so older
+	// deliveries arriving out of order are skipped
+	`ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS lemonsqueezy_updated_at TIMESTAMPTZ`,
+
+	// Subscriptions whose checkout user_id and email match no user wait here
+	// for staff to link them
+	`CREATE TABLE IF NOT EXISTS unmatched_subscriptions (
+		lemonsqueezy_subscription_id TEXT PRIMARY KEY,
+		user_email TEXT NOT NULL,
+		custom_user_id TEXT,
+		subscription JSONB NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		resolved_at TIMESTAMPTZ,
+		resolved_user_id UUID REFERENCES users(id) ON DELETE SET NULL
+	)`,
+
+	// Invoices and orders for billing history. Amounts are in cents.
+	`CREATE TABLE IF NOT EXISTS payments (
+		id BIGSERIAL PRIMARY KEY,
+		user_id UUID REFERENCES users(id) ON DELETE SET NULL,
+		provider TEXT NOT NULL DEFAULT 'lemonsqueezy',
+		kind TEXT NOT NULL,
+		external_id TEXT NOT NULL,
+		subscription_id TEXT,
+		status TEXT NOT NULL,
+		billing_reason TEXT,
+		currency TEXT NOT NULL,
+		total INTEGER NOT NULL,
+		invoice_url TEXT,
+		refunded_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		UNIQUE (kind, external_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS payments_user_created_idx ON payments (user_id, created_at)`,
+	// Lets a refunded order revoke the subscription it started
+	`ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS lemonsqueezy_order_id TEXT`,
+
+	// Access to a plan from a source (e.g. a subscription), valid until
+	// expires_at. users.is_pro and users.plan_id cache the best active one.
+	`CREATE TABLE IF NOT EXISTS entitlements (
+		id BIGSERIAL PRIMARY KEY,
+		user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		source TEXT NOT NULL,
+		source_id TEXT NOT NULL,
+		plan_id TEXT NOT NULL REFERENCES plans(id),
+		status TEXT NOT NULL,
+		starts_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		expires_at TIMESTAMPTZ NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		UNIQUE (source, source_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS entitlements_user_expires_idx ON entitlements (user_id, expires_at)`,
+	// Higher ranked plans win when a user has several entitlements
+	`ALTER TABLE plans ADD COLUMN IF NOT EXISTS rank INTEGER NOT NULL DEFAULT 0`,
+	`UPDATE plans SET rank = CASE id WHEN 'pro' THEN 10 WHEN 'team' THEN 20 WHEN 'custom' THEN 30 ELSE rank END
+	WHERE rank = 0`,
+	`ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS ends_at TIMESTAMPTZ`,
+	`ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS trial_ends_at TIMESTAMPTZ`,
+	`ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS lemonsqueezy_variant_id INTEGER`,
+	// Subscriptions that predate entitlements keep access for their current period
+	once("entitlements_backfill_lemonsqueezy", `INSERT INTO entitlements (user_id, source, source_id, plan_id, status, expires_at)
+	SELECT user_id, 'subscription', lemonsqueezy_subscription_id, 'pro', status, current_period_end + INTERVAL '1 day'
+	FROM subscriptions
+	WHERE user_id IS NOT NULL
+		AND lemonsqueezy_subscription_id IS NOT NULL
+		AND status IN ('active', 'on_trial', 'past_due', 'cancelled')
+		AND current_period_end > NOW()
+	ON CONFLICT (source, source_id) DO NOTHING`),
+
+	// Payment card shown in the billing portal
+	`ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS card_brand TEXT`,
+	`ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS card_last_four TEXT`,
+
+	// Stripe is an alternative billing provider; its subscriptions share the table
+	`ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS stripe_subscription_id TEXT`,
+	`ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS stripe_customer_id TEXT`,
+	`ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS stripe_price_id TEXT`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS subscriptions_stripe_subscription_idx
+		ON subscriptions (stripe_subscription_id)`,
+
+	// Subscriptions from every provider record the plan they grant
+	`ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS plan_id TEXT REFERENCES plans(id)`,
+	`UPDATE subscriptions s SET plan_id = pv.plan_id
+	FROM plan_variants pv
+	WHERE s.plan_id IS NULL AND pv.lemonsqueezy_variant_id = s.lemonsqueezy_variant_id`,
+	`ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS stripe_updated_at TIMESTAMPTZ`,
+	// Subscriptions from providers without a quarantine of their own, such as
+	// Stripe, that match no user wait here with their latest event for staff
+	// to link them
+	`CREATE TABLE IF NOT EXISTS unmatched_subscription_events (
+		provider TEXT NOT NULL,
+		subscription_id TEXT NOT NULL,
+		event JSONB NOT NULL,
+		event_updated_at TIMESTAMPTZ NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		resolved_at TIMESTAMPTZ,
+		resolved_user_id UUID REFERENCES users(id) ON DELETE SET NULL,
+		PRIMARY KEY (provider, subscription_id)
+	)`,
+
+	// Time-boxed grants of a plan (trials, promotions, comps). Each grant
+	// backs an entitlement with the grant's kind as source and its id as
+	// source_id. A user gets one trial.
+	`CREATE TABLE IF NOT EXISTS entitlement_grants (
+		id BIGSERIAL PRIMARY KEY,
+		user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		kind TEXT NOT NULL,
+		plan_id TEXT NOT NULL REFERENCES plans(id),
+		starts_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		expires_at TIMESTAMPTZ NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		granted_by TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		revoked_at TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS entitlement_grants_user_idx ON entitlement_grants (user_id, created_at)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS entitlement_grants_one_trial_idx
+		ON entitlement_grants (user_id) WHERE kind = 'trial'`,
+	// Days of the plan new users get as a trial; 0 disables it
+	`ALTER TABLE plans ADD COLUMN IF NOT EXISTS trial_days INTEGER NOT NULL DEFAULT 0`,
+
+	// Workspaces share a subscription among their members. seats comes from
+	// the quantity of the workspace's subscription and caps the members.
+	`CREATE TABLE IF NOT EXISTS workspaces (
+		id BIGSERIAL PRIMARY KEY,
+		name TEXT NOT NULL,
+		owner_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		seats INTEGER NOT NULL DEFAULT 1,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE TABLE IF NOT EXISTS workspace_members (
+		workspace_id BIGINT NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+		user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		role TEXT NOT NULL DEFAULT 'member',
+		joined_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (workspace_id, user_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS workspace_members_user_idx ON workspace_members (user_id)`,
+	// Only a hash of the accept token is stored
+	`CREATE TABLE IF NOT EXISTS workspace_invitations (
+		id BIGSERIAL PRIMARY KEY,
+		workspace_id BIGINT NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+		email TEXT NOT NULL,
+		role TEXT NOT NULL DEFAULT 'member',
+		token_hash TEXT NOT NULL UNIQUE,
+		invited_by UUID REFERENCES users(id) ON DELETE SET NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		expires_at TIMESTAMPTZ NOT NULL,
+		accepted_at TIMESTAMPTZ,
+		accepted_by UUID REFERENCES users(id) ON DELETE SET NULL,
+		revoked_at TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS workspace_invitations_workspace_idx ON workspace_invitations (workspace_id)`,
+	`ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS workspace_id BIGINT REFERENCES workspaces(id) ON DELETE SET NULL`,
+	`ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS quantity INTEGER NOT NULL DEFAULT 1`,
+	// Entitlements of a workspace subscription apply to every member
+	`ALTER TABLE entitlements ADD COLUMN IF NOT EXISTS workspace_id BIGINT REFERENCES workspaces(id) ON DELETE CASCADE`,
+	`CREATE INDEX IF NOT EXISTS entitlements_workspace_idx ON entitlements (workspace_id) WHERE workspace_id IS NOT NULL`,
+
+	// Usage-based subscriptions are billed for their rewrites through the
+	// subscription item. usage_reports is the ledger of what was reported.
+	`ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS lemonsqueezy_subscription_item_id INTEGER`,
+	`ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS is_usage_based BOOLEAN NOT NULL DEFAULT FALSE`,
+	`CREATE TABLE IF NOT EXISTS usage_reports (
+		id BIGSERIAL PRIMARY KEY,
+		lemonsqueezy_subscription_id TEXT NOT NULL,
+		subscription_item_id INTEGER NOT NULL,
+		period_start TIMESTAMPTZ NOT NULL,
+		period_end TIMESTAMPTZ NOT NULL,
+		quantity INTEGER NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		usage_record_id TEXT,
+		error TEXT,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		reported_at TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS usage_reports_item_created_idx ON usage_reports (subscription_item_id, created_at)`,
+
+	// Dunning: when the current run of failed renewal payments started, and
+	// how many of its emails have been sent.
+	`ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS payment_failed_at TIMESTAMPTZ`,
+	`ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS dunning_step INTEGER NOT NULL DEFAULT 0`,
+	`UPDATE subscriptions SET payment_failed_at = updated_at WHERE status = 'past_due' AND payment_failed_at IS NULL`,
+	`CREATE INDEX IF NOT EXISTS subscriptions_payment_failed_idx ON subscriptions (payment_failed_at) WHERE payment_failed_at IS NOT NULL`,
+
+	// Personal API keys. Only a hash of each key is stored; the prefix lets
+	// users tell their keys apart.
+	`CREATE TABLE IF NOT EXISTS api_keys (
+		id BIGSERIAL PRIMARY KEY,
+		user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		name TEXT NOT NULL,
+		prefix TEXT NOT NULL,
+		key_hash TEXT NOT NULL UNIQUE,
+		scopes TEXT[] NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		last_used_at TIMESTAMPTZ,
+		revoked_at TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS api_keys_user_idx ON api_keys (user_id)`,
+	// Keys are limited by their owner's plan rather than a limit they chose.
+	// CASCADE drops the audit trigger on the column; it's recreated below.
+	`ALTER TABLE api_keys DROP COLUMN IF EXISTS rate_limit CASCADE`,
+	// Key requests are counted in the rate limit buckets
+	`ALTER TABLE api_keys DROP COLUMN IF EXISTS rate_window_start`,
+	`ALTER TABLE api_keys DROP COLUMN IF EXISTS rate_window_count`,
+	`ALTER TABLE plans ADD COLUMN IF NOT EXISTS api_key_rate_limit INTEGER NOT NULL DEFAULT 0`,
+	`UPDATE plans SET api_key_rate_limit = CASE id
+		WHEN 'free' THEN 10 WHEN 'pro' THEN 60 WHEN 'team' THEN 120 WHEN 'custom' THEN 300 ELSE 60
+	END
+	WHERE api_key_rate_limit = 0`,
+	// A plan without a rate would stop its keys entirely
+	`ALTER TABLE plans ALTER COLUMN api_key_rate_limit SET DEFAULT 60`,
+	`ALTER TABLE plans DROP CONSTRAINT IF EXISTS plans_api_key_rate_limit_check`,
+	`ALTER TABLE plans ADD CONSTRAINT plans_api_key_rate_limit_check CHECK (api_key_rate_limit > 0)`,
+	`ALTER TABLE emails ADD COLUMN IF NOT EXISTS api_key_id BIGINT REFERENCES api_keys(id) ON DELETE SET NULL`,
+	`ALTER TABLE usage_reservations ADD COLUMN IF NOT EXISTS api_key_id BIGINT REFERENCES api_keys(id) ON DELETE SET NULL`,
+	`CREATE INDEX IF NOT EXISTS usage_reservations_api_key_idx ON usage_reservations (api_key_id) WHERE api_key_id IS NOT NULL`,
+
+	// Token buckets of the Postgres rate limit store. Losing them in a crash
+	// only resets the limits, so the table skips the WAL.
+	`CREATE UNLOGGED TABLE IF NOT EXISTS rate_limit_buckets (
+		key TEXT PRIMARY KEY,
+		tokens DOUBLE PRECISION NOT NULL,
+		updated_at TIMESTAMPTZ NOT NULL,
+		full_at TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS rate_limit_buckets_full_at_idx ON rate_limit_buckets (full_at)`,
+
+	// Admin API: staff roles, per-user quota adjustments, failed AI calls and
+	// the append-only audit log of staff actions.
+	`CREATE TABLE IF NOT EXISTS staff_roles (
+		user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+		role TEXT NOT NULL CHECK (role IN ('admin', 'support')),
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS request_limit_override INTEGER`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS usage_reset_at TIMESTAMPTZ`,
+	`CREATE TABLE IF NOT EXISTS ai_errors (
+		id BIGSERIAL PRIMARY KEY,
+		user_id UUID,
+		operation TEXT NOT NULL,
+		error TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE INDEX IF NOT EXISTS ai_errors_created_idx ON ai_errors (created_at)`,
+	`CREATE TABLE IF NOT EXISTS audit_log (
+		id BIGSERIAL PRIMARY KEY,
+		actor_type TEXT NOT NULL,
+		actor_id TEXT,
+		action TEXT NOT NULL,
+		target_type TEXT NOT NULL,
+		target_id TEXT NOT NULL,
+		before JSONB,
+		after JSONB,
+		request_id TEXT,
+		ip TEXT,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE INDEX IF NOT EXISTS audit_log_target_idx ON audit_log (target_type, target_id, created_at)`,
+	`CREATE INDEX IF NOT EXISTS audit_log_created_idx ON audit_log (created_at)`,
+	// Append-only: the log can't be edited or pruned through the app. The
+	// one exception is purging a user, which redacts their personal data
+	// from entries with app.audit_redact set, leaving the rest intact.
+	`CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+	BEGIN
+		IF TG_OP = 'UPDATE' AND current_setting('app.audit_redact', true) = 'on'
+			AND (NEW.id, NEW.actor_type, NEW.actor_id, NEW.action, NEW.target_type, NEW.target_id,
+				NEW.request_id, NEW.created_at)
+			IS NOT DISTINCT FROM (OLD.id, OLD.actor_type, OLD.actor_id, OLD.action, OLD.target_type,
+				OLD.target_id, OLD.request_id, OLD.created_at) THEN
+			RETURN NEW;
+		END IF;
+		RAISE EXCEPTION 'audit_log is append-only';
+	END
+	$$ LANGUAGE plpgsql`,
+	`DROP TRIGGER IF EXISTS audit_log_append_only ON audit_log`,
+	`CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE ON audit_log
+	FOR EACH ROW EXECUTE FUNCTION audit_log_append_only()`,
+	// Changes to users and subscriptions are logged by trigger, in the
+	// transaction that makes them, whichever code path makes them. The
+	// transaction names the actor with set_config; anything else is 'system'.
+	// Arguments: target type, space-separated columns to take the target ID
+	// from, then columns left out of entries: ones whose changes aren't worth
+	// one, and personal data or secrets, which the append-only log mustn't
+	// keep.
+	`CREATE OR REPLACE FUNCTION audit_row_change() RETURNS trigger AS $$
+	DECLARE
+		old_row JSONB;
+		new_row JSONB;
+		before_row JSONB := '{}';
+		after_row JSONB := '{}';
+		row_id TEXT;
+		id_column TEXT;
+		col TEXT;
+		i INT;
+	BEGIN
+		IF TG_OP <> 'INSERT' THEN
+			old_row := to_jsonb(OLD);
+		END IF;
+		IF TG_OP <> 'DELETE' THEN
+			new_row := to_jsonb(NEW);
+		END IF;
+
+		FOREACH id_column IN ARRAY string_to_array(TG_ARGV[1], ' ') LOOP
+			row_id := COALESCE(row_id, COALESCE(new_row, old_row) ->> id_column);
+		END LOOP;
+
+		FOR i IN 2 .. TG_NARGS - 1 LOOP
+			old_row := old_row - TG_ARGV[i];
+			new_row := new_row - TG_ARGV[i];
+		END LOOP;
+
+		IF TG_OP = 'UPDATE' THEN
+			FOR col IN SELECT jsonb_object_keys(new_row) LOOP
+				IF new_row -> col IS DISTINCT FROM old_row -> col THEN
+					before_row := before_row || jsonb_build_object(col, old_row -> col);
+					after_row := after_row || jsonb_build_object(col, new_row -> col);
+				END IF;
+			END LOOP;
+			IF after_row = '{}' THEN
+				RETURN NULL;
+			END IF;
+		ELSE
+			before_row := old_row;
+			after_row := new_row;
+		END IF;
+
+		INSERT INTO audit_log (actor_type, actor_id, action, target_type, target_id, before, after, request_id, ip)
+		VALUES (
+			COALESCE(NULLIF(current_setting('app.audit_actor_type', true), ''), 'system'),
+			NULLIF(current_setting('app.audit_actor_id', true), ''),
+			COALESCE(NULLIF(current_setting('app.audit_action', true), ''), TG_ARGV[0] || '.' || lower(TG_OP)),
+			TG_ARGV[0],
+			COALESCE(row_id, ''),
+			before_row,
+			after_row,
+			NULLIF(current_setting('app.audit_request_id', true), ''),
+			NULLIF(current_setting('app.audit_ip', true), '')
+		);
+		RETURN NULL;
+	END
+	$$ LANGUAGE plpgsql`,
+	`DROP TRIGGER IF EXISTS users_audit ON users`,
+	`CREATE TRIGGER users_audit AFTER INSERT OR UPDATE OR DELETE ON users
+	FOR EACH ROW EXECUTE FUNCTION audit_row_change('user', 'id', 'updated_at', 'email', 'name')`,
+	`DROP TRIGGER IF EXISTS subscriptions_audit ON subscriptions`,
+	`CREATE TRIGGER subscriptions_audit AFTER INSERT OR UPDATE OR DELETE ON subscriptions
+	FOR EACH ROW EXECUTE FUNCTION audit_row_change('subscription',
+		'lemonsqueezy_subscription_id stripe_subscription_id', 'updated_at', 'lemonsqueezy_updated_at', 'stripe_updated_at',
+		'card_brand', 'card_last_four')`,
+	// API keys are logged when created, changed or revoked, not on every use
+	`DROP TRIGGER IF EXISTS api_keys_audit ON api_keys`,
+	`CREATE TRIGGER api_keys_audit AFTER INSERT OR UPDATE OF name, scopes, revoked_at OR DELETE ON api_keys
+	FOR EACH ROW EXECUTE FUNCTION audit_row_change('api_key', 'id',
+		'key_hash', 'last_used_at')`,
+	`DROP TRIGGER IF EXISTS workspace_members_audit ON workspace_members`,
+	`CREATE TRIGGER workspace_members_audit AFTER INSERT OR UPDATE OR DELETE ON workspace_members
+	FOR EACH ROW EXECUTE FUNCTION audit_row_change('workspace', 'workspace_id')`,
+	`CREATE INDEX IF NOT EXISTS audit_log_actor_idx ON audit_log (actor_type, actor_id, created_at)`,
+
+	// Profile settings. default_tone is used for rewrites that don't name one.
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS name TEXT`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS default_tone TEXT`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS language TEXT`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()`,
+	// Deleted accounts can be restored until purge_after, when the billing
+	// worker deletes them and everything they own
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS purge_after TIMESTAMPTZ`,
+	`CREATE INDEX IF NOT EXISTS users_purge_after_idx ON users (purge_after) WHERE deleted_at IS NOT NULL`,
+
+	// Plans are read from entitlements only, so everyone who had access
+	// before entitlements needs one. The first backfill above only covered
+	// LemonSqueezy; Stripe subscriptions predating entitlements get theirs
+	// here, with the plan they record.
+	once("entitlements_backfill_stripe", `INSERT INTO entitlements (user_id, source, source_id, plan_id, status, expires_at, workspace_id)
+	SELECT user_id, 'subscription', stripe_subscription_id, COALESCE(plan_id, 'pro'), status,
+		COALESCE(ends_at, current_period_end + INTERVAL '1 day'), workspace_id
+	FROM subscriptions
+	WHERE user_id IS NOT NULL
+		AND stripe_subscription_id IS NOT NULL
+		AND status IN ('active', 'on_trial', 'past_due', 'cancelled')
+		AND COALESCE(ends_at, current_period_end) > NOW()
+	ON CONFLICT (source, source_id) DO NOTHING`),
+	// Users made pro without any subscription, e.g. by hand, keep their plan
+	// through a legacy entitlement. Users that ever had an entitlement or a
+	// subscription are left alone, so this can't revive lapsed access.
+	once("entitlements_backfill_legacy", `INSERT INTO entitlements (user_id, source, source_id, plan_id, status, expires_at)
+	SELECT u.id, 'legacy', u.id::text, CASE WHEN u.plan_id = 'free' THEN 'pro' ELSE u.plan_id END, 'active', 'infinity'
+	FROM users u
+	WHERE (u.is_pro OR u.plan_id <> 'free')
+		AND NOT EXISTS (SELECT 1 FROM entitlements e WHERE e.user_id = u.id)
+		AND NOT EXISTS (SELECT 1 FROM subscriptions s WHERE s.user_id = u.id)
+	ON CONFLICT (source, source_id) DO NOTHING`),
+
+	// Usage is reported as increments of the rewrites not reported yet, so
+	// rewrites made just before a renewal are billed in the next period
+	// instead of being lost. Each reservation records the report that billed
+	// it; earlier reports set the period's total.
+	`ALTER TABLE usage_reports ADD COLUMN IF NOT EXISTS action TEXT NOT NULL DEFAULT 'set'`,
+	`ALTER TABLE usage_reservations ADD COLUMN IF NOT EXISTS usage_report_id BIGINT REFERENCES usage_reports(id) ON DELETE SET NULL`,
+	`CREATE INDEX IF NOT EXISTS usage_reservations_unreported_idx ON usage_reservations (user_id, created_at)
+	WHERE usage_report_id IS NULL AND status = 'committed' AND source = 'quota'`,
+
+	// Quotas used to be counted by the other service's increment_usage.
+	// Today's count carries over as committed reservations, so deploying
+	// doesn't give free users a fresh quota. Days are the users' own, as for
+	// their quota windows; reservations already in the window count towards
+	// the carried over usage.
+	once("legacy_usage_carry_over", `DO $$
+	DECLARE
+		u RECORD;
+		legacy INTEGER;
+	BEGIN
+		IF to_regproc('get_user_usage') IS NULL THEN
+			RETURN;
+		END IF;
+		FOR u IN
+			SELECT id, COALESCE((SELECT name FROM pg_timezone_names WHERE name = timezone), 'UTC') AS tz
+			FROM users WHERE NOT is_pro
+		LOOP
+			EXECUTE format('SELECT get_user_usage(%L)', u.id) INTO legacy;
+			INSERT INTO usage_reservations (user_id, status, source, settled_at)
+			SELECT u.id, 'committed', 'quota', NOW()
+			FROM generate_series(1, COALESCE(legacy, 0) - (
+				SELECT COUNT(*) FROM usage_reservations
+				WHERE user_id = u.id AND source = 'quota'
+					AND created_at >= date_trunc('day', NOW() AT TIME ZONE u.tz) AT TIME ZONE u.tz
+			));
+		END LOOP;
+	END
+	$$`),
+}
+
+// once wraps a data migration so it runs a single time: it's recorded in
+// data_migrations under name, in the same transaction, and skipped once
+// recorded.
+func once(name, statement string) string {
+	return fmt.Sprintf(`DO $once$
+	BEGIN
+		INSERT INTO data_migrations (name) VALUES (%s) ON CONFLICT (name) DO NOTHING;
+		IF NOT FOUND THEN
+			RETURN;
+		END IF;
+		EXECUTE %s;
+	END
+	$once$`, quoteLiteral(name), quoteLiteral(statement))
+}
+
+// quoteLiteral quotes s as an SQL string literal.
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func Migrate(db *sql.DB) {
+	for i, migration := range migrations {
+		if _, err := db.Exec(migration); err != nil {
+			panic(fmt.Sprintf("Failed to run migration %d: %v", i+1, err))
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"emaildrip-be/services"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ReplayRequest struct {
+	ID         int64      `json:"id"`
+	ResourceID string     `json:"resource_id"`
+	EventName  string     `json:"event_name"`
+	Status     string     `json:"status"`
+	Since      *time.Time `json:"since"`
+	Until      *time.Time `json:"until"`
+	DryRun     bool       `json:"dry_run"`
+}
+
+// staffRoleKey is the context key of the staff role set by RequireStaff.
+const staffRoleKey = "staff_role"
+
+// RequireStaff admits staff: users with a staff role, signed in with a
+// session token, and holders of the admin API key, who act as admins. Routes
+// that need more than the support role add RequireRole.
+func (h *Handlers) RequireStaff(c *gin.Context) {
+	if h.isAdminRequest(c) {
+		c.Set(staffRoleKey, services.StaffRoleAdmin)
+		c.Next()
+		return
+	}
+
+	token, ok := bearerToken(c)
+	if !ok {
+		return
+	}
+	if services.IsAPIKey(token) {
+		c.AbortWithStatusJSON(403, gin.H{"error": "API keys can't be used for this endpoint"})
+		return
+	}
+	if !h.verifySession(c, token, false) {
+		return
+	}
+
+	role, err := h.Admin.StaffRole(c.GetString(authUserIDKey))
+	if err != nil {
+		log.Printf("Failed to look up staff role: %v", err)
+		c.AbortWithStatusJSON(500, gin.H{"error": "Failed to check staff role"})
+		return
+	}
+	if role == "" {
+		c.AbortWithStatusJSON(403, gin.H{"error": "Staff only"})
+		return
+	}
+
+	c.Set(staffRoleKey, role)
+	c.Next()
+}
+
+// RequireRole rejects staff without the role. Admins have every role.
+func (h *Handlers) RequireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		staffRole := c.GetString(staffRoleKey)
+		if staffRole != role && staffRole != services.StaffRoleAdmin {
+			c.AbortWithStatusJSON(403, gin.H{"error": "Requires the " + role + " role"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// auditActor identifies who is making a request for the audit log: a staff
+// member or the admin key on admin routes, otherwise the signed-in user.
+func auditActor(c *gin.Context) services.AuditActor {
+	actor := services.AuditActor{
+		Type:      services.AuditActorUser,
+		ID:        c.GetString(authUserIDKey),
+		RequestID: c.GetString(requestIDKey),
+		IP:        c.ClientIP(),
+	}
+	if c.GetString(staffRoleKey) != "" {
+		actor.Type = services.AuditActorStaff
+		if actor.ID == "" {
+			actor.Type = services.AuditActorAdminKey
+		}
+	}
+	return actor
+}
+
+// audit records a staff action the service didn't record itself. Failures
+// are logged rather than failing an action that has already happened.
+func (h *Handlers) audit(c *gin.Context, action, targetType, targetID string, before, after interface{}) {
+	if err := h.Audit.Record(auditActor(c), action, targetType, targetID, before, after); err != nil {
+		log.Printf("Failed to audit %s of %s %s: %v", action, targetType, targetID, err)
+	}
+}
+
+// isAdminRequest reports whether the request carries the admin API key, as
+// the bearer token or, on routes where the bearer token is the user's, in
+// the X-Admin-Key header.
+func (h *Handlers) isAdminRequest(c *gin.Context) bool {
+	if h.AdminAPIKey == "" {
+		return false
+	}
+	token := c.GetHeader("X-Admin-Key")
+	if token == "" {
+		token = strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.AdminAPIKey)) == 1
+}
+
+func (h *Handlers) ListWebhookEvents(c *gin.Context) {
+	filter := services.WebhookEventFilter{
+		ResourceID: c.Query("resource_id"),
+		EventName:  c.Query("event_name"),
+		Status:     c.Query("status"),
+		Limit:      100,
+	}
+
+	if limit, err := strconv.Atoi(c.Query("limit")); err == nil {
+		filter.Limit = limit
+	}
+
+	for param, dest := range map[string]**time.Time{"since": &filter.Since, "until": &filter.Until} {
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			c.JSON(400, gin.H{"error": param + " must be an RFC 3339 timestamp"})
+			return
+		}
+		*dest = &parsed
+	}
+
+	events, err := h.LemonSqueezy.ListWebhookEvents(filter)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to list webhook events"})
+		return
+	}
+
+	c.JSON(200, gin.H{"events": events})
+}
+
+func (h *Handlers) GetWebhookEvent(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid event ID"})
+		return
+	}
+
+	event, err := h.LemonSqueezy.GetWebhookEvent(id)
+	if err == sql.ErrNoRows {
+		c.JSON(404, gin.H{"error": "Webhook event not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to get webhook event"})
+		return
+	}
+
+	c.JSON(200, event)
+}
+
+func (h *Handlers) ReplayWebhookEvents(c *gin.Context) {
+	var req ReplayRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Replaying the whole log is never what anyone wants
+	if req.ID == 0 && req.ResourceID == "" && req.Since == nil && req.Until == nil {
+		c.JSON(400, gin.H{"error": "Select events by id, resource_id or a since/until range"})
+		return
+	}
+
+	filter := services.WebhookEventFilter{
+		ID:         req.ID,
+		ResourceID: req.ResourceID,
+		EventName:  req.EventName,
+		Status:     req.Status,
+		Since:      req.Since,
+		Until:      req.Until,
+	}
+
+	results, err := h.LemonSqueezy.ReplayWebhookEvents(auditActor(c), filter, req.DryRun)
+	if !req.DryRun {
+		target := req.ResourceID
+		if req.ID != 0 {
+			target = strconv.FormatInt(req.ID, 10)
+		}
+		h.audit(c, "webhooks.replay", "webhook_event", target, nil, gin.H{"filter": req, "results": results})
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to replay webhook events", "results": results})
+		return
+	}
+
+	c.JSON(200, gin.H{"dry_run": req.DryRun, "results": results})
+}
+
+type LinkSubscriptionRequest struct {
+	UserID   string `json:"user_id" binding:"required"`
+	Provider string `json:"provider"` // defaults to lemonsqueezy
+}
+
+// ListUnmatchedSubscriptions lists quarantined LemonSqueezy subscriptions,
+// and under subscription_events those of other providers, such as Stripe.
+func (h *Handlers) ListUnmatchedSubscriptions(c *gin.Context) {
+	unmatched, err := h.LemonSqueezy.ListUnmatchedSubscriptions()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to list unmatched subscriptions"})
+		return
+	}
+	events, err := h.Subscriptions.ListUnmatchedSubscriptions()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to list unmatched subscriptions"})
+		return
+	}
+
+	c.JSON(200, gin.H{"subscriptions": unmatched, "subscription_events": events})
+}
+
+func (h *Handlers) LinkUnmatchedSubscription(c *gin.Context) {
+	var req LinkSubscriptionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	var err error
+	if req.Provider == "" || req.Provider == services.BillingProviderLemonSqueezy {
+		err = h.LemonSqueezy.LinkUnmatchedSubscription(auditActor(c), c.Param("subscription_id"), req.UserID)
+	} else {
+		err = h.Subscriptions.LinkUnmatchedSubscription(auditActor(c), req.Provider, c.Param("subscription_id"), req.UserID)
+	}
+	if err == sql.ErrNoRows {
+		c.JSON(404, gin.H{"error": "Unmatched subscription not found"})
+		return
+	}
+	if errors.Is(err, services.ErrUserNotFound) {
+		c.JSON(400, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to link subscription"})
+		return
+	}
+
+	c.JSON(200, gin.H{"linked": true})
+}
+
+type GrantRequest struct {
+	Kind      string     `json:"kind" binding:"required"`
+	PlanID    string     `json:"plan_id"`
+	Days      int        `json:"days"`
+	StartsAt  *time.Time `json:"starts_at"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	Reason    string     `json:"reason"`
+}
+
+func (h *Handlers) ListUserGrants(c *gin.Context) {
+	userID, ok := h.adminUserParam(c)
+	if !ok {
+		return
+	}
+
+	grants, err := h.Grants.ListGrants(userID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to list grants"})
+		return
+	}
+
+	c.JSON(200, gin.H{"grants": grants})
+}
+
+// CreateGrant gives a user a plan for a number of days or until expires_at,
+// e.g. {"kind": "comp", "plan_id": "pro", "days": 30}.
+func (h *Handlers) CreateGrant(c *gin.Context) {
+	userID, ok := h.adminUserParam(c)
+	if !ok {
+		return
+	}
+
+	var req GrantRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Grants are attributed to whoever made the request; the admin API key
+	// has no user, so its grants are attributed to the key
+	actor := auditActor(c)
+	grant := services.Grant{
+		UserID:    userID,
+		Kind:      req.Kind,
+		PlanID:    req.PlanID,
+		StartsAt:  time.Now(),
+		Reason:    req.Reason,
+		GrantedBy: actor.ID,
+	}
+	if grant.PlanID == "" {
+		grant.PlanID = "pro"
+	}
+	if grant.GrantedBy == "" {
+		grant.GrantedBy = actor.Type
+	}
+	if req.StartsAt != nil {
+		grant.StartsAt = *req.StartsAt
+	}
+
+	switch {
+	case req.ExpiresAt != nil && req.Days == 0:
+		grant.ExpiresAt = *req.ExpiresAt
+	case req.ExpiresAt == nil && req.Days > 0:
+		grant.ExpiresAt = grant.StartsAt.AddDate(0, 0, req.Days)
+	default:
+		c.JSON(400, gin.H{"error": "Set either days or expires_at"})
+		return
+	}
+
+	created, err := h.Grants.CreateGrant(actor, grant)
+	if errors.Is(err, services.ErrInvalidGrant) {
+		c.JSON(400, gin.H{"error": "kind must be trial, promo or comp, plan_id an existing plan, and the grant must end after it starts"})
+		return
+	}
+	if errors.Is(err, services.ErrUserNotFound) {
+		c.JSON(404, gin.H{"error": "User not found"})
+		return
+	}
+	if errors.Is(err, services.ErrTrialUsed) {
+		c.JSON(409, gin.H{"error": "User already had a trial"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to create grant"})
+		return
+	}
+
+	c.JSON(201, created)
+}
+
+func (h *Handlers) RevokeGrant(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid grant ID"})
+		return
+	}
+
+	grant, err := h.Grants.RevokeGrant(auditActor(c), id)
+	if errors.Is(err, services.ErrGrantNotFound) {
+		c.JSON(404, gin.H{"error": "Grant not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to revoke grant"})
+		return
+	}
+
+	c.JSON(200, grant)
+}
+
+func (h *Handlers) GetUsageReconciliation(c *gin.Context) {
+	results, err := h.LemonSqueezy.ReconcileUsage(c.Request.Context())
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to reconcile usage", "results": results})
+		return
+	}
+
+	c.JSON(200, gin.H{"subscriptions": results})
+}
@@ -0,0 +1,261 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"emaildrip-be/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminRouter mounts the admin routes under test behind the same middleware
+// as main.
+func adminRouter(h *Handlers) *gin.Engine {
+	r := gin.New()
+	admin := r.Group("/admin", h.RequireStaff)
+	adminOnly := admin.Group("", h.RequireRole(services.StaffRoleAdmin))
+	admin.GET("/users/:user_id", h.GetAdminUser)
+	admin.GET("/users/:user_id/grants", h.ListUserGrants)
+	adminOnly.POST("/webhooks/replay", h.ReplayWebhookEvents)
+	adminOnly.POST("/users/:user_id/grants", h.CreateGrant)
+	adminOnly.PUT("/staff/:user_id", h.SetStaffRole)
+	return r
+}
+
+var adminKeyHeader = http.Header{"Authorization": {"Bearer " + testAdminKey}}
+
+func TestReplayWebhookEventsRequiresSelection(t *testing.T) {
+	h := newTestHandlers(nil)
+
+	for _, body := range []gin.H{{}, {"dry_run": true}, {"event_name": "subscription_created"}} {
+		rec := serve(adminRouter(h), "POST", "/admin/webhooks/replay", body, adminKeyHeader)
+		if rec.Code != 400 {
+			t.Errorf("replay of %v: status = %d, want 400", body, rec.Code)
+		}
+	}
+}
+
+func TestReplayWebhookEvents(t *testing.T) {
+	db := openTestDB(t)
+	h := newTestHandlers(db)
+	userID := createTestUser(t, db)
+	subscriptionID := newTestSubscriptionID()
+
+	payload, header := lemonSqueezyWebhook(t, "subscription_created", subscriptionID, userID)
+	if rec := serve(webhookRouter(h), "POST", "/api/lemonsqueezy/webhook", payload, header); rec.Code != 200 {
+		t.Fatalf("delivery status = %d: %s", rec.Code, rec.Body)
+	}
+
+	// Local state that drifted from what the event says
+	_, err := db.Exec(`
+		UPDATE subscriptions SET status = $2 WHERE lemonsqueezy_subscription_id = $1
+	`, subscriptionID, services.SubscriptionExpired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := func() (subscriptionStatus string, attempts int) {
+		t.Helper()
+		err := db.QueryRow(`
+			SELECT s.status, e.attempts
+			FROM subscriptions s, webhook_events e
+			WHERE s.lemonsqueezy_subscription_id = $1 AND e.resource_id = $1
+		`, subscriptionID).Scan(&subscriptionStatus, &attempts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return subscriptionStatus, attempts
+	}
+
+	dryRun := serve(adminRouter(h), "POST", "/admin/webhooks/replay",
+		gin.H{"resource_id": subscriptionID, "dry_run": true}, adminKeyHeader)
+	if dryRun.Code != 200 {
+		t.Fatalf("dry run status = %d: %s", dryRun.Code, dryRun.Body)
+	}
+	results, _ := decodeResponse(t, dryRun)["results"].([]interface{})
+	if len(results) != 1 {
+		t.Fatalf("dry run replayed %d events, want 1: %s", len(results), dryRun.Body)
+	}
+	if changes, _ := results[0].(map[string]interface{})["changes"].([]interface{}); len(changes) == 0 {
+		t.Errorf("dry run reported no changes for a drifted subscription: %s", dryRun.Body)
+	}
+	if got, attempts := status(); got != services.SubscriptionExpired || attempts != 1 {
+		t.Errorf("after a dry run: status %q with %d attempts, want it untouched", got, attempts)
+	}
+
+	replay := serve(adminRouter(h), "POST", "/admin/webhooks/replay",
+		gin.H{"resource_id": subscriptionID}, adminKeyHeader)
+	if replay.Code != 200 {
+		t.Fatalf("replay status = %d: %s", replay.Code, replay.Body)
+	}
+	if got, attempts := status(); got != services.SubscriptionActive || attempts != 2 {
+		t.Errorf("after a replay: status %q with %d attempts, want %q with 2", got, attempts, services.SubscriptionActive)
+	}
+}
+
+// staffRouter answers a support route and an admin-only route with the
+// caller's staff role and audit actor.
+func staffRouter(h *Handlers, before ...gin.HandlerFunc) *gin.Engine {
+	whoami := func(c *gin.Context) {
+		c.JSON(200, gin.H{"role": c.GetString(staffRoleKey), "actor": auditActor(c).Type})
+	}
+	r := gin.New()
+	r.Use(before...)
+	r.GET("/support", h.RequireRole(services.StaffRoleSupport), whoami)
+	r.GET("/admin", h.RequireRole(services.StaffRoleAdmin), whoami)
+	return r
+}
+
+// signSession signs an HS256 session token for the user with the test
+// secret, expiring at exp.
+func signSession(t *testing.T, userID string, exp time.Time) string {
+	t.Helper()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"sub":   userID,
+		"email": userID + "@example.com",
+		"exp":   exp.Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	mac := hmac.New(sha256.New, []byte(testJWTSecret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func bearer(token string) http.Header {
+	return http.Header{"Authorization": {"Bearer " + token}}
+}
+
+func TestRequireStaff(t *testing.T) {
+	h := newTestHandlers(nil) // none of these get as far as looking up a staff role
+
+	tests := []struct {
+		name      string
+		header    http.Header
+		wantCode  int
+		wantActor string
+	}{
+		{"no credentials", nil, 401, ""},
+		{"admin key", adminKeyHeader, 200, services.AuditActorAdminKey},
+		{"admin key header", http.Header{"X-Admin-Key": {testAdminKey}}, 200, services.AuditActorAdminKey},
+		{"wrong admin key", bearer("not-the-admin-key"), 401, ""},
+		{"API key", bearer(services.APIKeyPrefix + "0123456789abcdef"), 403, ""},
+		{"expired session", bearer(signSession(t, newTestUUID(t), time.Now().Add(-time.Hour))), 401, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(staffRouter(h, h.RequireStaff), "GET", "/admin", nil, tt.header)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if tt.wantCode != 200 {
+				return
+			}
+			if body := decodeResponse(t, rec); body["role"] != services.StaffRoleAdmin || body["actor"] != tt.wantActor {
+				t.Errorf("admin key request = %v, want the admin role as %s", body, tt.wantActor)
+			}
+		})
+	}
+}
+
+func TestRequireStaffWithoutAdminKey(t *testing.T) {
+	h := newTestHandlers(nil)
+	h.AdminAPIKey = "" // an unset key must not match an empty header
+
+	for _, header := range []http.Header{nil, {"X-Admin-Key": {""}}, bearer("")} {
+		if rec := serve(staffRouter(h, h.RequireStaff), "GET", "/admin", nil, header); rec.Code != 401 {
+			t.Errorf("%v: status = %d, want 401", header, rec.Code)
+		}
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	h := newTestHandlers(nil)
+
+	tests := []struct {
+		role        string
+		wantSupport int
+		wantAdmin   int
+	}{
+		{"", 403, 403},
+		{services.StaffRoleSupport, 200, 403},
+		{services.StaffRoleAdmin, 200, 200},
+		{"owner", 403, 403},
+	}
+	for _, tt := range tests {
+		asRole := func(c *gin.Context) {
+			if tt.role != "" {
+				c.Set(staffRoleKey, tt.role)
+			}
+		}
+		router := staffRouter(h, asRole)
+		if rec := serve(router, "GET", "/support", nil, nil); rec.Code != tt.wantSupport {
+			t.Errorf("role %q on a support route: status = %d, want %d", tt.role, rec.Code, tt.wantSupport)
+		}
+		if rec := serve(router, "GET", "/admin", nil, nil); rec.Code != tt.wantAdmin {
+			t.Errorf("role %q on an admin route: status = %d, want %d", tt.role, rec.Code, tt.wantAdmin)
+		}
+	}
+}
+
+func TestRequireStaffSessions(t *testing.T) {
+	db := openTestDB(t)
+	h := newTestHandlers(db)
+	router := staffRouter(h, h.RequireStaff)
+
+	tests := []struct {
+		role        string
+		wantSupport int
+		wantAdmin   int
+	}{
+		{"", 403, 403},
+		{services.StaffRoleSupport, 200, 403},
+		{services.StaffRoleAdmin, 200, 200},
+	}
+	for _, tt := range tests {
+		userID := createTestUser(t, db)
+		if tt.role != "" {
+			if err := h.Admin.SetStaffRole(services.AuditActor{Type: services.AuditActorSystem}, userID, tt.role); err != nil {
+				t.Fatal(err)
+			}
+		}
+		session := bearer(signSession(t, userID, time.Now().Add(time.Hour)))
+
+		if rec := serve(router, "GET", "/support", nil, session); rec.Code != tt.wantSupport {
+			t.Errorf("role %q on a support route: status = %d, want %d", tt.role, rec.Code, tt.wantSupport)
+		}
+		rec := serve(router, "GET", "/admin", nil, session)
+		if rec.Code != tt.wantAdmin {
+			t.Errorf("role %q on an admin route: status = %d, want %d", tt.role, rec.Code, tt.wantAdmin)
+		}
+		if rec.Code == 200 {
+			if body := decodeResponse(t, rec); body["actor"] != services.AuditActorStaff {
+				t.Errorf("staff session audited as %v, want %s", body["actor"], services.AuditActorStaff)
+			}
+		}
+	}
+}
+
+func TestAdminUserRoutesRejectMalformedIDs(t *testing.T) {
+	h := newTestHandlers(nil) // malformed IDs are rejected before any query
+
+	for _, route := range []struct{ method, path string }{
+		{"GET", "/admin/users/not-a-uuid"},
+		{"GET", "/admin/users/not-a-uuid/grants"},
+		{"POST", "/admin/users/1%27%20OR%201=1/grants"},
+		{"PUT", "/admin/staff/42"},
+	} {
+		rec := serve(adminRouter(h), route.method, route.path, gin.H{"kind": "comp", "days": 1, "role": "admin"}, adminKeyHeader)
+		if rec.Code != 400 {
+			t.Errorf("%s %s: status = %d, want 400", route.method, route.path, rec.Code)
+		}
+	}
+}
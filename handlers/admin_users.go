@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	"emaildrip-be/services"
+	"errors"
+	"log"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type QuotaRequest struct {
+	RequestLimit *int `json:"request_limit"` // null goes back to the plan's limit
+}
+
+type StaffRoleRequest struct {
+	Role string `json:"role" binding:"required"`
+}
+
+// adminUserParam reads the :user_id of an admin route, answering 400 when it
+// isn't a user ID and 404 when the user doesn't exist.
+func (h *Handlers) adminUserParam(c *gin.Context) (string, bool) {
+	userID := c.Param("user_id")
+	_, err := h.Users.GetUser(userID)
+	if errors.Is(err, services.ErrInvalidUserID) {
+		c.JSON(400, gin.H{"error": "user_id must be a UUID"})
+		return "", false
+	}
+	if errors.Is(err, services.ErrUserNotFound) {
+		c.JSON(404, gin.H{"error": "User not found"})
+		return "", false
+	}
+	if err != nil {
+		log.Printf("Failed to get user %s: %v", userID, err)
+		c.JSON(500, gin.H{"error": "Failed to get user"})
+		return "", false
+	}
+	return userID, true
+}
+
+// SearchUsers finds users by ID or email, e.g. ?q=alice@example.com.
+func (h *Handlers) SearchUsers(c *gin.Context) {
+	query := c.Query("q")
+	if len(query) < 3 {
+		c.JSON(400, gin.H{"error": "q must be at least 3 characters"})
+		return
+	}
+
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	users, err := h.Admin.SearchUsers(query, limit)
+	if err != nil {
+		log.Printf("Failed to search users: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to search users"})
+		return
+	}
+	h.audit(c, "users.search", "user", "", nil, gin.H{"q": query})
+
+	c.JSON(200, gin.H{"users": users})
+}
+
+// GetAdminUser shows a user's plan, usage, quota, subscriptions and
+// entitlements.
+func (h *Handlers) GetAdminUser(c *gin.Context) {
+	userID, ok := h.adminUserParam(c)
+	if !ok {
+		return
+	}
+	view, err := h.Admin.GetUserView(userID)
+	if errors.Is(err, services.ErrUserNotFound) {
+		c.JSON(404, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to get user %s: %v", userID, err)
+		c.JSON(500, gin.H{"error": "Failed to get user"})
+		return
+	}
+	h.audit(c, "user.view", "user", userID, nil, nil)
+
+	c.JSON(200, view)
+}
+
+// GetAdminUserEmails reads a user's rewrite history as they see it.
+func (h *Handlers) GetAdminUserEmails(c *gin.Context) {
+	userID, ok := h.adminUserParam(c)
+	if !ok {
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil {
+		limit = 50
+	}
+
+	emails, err := h.Email.GetUserEmails(userID, limit)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to get emails"})
+		return
+	}
+	h.audit(c, "user.history_read", "user", userID, nil, nil)
+
+	c.JSON(200, gin.H{"emails": emails})
+}
+
+// SetUserQuota overrides the request limit of a user's plan.
+func (h *Handlers) SetUserQuota(c *gin.Context) {
+	userID, ok := h.adminUserParam(c)
+	if !ok {
+		return
+	}
+
+	var req QuotaRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if req.RequestLimit != nil && *req.RequestLimit < 0 {
+		c.JSON(400, gin.H{"error": "request_limit can't be negative"})
+		return
+	}
+
+	quota, err := h.Admin.SetRequestLimitOverride(auditActor(c), userID, req.RequestLimit)
+	if errors.Is(err, services.ErrUserNotFound) {
+		c.JSON(404, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to set quota: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to set quota"})
+		return
+	}
+
+	c.JSON(200, quota)
+}
+
+// ResetUserUsage gives a user their full quota back.
+func (h *Handlers) ResetUserUsage(c *gin.Context) {
+	userID, ok := h.adminUserParam(c)
+	if !ok {
+		return
+	}
+
+	quota, err := h.Admin.ResetUsage(auditActor(c), userID)
+	if errors.Is(err, services.ErrUserNotFound) {
+		c.JSON(404, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to reset usage: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to reset usage"})
+		return
+	}
+
+	c.JSON(200, quota)
+}
+
+// ListAIErrors shows recent failed AI calls, optionally for one ?user_id=.
+func (h *Handlers) ListAIErrors(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit < 1 || limit > 500 {
+		limit = 100
+	}
+
+	aiErrors, err := h.Admin.ListAIErrors(c.Query("user_id"), limit)
+	if err != nil {
+		log.Printf("Failed to list AI errors: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to list AI errors"})
+		return
+	}
+	h.audit(c, "ai_errors.view", "user", c.Query("user_id"), nil, nil)
+
+	c.JSON(200, gin.H{"errors": aiErrors})
+}
+
+// SetStaffRole makes a user an admin or support staff member.
+func (h *Handlers) SetStaffRole(c *gin.Context) {
+	userID, ok := h.adminUserParam(c)
+	if !ok {
+		return
+	}
+
+	var req StaffRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	h.setStaffRole(c, userID, req.Role)
+}
+
+func (h *Handlers) RemoveStaffRole(c *gin.Context) {
+	userID, ok := h.adminUserParam(c)
+	if !ok {
+		return
+	}
+
+	h.setStaffRole(c, userID, "")
+}
+
+func (h *Handlers) setStaffRole(c *gin.Context, userID, role string) {
+	err := h.Admin.SetStaffRole(auditActor(c), userID, role)
+	if errors.Is(err, services.ErrInvalidStaffRole) {
+		c.JSON(400, gin.H{"error": "role must be admin or support"})
+		return
+	}
+	if errors.Is(err, services.ErrUserNotFound) {
+		c.JSON(404, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to set staff role: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to set staff role"})
+		return
+	}
+
+	c.JSON(200, gin.H{"user_id": userID, "role": role})
+}
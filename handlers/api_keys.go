@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"emaildrip-be/services"
+	"errors"
+	"log"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CreateAPIKeyRequest has no rate limit: keys get the one of the user's plan.
+type CreateAPIKeyRequest struct {
+	Name   string   `json:"name" binding:"required"`
+	Scopes []string `json:"scopes" binding:"required"` // rewrite:write, history:read
+}
+
+func (h *Handlers) ListAPIKeys(c *gin.Context) {
+	userID, ok := authenticatedUser(c, "")
+	if !ok {
+		return
+	}
+
+	keys, err := h.APIKeys.ListKeys(userID)
+	if err != nil {
+		log.Printf("Failed to list API keys: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to list API keys"})
+		return
+	}
+
+	c.JSON(200, gin.H{"keys": keys})
+}
+
+func (h *Handlers) CreateAPIKey(c *gin.Context) {
+	userID, ok := authenticatedUser(c, "")
+	if !ok {
+		return
+	}
+
+	var req CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	key, err := h.APIKeys.CreateKey(auditActor(c), userID, req.Name, req.Scopes)
+	if errors.Is(err, services.ErrInvalidAPIKeyRequest) {
+		c.JSON(400, gin.H{"error": "Invalid API key: check the name and scopes, and that you have fewer than 20 keys"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to create API key: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to create API key"})
+		return
+	}
+
+	c.JSON(201, key)
+}
+
+func (h *Handlers) RevokeAPIKey(c *gin.Context) {
+	userID, ok := authenticatedUser(c, "")
+	if !ok {
+		return
+	}
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid API key ID"})
+		return
+	}
+
+	err = h.APIKeys.RevokeKey(auditActor(c), userID, id)
+	if errors.Is(err, services.ErrAPIKeyNotFound) {
+		c.JSON(404, gin.H{"error": "API key not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to revoke API key: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to revoke API key"})
+		return
+	}
+
+	c.JSON(200, gin.H{"revoked": true})
+}
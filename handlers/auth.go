@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"emaildrip-be/services"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Context keys set by RequireAuth and AllowAPIKey.
+const (
+	authUserIDKey = "auth_user_id"
+	authClaimsKey = "auth_claims"
+	authAPIKeyKey = "auth_api_key"
+)
+
+// RequireAuth rejects requests without a valid bearer token and stores the
+// token's subject as the request's user, creating the user on their first
+// request. Personal API keys are rejected; routes that accept them use
+// AllowAPIKey instead. Accounts scheduled for deletion are rejected too.
+func (h *Handlers) RequireAuth(c *gin.Context) {
+	h.requireSession(c, false)
+}
+
+// RequireAccount authenticates like RequireAuth, but admits accounts
+// scheduled for deletion so they can be looked at and restored.
+func (h *Handlers) RequireAccount(c *gin.Context) {
+	h.requireSession(c, true)
+}
+
+func (h *Handlers) requireSession(c *gin.Context, allowDeleted bool) {
+	token, ok := bearerToken(c)
+	if !ok {
+		return
+	}
+	if services.IsAPIKey(token) {
+		c.AbortWithStatusJSON(403, gin.H{"error": "API keys can't be used for this endpoint"})
+		return
+	}
+
+	if h.verifySession(c, token, allowDeleted) {
+		c.Next()
+	}
+}
+
+// AllowAPIKey authenticates like RequireAuth, but also accepts personal API
+// keys that grant the scope, taking the request from the key's token bucket,
+// which refills at the key's rate limit.
+func (h *Handlers) AllowAPIKey(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, ok := bearerToken(c)
+		if !ok {
+			return
+		}
+		if !services.IsAPIKey(token) {
+			if h.verifySession(c, token, false) {
+				c.Next()
+			}
+			return
+		}
+
+		key, err := h.APIKeys.Authenticate(token)
+		if errors.Is(err, services.ErrInvalidAPIKey) {
+			c.AbortWithStatusJSON(401, gin.H{"error": "Invalid API key"})
+			return
+		}
+		if err != nil {
+			log.Printf("API key authentication failed: %v", err)
+			c.AbortWithStatusJSON(500, gin.H{"error": "Failed to check API key"})
+			return
+		}
+		if !key.HasScope(scope) {
+			c.AbortWithStatusJSON(403, gin.H{"error": fmt.Sprintf("API key lacks the %s scope", scope)})
+			return
+		}
+
+		policy := services.RateLimitPolicy{Name: "api_key", Limit: key.RateLimit, Period: time.Minute}
+		if !h.takeRateLimit(c, "api_key:"+strconv.FormatInt(key.ID, 10), policy) {
+			return
+		}
+
+		c.Set(authUserIDKey, key.UserID)
+		c.Set(authAPIKeyKey, key)
+		c.Next()
+	}
+}
+
+// bearerToken returns the request's bearer token, rejecting the request with
+// 401 if it has none.
+func bearerToken(c *gin.Context) (string, bool) {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		c.AbortWithStatusJSON(401, gin.H{"error": "Authorization bearer token required"})
+		return "", false
+	}
+	return token, true
+}
+
+// verifySession verifies a session JWT and makes its subject the request's
+// user, creating the user if this is their first request. It aborts the
+// request and returns false if the token isn't valid, or the account is
+// scheduled for deletion and allowDeleted isn't set.
+func (h *Handlers) verifySession(c *gin.Context, token string, allowDeleted bool) bool {
+	claims, err := h.Tokens.Verify(token)
+	if errors.Is(err, services.ErrTokenExpired) {
+		c.AbortWithStatusJSON(401, gin.H{"error": "Token expired"})
+		return false
+	}
+	if errors.Is(err, services.ErrInvalidToken) {
+		c.AbortWithStatusJSON(401, gin.H{"error": "Invalid token"})
+		return false
+	}
+	if err != nil {
+		log.Printf("Token verification failed: %v", err)
+		c.AbortWithStatusJSON(503, gin.H{"error": "Authentication is temporarily unavailable"})
+		return false
+	}
+
+	c.Set(authUserIDKey, claims.Subject)
+	c.Set(authClaimsKey, claims)
+
+	user, err := h.Users.EnsureUser(auditActor(c), claims.Subject, claims.Email)
+	if errors.Is(err, services.ErrInvalidUserID) {
+		c.AbortWithStatusJSON(401, gin.H{"error": "Token subject is not a valid user ID"})
+		return false
+	}
+	if err != nil {
+		log.Printf("Failed to load user %s: %v", claims.Subject, err)
+		c.AbortWithStatusJSON(500, gin.H{"error": "Failed to load user"})
+		return false
+	}
+	if user.DeletedAt != nil && !allowDeleted {
+		c.AbortWithStatusJSON(403, gin.H{
+			"error":       "Account is scheduled for deletion; restore it to continue",
+			"purge_after": user.PurgeAfter,
+		})
+		return false
+	}
+	return true
+}
+
+// authenticatedUser returns the user the request is authenticated as. A user
+// ID the client sent in the path, query or body is only accepted if it is the
+// same user; otherwise the request is rejected with 403 and ok is false.
+func authenticatedUser(c *gin.Context, claimed string) (string, bool) {
+	userID := c.GetString(authUserIDKey)
+	if userID == "" {
+		c.AbortWithStatusJSON(401, gin.H{"error": "Unauthorized"})
+		return "", false
+	}
+	if claimed != "" && claimed != userID {
+		c.AbortWithStatusJSON(403, gin.H{"error": "user_id does not match the authenticated user"})
+		return "", false
+	}
+	return userID, true
+}
+
+// authenticatedEmail returns the email from the request's token, if it has one.
+func authenticatedEmail(c *gin.Context) string {
+	if claims, ok := c.Get(authClaimsKey); ok {
+		return claims.(*services.TokenClaims).Email
+	}
+	return ""
+}
+
+// authenticatedAPIKeyID returns the ID of the personal API key the request was
+// made with, or nil for session tokens.
+func authenticatedAPIKeyID(c *gin.Context) *int64 {
+	if key, ok := c.Get(authAPIKeyKey); ok {
+		return &key.(*services.APIKey).ID
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"emaildrip-be/services"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PauseRequest accepts only the void mode, kept for clients that send it;
+// paused subscriptions don't keep access.
+type PauseRequest struct {
+	Mode      string     `json:"mode" binding:"omitempty,oneof=void"`
+	ResumesAt *time.Time `json:"resumes_at"`
+}
+
+type ChangePlanRequest struct {
+	Plan string `json:"plan" binding:"required"`
+}
+
+func (h *Handlers) GetSubscription(c *gin.Context) {
+	userID, ok := authenticatedUser(c, c.Param("user_id"))
+	if !ok {
+		return
+	}
+
+	provider, err := h.subscriptionProvider(userID)
+	if err != nil {
+		h.subscriptionError(c, err, "get subscription")
+		return
+	}
+
+	subscription, err := provider.GetUserSubscription(userID)
+	if err != nil {
+		h.subscriptionError(c, err, "get subscription")
+		return
+	}
+
+	c.JSON(200, subscription)
+}
+
+func (h *Handlers) GetBillingPortal(c *gin.Context) {
+	userID, ok := authenticatedUser(c, c.Param("user_id"))
+	if !ok {
+		return
+	}
+
+	provider, err := h.subscriptionProvider(userID)
+	if err != nil {
+		h.subscriptionError(c, err, "get billing portal")
+		return
+	}
+
+	urls, err := provider.GetPortalURLs(userID)
+	if err != nil {
+		h.subscriptionError(c, err, "get billing portal")
+		return
+	}
+
+	c.JSON(200, urls)
+}
+
+func (h *Handlers) CancelSubscription(c *gin.Context) {
+	userID, ok := authenticatedUser(c, c.Param("user_id"))
+	if !ok {
+		return
+	}
+
+	provider, err := h.subscriptionProvider(userID)
+	if err != nil {
+		h.subscriptionError(c, err, "cancel subscription")
+		return
+	}
+
+	subscription, err := provider.CancelSubscription(auditActor(c), userID)
+	if err != nil {
+		h.subscriptionError(c, err, "cancel subscription")
+		return
+	}
+
+	c.JSON(200, subscription)
+}
+
+func (h *Handlers) ResumeSubscription(c *gin.Context) {
+	userID, ok := authenticatedUser(c, c.Param("user_id"))
+	if !ok {
+		return
+	}
+
+	provider, err := h.subscriptionProvider(userID)
+	if err != nil {
+		h.subscriptionError(c, err, "resume subscription")
+		return
+	}
+
+	subscription, err := provider.ResumeSubscription(auditActor(c), userID)
+	if err != nil {
+		h.subscriptionError(c, err, "resume subscription")
+		return
+	}
+
+	c.JSON(200, subscription)
+}
+
+func (h *Handlers) PauseSubscription(c *gin.Context) {
+	userID, ok := authenticatedUser(c, c.Param("user_id"))
+	if !ok {
+		return
+	}
+
+	var req PauseRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	provider, err := h.subscriptionProvider(userID)
+	if err != nil {
+		h.subscriptionError(c, err, "pause subscription")
+		return
+	}
+
+	subscription, err := provider.PauseSubscription(auditActor(c), userID, req.ResumesAt)
+	if err != nil {
+		h.subscriptionError(c, err, "pause subscription")
+		return
+	}
+
+	c.JSON(200, subscription)
+}
+
+func (h *Handlers) UnpauseSubscription(c *gin.Context) {
+	userID, ok := authenticatedUser(c, c.Param("user_id"))
+	if !ok {
+		return
+	}
+
+	provider, err := h.subscriptionProvider(userID)
+	if err != nil {
+		h.subscriptionError(c, err, "unpause subscription")
+		return
+	}
+
+	subscription, err := provider.UnpauseSubscription(auditActor(c), userID)
+	if err != nil {
+		h.subscriptionError(c, err, "unpause subscription")
+		return
+	}
+
+	c.JSON(200, subscription)
+}
+
+func (h *Handlers) ChangeSubscriptionPlan(c *gin.Context) {
+	userID, ok := authenticatedUser(c, c.Param("user_id"))
+	if !ok {
+		return
+	}
+
+	var req ChangePlanRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	provider, err := h.subscriptionProvider(userID)
+	if err != nil {
+		h.subscriptionError(c, err, "change plan")
+		return
+	}
+
+	subscription, err := provider.ChangeSubscriptionPlan(auditActor(c), userID, req.Plan)
+	if err != nil {
+		h.subscriptionError(c, err, "change plan")
+		return
+	}
+
+	c.JSON(200, subscription)
+}
+
+// subscriptionProvider is the billing provider the user's subscription was
+// bought from.
+func (h *Handlers) subscriptionProvider(userID string) (services.BillingProvider, error) {
+	name, err := h.Subscriptions.UserProvider(userID)
+	if err != nil {
+		return nil, err
+	}
+	provider, ok := h.BillingProviders[name]
+	if !ok {
+		return nil, fmt.Errorf("billing provider %q not configured", name)
+	}
+	return provider, nil
+}
+
+func (h *Handlers) subscriptionError(c *gin.Context, err error, action string) {
+	switch {
+	case errors.Is(err, services.ErrNoSubscription):
+		c.JSON(404, gin.H{"error": "No subscription found"})
+	case errors.Is(err, services.ErrUnknownCheckoutPlan):
+		c.JSON(400, gin.H{"error": err.Error()})
+	default:
+		log.Printf("Failed to %s: %v", action, err)
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to %s", action)})
+	}
+}
@@ -1,30 +1,51 @@
 package handlers
 
 import (
-	"crypto/hmac"
-	"crypto/sha256"
+	"database/sql"
 	"emaildrip-be/services"
-	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 type Handlers struct {
-	AI           *services.AIService
-	Email        *services.EmailService
-	LemonSqueezy *services.LemonSqueezyService
+	AI          *services.AIService
+	Email       *services.EmailService
+	Plans       *services.PlanService
+	Credits     *services.CreditService
+	Grants      *services.GrantService
+	Workspaces  *services.WorkspaceService
+	Users       *services.UserService
+	Dunning     *services.DunningService
+	Tokens      *services.TokenVerifier
+	APIKeys     *services.APIKeyService
+	RateLimits  services.RateLimitStore
+	Admin       *services.AdminService
+	Audit       *services.AuditService
+	AdminAPIKey string
+	// AllowedOrigins are the frontend origins, e.g. https://emaildrip-ai.com,
+	// that checkouts may redirect back to.
+	AllowedOrigins []string
+	LemonSqueezy   *services.LemonSqueezyService
+	Billing        services.BillingProvider // where new subscriptions are bought
+	// BillingProviders are all providers by name; existing subscriptions
+	// are managed through the one they were bought from.
+	BillingProviders map[string]services.BillingProvider
+	Subscriptions    *services.SubscriptionStore
 }
 
 type RewriteRequest struct {
 	Email  string `json:"email" binding:"required"`
-	Tone   string `json:"tone" binding:"required"`
+	Tone   string `json:"tone"` // defaults to the user's default_tone
 	Roast  bool   `json:"roast"`
-	UserID string `json:"user_id" binding:"required"`
+	UserID string `json:"user_id"` // optional; must match the token
 }
 
 type RewriteResponse struct {
@@ -32,19 +53,22 @@ type RewriteResponse struct {
 	Roast     string `json:"roast,omitempty"`
 }
 
-type LemonSqueezyWebhookPayload struct {
-	Meta LemonSqueezyMeta                  `json:"meta"`
-	Data services.LemonSqueezySubscription `json:"data"`
+type CheckoutRequest struct {
+	UserID       string `json:"user_id"` // optional; must match the token
+	Email        string `json:"email"`   // defaults to the token's email
+	Plan         string `json:"plan"`    // monthly (default), yearly or team
+	DiscountCode string `json:"discount_code"`
+	RedirectURL  string `json:"redirect_url"`
+	CustomPrice  *int   `json:"custom_price"` // in cents, staff only
+	TestMode     bool   `json:"test_mode"`
+	WorkspaceID  int64  `json:"workspace_id"` // buy for a workspace the user manages
+	Seats        int    `json:"seats"`
 }
 
-type LemonSqueezyMeta struct {
-	EventName  string                 `json:"event_name"`
-	CustomData map[string]interface{} `json:"custom_data"`
-}
-
-type CheckoutRequest struct {
-	UserID string `json:"user_id" binding:"required"`
-	Email  string `json:"email" binding:"required"`
+type CreditCheckoutRequest struct {
+	UserID    string `json:"user_id"` // optional; must match the token
+	Email     string `json:"email"`   // defaults to the token's email
+	VariantID int    `json:"variant_id" binding:"required"`
 }
 
 type CheckoutResponse struct {
@@ -58,21 +82,58 @@ func (h *Handlers) RewriteEmail(c *gin.Context) {
 		return
 	}
 
-	// Check if user can make requests (usage limit or pro status)
-	canUse, err := h.Email.CanUserMakeRequest(req.UserID)
+	userID, ok := authenticatedUser(c, req.UserID)
+	if !ok {
+		return
+	}
+
+	if req.Tone == "" {
+		user, err := h.Users.GetUser(userID)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Failed to get profile"})
+			return
+		}
+		req.Tone = user.DefaultTone
+	}
+	if req.Tone == "" {
+		c.JSON(400, gin.H{"error": "Set a tone, or a default_tone in your profile"})
+		return
+	}
+
+	// Check the request against the user's plan entitlements
+	plan, err := h.Plans.GetUserPlan(userID)
 	if err != nil {
 		c.JSON(500, gin.H{"error": "Failed to check user limits"})
 		return
 	}
 
-	if !canUse {
-		c.JSON(429, gin.H{"error": "Daily limit reached. Upgrade to Pro for unlimited emails."})
+	if len(req.Email) > plan.MaxInputLength {
+		c.JSON(413, gin.H{"error": fmt.Sprintf("Email exceeds the %d character limit of your plan", plan.MaxInputLength)})
+		return
+	}
+
+	if req.Roast && !plan.AllowRoast {
+		c.JSON(403, gin.H{"error": "Roast mode is not available on your plan"})
+		return
+	}
+
+	// Reserve a unit of quota up front so concurrent requests can't overrun the limit
+	apiKeyID := authenticatedAPIKeyID(c)
+	reservation, err := h.Email.ReserveUsage(userID, apiKeyID)
+	if errors.Is(err, services.ErrUsageLimitReached) {
+		c.JSON(429, gin.H{"error": limitReachedMessage(plan)})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to check user limits"})
 		return
 	}
 
 	// Generate AI rewrite
 	rewritten, err := h.AI.RewriteEmail(req.Email, req.Tone)
 	if err != nil {
+		h.recordAIError(userID, "rewrite", err)
+		h.releaseUsage(reservation)
 		c.JSON(500, gin.H{"error": "Failed to rewrite email"})
 		return
 	}
@@ -86,40 +147,59 @@ func (h *Handlers) RewriteEmail(c *gin.Context) {
 		roast, err := h.AI.RoastEmail(req.Email)
 		if err == nil {
 			response.Roast = roast
+		} else {
+			h.recordAIError(userID, "roast", err)
 		}
 	}
 
-	// Save to database and increment usage
+	// Save to database and consume the reservation
 	emailRecord := services.EmailRecord{
-		UserID:    req.UserID,
+		UserID:    userID,
 		Original:  req.Email,
 		Rewritten: rewritten,
 		Roast:     response.Roast,
 		Tone:      req.Tone,
 		RoastMode: req.Roast,
+		APIKeyID:  apiKeyID,
 	}
 
-	if err := h.Email.SaveEmail(emailRecord); err != nil {
+	if err := h.Email.CommitUsage(reservation, emailRecord); err != nil {
+		h.releaseUsage(reservation)
 		c.JSON(500, gin.H{"error": "Failed to save email"})
 		return
 	}
 
-	if err := h.Email.IncrementUsage(req.UserID); err != nil {
-		c.JSON(500, gin.H{"error": "Failed to update usage"})
-		return
+	c.JSON(200, response)
+}
+
+// recordAIError keeps a failed AI call for staff to look into.
+func (h *Handlers) recordAIError(userID, operation string, aiErr error) {
+	if err := h.Email.RecordAIError(userID, operation, aiErr); err != nil {
+		log.Printf("Failed to record %s error for user %s: %v", operation, userID, err)
 	}
+}
 
-	c.JSON(200, response)
+// releaseUsage returns a reservation to the user's quota. Failures are only
+// logged; a pending reservation stops counting once it goes stale.
+func (h *Handlers) releaseUsage(reservation *services.UsageReservation) {
+	if err := h.Email.ReleaseUsage(reservation); err != nil {
+		log.Printf("Failed to release usage reservation %d: %v", reservation.ID, err)
+	}
 }
 
 func (h *Handlers) GetUsage(c *gin.Context) {
-	userID := c.Param("user_id")
-	if userID == "" {
-		c.JSON(400, gin.H{"error": "User ID required"})
+	userID, ok := authenticatedUser(c, c.Param("user_id"))
+	if !ok {
+		return
+	}
+
+	plan, err := h.Plans.GetUserPlan(userID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to get plan"})
 		return
 	}
 
-	usage, err := h.Email.GetUserUsage(userID)
+	usage, err := h.Email.GetUserUsage(userID, plan)
 	if err != nil {
 		c.JSON(500, gin.H{"error": "Failed to get usage"})
 		return
@@ -131,115 +211,214 @@ func (h *Handlers) GetUsage(c *gin.Context) {
 		return
 	}
 
+	entitlement, err := h.Email.GetActiveEntitlement(userID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to check pro status"})
+		return
+	}
+
+	grant, err := h.Grants.GetActiveGrant(userID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to check pro status"})
+		return
+	}
+
+	// Set while a renewal payment is failing, for the app's banner
+	billingAlert, err := h.Dunning.GetDunningState(userID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to check pro status"})
+		return
+	}
+
 	c.JSON(200, gin.H{
-		"usage":  usage,
-		"is_pro": isPro,
-		"limit":  5,
+		"usage":         usage.Count,
+		"is_pro":        isPro,
+		"entitlement":   entitlement,
+		"grant":         grant,
+		"billing_alert": billingAlert,
+		"limit":         plan.RequestLimit,
+		"period":        plan.Period,
+		"resets_at":     usage.ResetsAt,
+		"plan":          plan,
 	})
 }
 
-func (h *Handlers) GetUserEmails(c *gin.Context) {
-	userID := c.Param("user_id")
-	if userID == "" {
-		c.JSON(400, gin.H{"error": "User ID required"})
+// maxHistoryDays bounds the range of a usage history request.
+const maxHistoryDays = 366
+
+func (h *Handlers) GetUsageHistory(c *gin.Context) {
+	userID, ok := authenticatedUser(c, c.Param("user_id"))
+	if !ok {
 		return
 	}
 
-	limitStr := c.DefaultQuery("limit", "10")
-	limit, err := strconv.Atoi(limitStr)
+	// Defaults to the last 30 days, ending today in the user's timezone
+	to, err := h.Email.Today(userID)
 	if err != nil {
-		limit = 10
+		c.JSON(500, gin.H{"error": "Failed to get usage history"})
+		return
 	}
+	from := to.AddDate(0, 0, -29)
 
-	emails, err := h.Email.GetUserEmails(userID, limit)
+	if toStr := c.Query("to"); toStr != "" {
+		parsed, err := time.Parse("2006-01-02", toStr)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "to must be a date formatted as YYYY-MM-DD"})
+			return
+		}
+		to = parsed
+		from = to.AddDate(0, 0, -29)
+	}
+
+	if fromStr := c.Query("from"); fromStr != "" {
+		parsed, err := time.Parse("2006-01-02", fromStr)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "from must be a date formatted as YYYY-MM-DD"})
+			return
+		}
+		from = parsed
+	}
+
+	if to.Before(from) {
+		c.JSON(400, gin.H{"error": "from must not be after to"})
+		return
+	}
+	if to.Sub(from) > maxHistoryDays*24*time.Hour {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Date range cannot exceed %d days", maxHistoryDays)})
+		return
+	}
+
+	history, err := h.Email.GetUsageHistory(userID, from, to)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to get emails"})
+		c.JSON(500, gin.H{"error": "Failed to get usage history"})
 		return
 	}
 
-	c.JSON(200, gin.H{"emails": emails})
+	c.JSON(200, history)
 }
 
-// verifyLemonSqueezySignature verifies the webhook signature from LemonSqueezy
-func (h *Handlers) verifyLemonSqueezySignature(payload []byte, signature string, secret string) bool {
-	mac := hmac.New(sha256.New, []byte(secret))
-	mac.Write(payload)
-	expectedMAC := hex.EncodeToString(mac.Sum(nil))
-	return hmac.Equal([]byte(signature), []byte(expectedMAC))
+type TimezoneRequest struct {
+	Timezone string `json:"timezone" binding:"required"`
 }
 
-func (h *Handlers) LemonSqueezyWebhook(c *gin.Context) {
-	payload, err := io.ReadAll(c.Request.Body)
+func (h *Handlers) SetTimezone(c *gin.Context) {
+	userID, ok := authenticatedUser(c, c.Param("user_id"))
+	if !ok {
+		return
+	}
+
+	var req TimezoneRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := h.Email.SetUserTimezone(auditActor(c), userID, req.Timezone)
+	if errors.Is(err, services.ErrInvalidTimezone) {
+		c.JSON(400, gin.H{"error": "Invalid timezone"})
+		return
+	}
+	if err == sql.ErrNoRows {
+		c.JSON(404, gin.H{"error": "User not found"})
+		return
+	}
 	if err != nil {
-		c.JSON(400, gin.H{"error": "Invalid payload"})
+		c.JSON(500, gin.H{"error": "Failed to update timezone"})
 		return
 	}
 
-	// Verify webhook signature
-	signature := c.GetHeader("X-Signature")
-	if !h.verifyLemonSqueezySignature(payload, signature, h.LemonSqueezy.WebhookSecret) {
-		c.JSON(400, gin.H{"error": "Invalid signature"})
+	c.JSON(200, gin.H{"timezone": req.Timezone})
+}
+
+func limitReachedMessage(plan *services.Plan) string {
+	if plan.Period == services.PeriodMonthly {
+		return "Monthly limit reached. Upgrade your plan for more emails."
+	}
+	return "Daily limit reached. Upgrade to Pro or buy credits for more emails."
+}
+
+func (h *Handlers) GetUserEmails(c *gin.Context) {
+	userID, ok := authenticatedUser(c, c.Param("user_id"))
+	if !ok {
 		return
 	}
 
-	// Parse webhook payload
-	var webhookPayload LemonSqueezyWebhookPayload
-	if err := json.Unmarshal(payload, &webhookPayload); err != nil {
-		c.JSON(400, gin.H{"error": "Invalid JSON payload"})
+	limitStr := c.DefaultQuery("limit", "10")
+	limit, err := strconv.Atoi(limitStr)
+	if err != nil {
+		limit = 10
+	}
+
+	emails, err := h.Email.GetUserEmails(userID, limit)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to get emails"})
 		return
 	}
 
-	// Handle different event types
-	switch webhookPayload.Meta.EventName {
-	case "subscription_created":
-		if err := h.LemonSqueezy.HandleSubscriptionCreated(webhookPayload.Data); err != nil {
-			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to handle subscription creation: %v", err)})
-			return
-		}
+	c.JSON(200, gin.H{"emails": emails})
+}
 
-	case "subscription_updated":
-		if err := h.LemonSqueezy.HandleSubscriptionUpdated(webhookPayload.Data); err != nil {
-			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to handle subscription update %v", err)})
+// BillingWebhook receives webhooks from a billing provider.
+func (h *Handlers) BillingWebhook(provider services.BillingProvider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		payload, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Invalid payload"})
 			return
 		}
 
-	case "subscription_cancelled":
-		if err := h.LemonSqueezy.HandleSubscriptionCancelled(webhookPayload.Data); err != nil {
-			c.JSON(500, gin.H{"error": "Failed to handle subscription cancellation"})
+		// Verify webhook signature
+		delivery, err := provider.ParseWebhook(payload, c.Request.Header)
+		if errors.Is(err, services.ErrInvalidWebhookSignature) {
+			c.JSON(400, gin.H{"error": "Invalid signature"})
 			return
 		}
-
-	case "subscription_resumed":
-		if err := h.LemonSqueezy.HandleSubscriptionResumed(webhookPayload.Data); err != nil {
-			c.JSON(500, gin.H{"error": "Failed to handle subscription resumption"})
+		if errors.Is(err, services.ErrInvalidWebhookPayload) {
+			c.JSON(400, gin.H{"error": "Invalid JSON payload"})
 			return
 		}
-
-	case "subscription_expired":
-		if err := h.LemonSqueezy.HandleSubscriptionExpired(webhookPayload.Data); err != nil {
-			c.JSON(500, gin.H{"error": "Failed to handle subscription expiration"})
+		if err != nil {
+			log.Printf("%s webhook failed: %v", provider.Name(), err)
+			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to handle webhook: %v", err)})
 			return
 		}
 
-	case "subscription_paused":
-		if err := h.LemonSqueezy.HandleSubscriptionPaused(webhookPayload.Data); err != nil {
-			c.JSON(500, gin.H{"error": "Failed to handle subscription pause"})
+		delivery.RequestID = c.GetString(requestIDKey)
+		delivery.IP = c.ClientIP()
+
+		// Apply the event; retries of an applied delivery are no-ops
+		event, err := provider.HandleWebhook(delivery)
+		if err != nil {
+			log.Printf("%s webhook failed: %v", provider.Name(), err)
+			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to handle webhook: %v", err)})
 			return
 		}
 
-	case "subscription_unpaused":
-		if err := h.LemonSqueezy.HandleSubscriptionUnpaused(webhookPayload.Data); err != nil {
-			c.JSON(500, gin.H{"error": "Failed to handle subscription unpause"})
+		if event.Status == services.WebhookStatusIgnored {
+			// Log unknown event type but return success to avoid retries
+			c.JSON(200, gin.H{"message": "Unknown event type", "event": event.EventName})
 			return
 		}
 
-	default:
-		// Log unknown event type but return success to avoid retries
-		c.JSON(200, gin.H{"message": "Unknown event type", "event": webhookPayload.Meta.EventName})
-		return
+		c.JSON(200, gin.H{"received": true, "duplicate": event.Duplicate, "status": event.Status})
 	}
+}
 
-	c.JSON(200, gin.H{"received": true})
+// isAllowedRedirect reports whether a checkout may send the customer back to
+// rawURL, which must be on one of AllowedOrigins so checkouts can't be used
+// to redirect to arbitrary sites.
+func (h *Handlers) isAllowedRedirect(rawURL string) bool {
+	redirect, err := url.Parse(rawURL)
+	if err != nil || redirect.User != nil {
+		return false
+	}
+	origin := redirect.Scheme + "://" + redirect.Host
+	for _, allowed := range h.AllowedOrigins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+	return false
 }
 
 func (h *Handlers) CreateCheckout(c *gin.Context) {
@@ -249,17 +428,73 @@ func (h *Handlers) CreateCheckout(c *gin.Context) {
 		return
 	}
 
-	// Validate required fields
-	if req.UserID == "" || req.Email == "" {
-		c.JSON(400, gin.H{"error": "user_id and email are required"})
+	userID, ok := authenticatedUser(c, req.UserID)
+	if !ok {
+		return
+	}
+	if req.Email == "" {
+		req.Email = authenticatedEmail(c)
+	}
+	if req.Email == "" {
+		c.JSON(400, gin.H{"error": "email is required"})
+		return
+	}
+
+	if req.RedirectURL != "" && !h.isAllowedRedirect(req.RedirectURL) {
+		c.JSON(400, gin.H{"error": "redirect_url must be on one of our own sites"})
 		return
 	}
 
-	// Create checkout session with LemonSqueezy
-	checkoutURL, err := h.LemonSqueezy.CreateCheckoutSession(req.UserID, req.Email)
+	// Anyone could otherwise buy Pro for a cent, or with a test card
+	if req.CustomPrice != nil && !h.isAdminRequest(c) {
+		c.JSON(403, gin.H{"error": "custom_price can only be set by staff"})
+		return
+	}
+	if req.TestMode && !h.isAdminRequest(c) {
+		c.JSON(403, gin.H{"error": "test_mode can only be set by staff"})
+		return
+	}
+
+	if req.Seats < 0 || (req.Seats > 1 && req.WorkspaceID == 0) {
+		c.JSON(400, gin.H{"error": "seats can only be bought for a workspace"})
+		return
+	}
+
+	if req.WorkspaceID != 0 {
+		canManage, err := h.Workspaces.CanManage(req.WorkspaceID, userID)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Failed to check workspace"})
+			return
+		}
+		if !canManage {
+			c.JSON(403, gin.H{"error": "Only workspace owners and admins can buy for a workspace"})
+			return
+		}
+	}
+
+	opts := services.CheckoutOptions{
+		Plan:         req.Plan,
+		DiscountCode: req.DiscountCode,
+		RedirectURL:  req.RedirectURL,
+		CustomPrice:  req.CustomPrice,
+		TestMode:     req.TestMode,
+		WorkspaceID:  req.WorkspaceID,
+		Seats:        req.Seats,
+	}
+
+	// Create checkout session with the configured provider
+	checkoutURL, err := h.Billing.CreateCheckout(userID, req.Email, opts)
+	if errors.Is(err, services.ErrUnknownCheckoutPlan) {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Unknown plan %q", req.Plan)})
+		return
+	}
+	if errors.Is(err, services.ErrUnsupportedCheckoutOption) {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		// Log the detailed error for debugging
-		log.Printf("LemonSqueezy checkout creation failed: %v", err)
+		log.Printf("%s checkout creation failed: %v", h.Billing.Name(), err)
 		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to create checkout session: %v", err)})
 		return
 	}
@@ -274,3 +509,130 @@ func (h *Handlers) CreateCheckout(c *gin.Context) {
 		URL: checkoutURL,
 	})
 }
+
+func (h *Handlers) GetCreditBalance(c *gin.Context) {
+	userID, ok := authenticatedUser(c, c.Param("user_id"))
+	if !ok {
+		return
+	}
+
+	balance, err := h.Credits.GetBalance(userID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to get credit balance"})
+		return
+	}
+
+	c.JSON(200, gin.H{"balance": balance})
+}
+
+func (h *Handlers) GetCreditLedger(c *gin.Context) {
+	userID, ok := authenticatedUser(c, c.Param("user_id"))
+	if !ok {
+		return
+	}
+
+	limitStr := c.DefaultQuery("limit", "50")
+	limit, err := strconv.Atoi(limitStr)
+	if err != nil {
+		limit = 50
+	}
+
+	entries, err := h.Credits.GetLedger(userID, limit)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to get credit history"})
+		return
+	}
+
+	c.JSON(200, gin.H{"entries": entries})
+}
+
+func (h *Handlers) GetCreditPacks(c *gin.Context) {
+	packs, err := h.Credits.ListPacks()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to get credit packs"})
+		return
+	}
+
+	c.JSON(200, gin.H{"packs": packs})
+}
+
+// requireLemonSqueezyBilling answers 501 unless LemonSqueezy is the configured
+// billing provider, for features only it supports.
+func (h *Handlers) requireLemonSqueezyBilling(c *gin.Context) bool {
+	if h.Billing.Name() != services.BillingProviderLemonSqueezy {
+		c.JSON(501, gin.H{"error": fmt.Sprintf("Not available with the %s billing provider", h.Billing.Name())})
+		return false
+	}
+	return true
+}
+
+// CreateCreditCheckout sells credit packs, which are LemonSqueezy variants.
+func (h *Handlers) CreateCreditCheckout(c *gin.Context) {
+	if !h.requireLemonSqueezyBilling(c) {
+		return
+	}
+
+	var req CreditCheckoutRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid request: %v", err)})
+		return
+	}
+
+	userID, ok := authenticatedUser(c, req.UserID)
+	if !ok {
+		return
+	}
+	if req.Email == "" {
+		req.Email = authenticatedEmail(c)
+	}
+	if req.Email == "" {
+		c.JSON(400, gin.H{"error": "email is required"})
+		return
+	}
+
+	pack, err := h.Credits.GetPack(req.VariantID)
+	if err == sql.ErrNoRows {
+		c.JSON(400, gin.H{"error": "Unknown credit pack"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to look up credit pack"})
+		return
+	}
+
+	checkoutURL, err := h.LemonSqueezy.CreateCreditCheckoutSession(userID, req.Email, pack)
+	if err != nil {
+		log.Printf("LemonSqueezy credit checkout creation failed: %v", err)
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to create checkout session: %v", err)})
+		return
+	}
+
+	c.JSON(200, CheckoutResponse{
+		URL: checkoutURL,
+	})
+}
+
+// GetBillingHistory lists the payments recorded from LemonSqueezy webhooks.
+func (h *Handlers) GetBillingHistory(c *gin.Context) {
+	userID, ok := authenticatedUser(c, c.Param("user_id"))
+	if !ok {
+		return
+	}
+	if !h.requireLemonSqueezyBilling(c) {
+		return
+	}
+
+	limitStr := c.DefaultQuery("limit", "50")
+	limit, err := strconv.Atoi(limitStr)
+	if err != nil {
+		limit = 50
+	}
+
+	payments, err := h.LemonSqueezy.GetBillingHistory(userID, limit)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to get billing history"})
+		return
+	}
+
+	c.JSON(200, gin.H{"payments": payments})
+}
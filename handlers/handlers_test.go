@@ -0,0 +1,241 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"emaildrip-be/databases"
+	"emaildrip-be/services"
+
+	"github.com/gin-gonic/gin"
+	_ "github.com/lib/pq"
+)
+
+const (
+	testWebhookSecret = "test-webhook-secret"
+	testAdminKey      = "test-admin-key"
+	testJWTSecret     = "test-jwt-secret"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// openTestDB connects to the Postgres database in TEST_DATABASE_URL and
+// migrates it, skipping the test when it isn't set.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	databases.Migrate(db)
+	return db
+}
+
+func newTestUUID(t *testing.T) string {
+	t.Helper()
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func createTestUser(t *testing.T, db *sql.DB) string {
+	t.Helper()
+	userID := newTestUUID(t)
+	if _, err := db.Exec(`INSERT INTO users (id, email) VALUES ($1, $2)`, userID, userID+"@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	return userID
+}
+
+// newTestHandlers wires the handlers to db the way main does. Tests that
+// never reach the database can pass nil.
+func newTestHandlers(db *sql.DB) *Handlers {
+	plans := services.NewPlanService(db)
+	email := services.NewEmailService(db, plans)
+	lemonSqueezy := services.NewLemonSqueezyService("test-api-key", testWebhookSecret, db)
+	return &Handlers{
+		Email:            email,
+		Plans:            plans,
+		Credits:          services.NewCreditService(db),
+		Grants:           services.NewGrantService(db),
+		Workspaces:       services.NewWorkspaceService(db),
+		Users:            services.NewUserService(db),
+		Tokens:           services.NewTokenVerifier(testJWTSecret, ""),
+		APIKeys:          services.NewAPIKeyService(db),
+		RateLimits:       services.NewMemoryRateLimitStore(),
+		Admin:            services.NewAdminService(db, plans, email),
+		Audit:            services.NewAuditService(db),
+		AdminAPIKey:      testAdminKey,
+		LemonSqueezy:     lemonSqueezy,
+		Billing:          lemonSqueezy,
+		BillingProviders: map[string]services.BillingProvider{lemonSqueezy.Name(): lemonSqueezy},
+		Subscriptions:    services.NewSubscriptionStore(db),
+	}
+}
+
+// serve sends a request with a JSON body, if any, through the router.
+func serve(router http.Handler, method, path string, body interface{}, header http.Header) *httptest.ResponseRecorder {
+	var reader *bytes.Reader
+	switch body := body.(type) {
+	case nil:
+		reader = bytes.NewReader(nil)
+	case []byte:
+		reader = bytes.NewReader(body)
+	default:
+		data, err := json.Marshal(body)
+		if err != nil {
+			panic(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func decodeResponse(t *testing.T, rec *httptest.ResponseRecorder) map[string]interface{} {
+	t.Helper()
+	var body map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("response %q isn't JSON: %v", rec.Body.String(), err)
+	}
+	return body
+}
+
+func webhookRouter(h *Handlers) *gin.Engine {
+	r := gin.New()
+	r.POST("/api/lemonsqueezy/webhook", h.BillingWebhook(h.LemonSqueezy))
+	return r
+}
+
+// lemonSqueezyWebhook builds a subscription webhook bought by userID and the
+// headers that sign it.
+func lemonSqueezyWebhook(t *testing.T, eventName, subscriptionID, userID string) ([]byte, http.Header) {
+	t.Helper()
+	now := time.Now().UTC().Truncate(time.Second)
+	var subscription services.LemonSqueezySubscription
+	subscription.ID = subscriptionID
+	subscription.Type = "subscriptions"
+	subscription.Attributes.Status = services.SubscriptionActive
+	subscription.Attributes.UserEmail = userID + "@example.com"
+	subscription.Attributes.CreatedAt = now
+	subscription.Attributes.UpdatedAt = now
+	subscription.Attributes.RenewsAt = now.Add(30 * 24 * time.Hour)
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"meta": map[string]interface{}{
+			"event_name":  eventName,
+			"custom_data": map[string]string{"user_id": userID},
+		},
+		"data": subscription,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload, signWebhook(payload, testWebhookSecret)
+}
+
+func signWebhook(payload []byte, secret string) http.Header {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return http.Header{"X-Signature": {hex.EncodeToString(mac.Sum(nil))}}
+}
+
+// newTestSubscriptionID returns a LemonSqueezy style numeric ID.
+func newTestSubscriptionID() string {
+	return strconv.FormatInt(time.Now().UnixNano()%1_000_000_000, 10)
+}
+
+func TestBillingWebhookRejectsBadSignature(t *testing.T) {
+	h := newTestHandlers(nil) // a rejected delivery never reaches the database
+	payload, _ := lemonSqueezyWebhook(t, "subscription_created", newTestSubscriptionID(), newTestUUID(t))
+
+	for name, header := range map[string]http.Header{
+		"unsigned":        nil,
+		"wrong secret":    signWebhook(payload, "other-secret"),
+		"other payload":   signWebhook([]byte(`{}`), testWebhookSecret),
+		"empty signature": {"X-Signature": {""}},
+	} {
+		rec := serve(webhookRouter(h), "POST", "/api/lemonsqueezy/webhook", payload, header)
+		if rec.Code != 400 {
+			t.Errorf("%s: status = %d, want 400", name, rec.Code)
+		}
+	}
+}
+
+func TestBillingWebhookDeduplicatesRetries(t *testing.T) {
+	db := openTestDB(t)
+	h := newTestHandlers(db)
+	userID := createTestUser(t, db)
+	subscriptionID := newTestSubscriptionID()
+	payload, header := lemonSqueezyWebhook(t, "subscription_created", subscriptionID, userID)
+
+	first := serve(webhookRouter(h), "POST", "/api/lemonsqueezy/webhook", payload, header)
+	if first.Code != 200 {
+		t.Fatalf("first delivery status = %d: %s", first.Code, first.Body)
+	}
+	if body := decodeResponse(t, first); body["duplicate"] != false || body["status"] != services.WebhookStatusProcessed {
+		t.Fatalf("first delivery = %v, want processed and not a duplicate", body)
+	}
+
+	// The same delivery again, as LemonSqueezy retries it
+	retry := serve(webhookRouter(h), "POST", "/api/lemonsqueezy/webhook", payload, header)
+	if retry.Code != 200 {
+		t.Fatalf("retry status = %d: %s", retry.Code, retry.Body)
+	}
+	if body := decodeResponse(t, retry); body["duplicate"] != true {
+		t.Fatalf("retry = %v, want a duplicate", body)
+	}
+
+	var events, subscriptions, attempts int
+	err := db.QueryRow(`
+		SELECT COUNT(*), COALESCE(MAX(attempts), 0) FROM webhook_events WHERE resource_id = $1
+	`, subscriptionID).Scan(&events, &attempts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if events != 1 || attempts != 1 {
+		t.Errorf("logged %d events with %d attempts, want the delivery once with 1 attempt", events, attempts)
+	}
+	err = db.QueryRow(`
+		SELECT COUNT(*) FROM subscriptions WHERE lemonsqueezy_subscription_id = $1 AND user_id = $2
+	`, subscriptionID, userID).Scan(&subscriptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subscriptions != 1 {
+		t.Errorf("found %d subscriptions for the delivery, want 1", subscriptions)
+	}
+}
@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestIDKey is the context key of the ID set by RequestID.
+const requestIDKey = "request_id"
+
+// validRequestID matches request IDs worth keeping from a proxy or client.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// RequestID gives every request an ID, echoed in the X-Request-ID response
+// header and recorded with the audit log entries the request causes. An ID
+// set by a proxy in front of the API is kept.
+func (h *Handlers) RequestID(c *gin.Context) {
+	id := c.GetHeader("X-Request-ID")
+	if !validRequestID.MatchString(id) {
+		b := make([]byte, 16)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+
+	c.Set(requestIDKey, id)
+	c.Header("X-Request-ID", id)
+	c.Next()
+}
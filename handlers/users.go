@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"emaildrip-be/services"
+	"errors"
+	"log"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ProfileRequest changes the fields it sets; an empty name, default_tone or
+// language clears it.
+type ProfileRequest struct {
+	Name        *string `json:"name"`
+	Timezone    *string `json:"timezone"`     // IANA name, e.g. Europe/Berlin
+	DefaultTone *string `json:"default_tone"` // Polite, Funny, Direct or Karen
+	Language    *string `json:"language"`     // BCP 47 tag, e.g. en or pt-BR
+}
+
+// GetProfile returns the user's account, including whether it is scheduled
+// for deletion.
+func (h *Handlers) GetProfile(c *gin.Context) {
+	userID, ok := authenticatedUser(c, c.Param("user_id"))
+	if !ok {
+		return
+	}
+
+	user, err := h.Users.GetUser(userID)
+	if errors.Is(err, services.ErrUserNotFound) {
+		c.JSON(404, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to get user %s: %v", userID, err)
+		c.JSON(500, gin.H{"error": "Failed to get profile"})
+		return
+	}
+
+	c.JSON(200, user)
+}
+
+func (h *Handlers) UpdateProfile(c *gin.Context) {
+	userID, ok := authenticatedUser(c, c.Param("user_id"))
+	if !ok {
+		return
+	}
+
+	var req ProfileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := h.Users.UpdateProfile(auditActor(c), userID, services.ProfileUpdate{
+		Name:        req.Name,
+		Timezone:    req.Timezone,
+		DefaultTone: req.DefaultTone,
+		Language:    req.Language,
+	})
+	if errors.Is(err, services.ErrInvalidTimezone) {
+		c.JSON(400, gin.H{"error": "Invalid timezone"})
+		return
+	}
+	if errors.Is(err, services.ErrInvalidProfile) {
+		c.JSON(400, gin.H{"error": "name must be at most 100 characters, default_tone one of Polite, Funny, Direct or Karen, and language a language tag such as en"})
+		return
+	}
+	if errors.Is(err, services.ErrUserNotFound) {
+		c.JSON(404, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to update profile of user %s: %v", userID, err)
+		c.JSON(500, gin.H{"error": "Failed to update profile"})
+		return
+	}
+
+	c.JSON(200, user)
+}
+
+// DeleteAccount schedules the account for deletion. It can be restored until
+// purge_after, when it is deleted with everything it owns.
+func (h *Handlers) DeleteAccount(c *gin.Context) {
+	userID, ok := authenticatedUser(c, c.Param("user_id"))
+	if !ok {
+		return
+	}
+
+	user, err := h.Users.DeleteAccount(auditActor(c), userID)
+	if errors.Is(err, services.ErrSubscriptionActive) {
+		c.JSON(409, gin.H{"error": "Cancel your subscription before deleting your account"})
+		return
+	}
+	if errors.Is(err, services.ErrOwnsWorkspace) {
+		c.JSON(409, gin.H{"error": "Remove the other members of your workspaces before deleting your account"})
+		return
+	}
+	if errors.Is(err, services.ErrUserNotFound) {
+		c.JSON(404, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to delete user %s: %v", userID, err)
+		c.JSON(500, gin.H{"error": "Failed to delete account"})
+		return
+	}
+
+	c.JSON(202, user)
+}
+
+// RestoreAccount cancels a scheduled deletion.
+func (h *Handlers) RestoreAccount(c *gin.Context) {
+	userID, ok := authenticatedUser(c, c.Param("user_id"))
+	if !ok {
+		return
+	}
+
+	user, err := h.Users.RestoreAccount(auditActor(c), userID)
+	if errors.Is(err, services.ErrAccountNotDeleted) {
+		c.JSON(409, gin.H{"error": "Account is not scheduled for deletion"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to restore user %s: %v", userID, err)
+		c.JSON(500, gin.H{"error": "Failed to restore account"})
+		return
+	}
+
+	c.JSON(200, user)
+}
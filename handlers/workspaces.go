@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"emaildrip-be/services"
+	"errors"
+	"log"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type CreateWorkspaceRequest struct {
+	UserID string `json:"user_id"` // optional; must match the token
+	Name   string `json:"name" binding:"required"`
+}
+
+type InviteRequest struct {
+	UserID string `json:"user_id"` // the inviter; optional, must match the token
+	Email  string `json:"email" binding:"required,email"`
+	Role   string `json:"role"` // member (default) or admin
+}
+
+type AcceptInvitationRequest struct {
+	UserID string `json:"user_id"` // optional; must match the token
+	Token  string `json:"token" binding:"required"`
+}
+
+func (h *Handlers) CreateWorkspace(c *gin.Context) {
+	var req CreateWorkspaceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, ok := authenticatedUser(c, req.UserID)
+	if !ok {
+		return
+	}
+
+	workspace, err := h.Workspaces.CreateWorkspace(auditActor(c), userID, req.Name)
+	if err != nil {
+		h.workspaceError(c, err, "create workspace")
+		return
+	}
+
+	c.JSON(201, workspace)
+}
+
+func (h *Handlers) ListWorkspaces(c *gin.Context) {
+	userID, ok := authenticatedUser(c, c.Param("user_id"))
+	if !ok {
+		return
+	}
+
+	workspaces, err := h.Workspaces.ListWorkspaces(userID)
+	if err != nil {
+		h.workspaceError(c, err, "list workspaces")
+		return
+	}
+
+	c.JSON(200, gin.H{"workspaces": workspaces})
+}
+
+func (h *Handlers) GetWorkspace(c *gin.Context) {
+	workspaceID, ok := workspaceIDParam(c)
+	if !ok {
+		return
+	}
+	userID, ok := authenticatedUser(c, c.Query("user_id"))
+	if !ok {
+		return
+	}
+
+	workspace, members, err := h.Workspaces.GetWorkspace(workspaceID, userID)
+	if err != nil {
+		h.workspaceError(c, err, "get workspace")
+		return
+	}
+
+	c.JSON(200, gin.H{"workspace": workspace, "members": members})
+}
+
+func (h *Handlers) InviteWorkspaceMember(c *gin.Context) {
+	workspaceID, ok := workspaceIDParam(c)
+	if !ok {
+		return
+	}
+
+	var req InviteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, ok := authenticatedUser(c, req.UserID)
+	if !ok {
+		return
+	}
+
+	invitation, err := h.Workspaces.InviteMember(workspaceID, userID, req.Email, req.Role)
+	if err != nil {
+		h.workspaceError(c, err, "invite member")
+		return
+	}
+
+	c.JSON(201, invitation)
+}
+
+func (h *Handlers) AcceptInvitation(c *gin.Context) {
+	var req AcceptInvitationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, ok := authenticatedUser(c, req.UserID)
+	if !ok {
+		return
+	}
+
+	workspace, err := h.Workspaces.AcceptInvitation(auditActor(c), req.Token, userID)
+	if err != nil {
+		h.workspaceError(c, err, "accept invitation")
+		return
+	}
+
+	c.JSON(200, workspace)
+}
+
+func (h *Handlers) RemoveWorkspaceMember(c *gin.Context) {
+	workspaceID, ok := workspaceIDParam(c)
+	if !ok {
+		return
+	}
+	userID, ok := authenticatedUser(c, c.Query("user_id"))
+	if !ok {
+		return
+	}
+
+	err := h.Workspaces.RemoveMember(auditActor(c), workspaceID, userID, c.Param("member_id"))
+	if err != nil {
+		h.workspaceError(c, err, "remove member")
+		return
+	}
+
+	c.JSON(200, gin.H{"removed": true})
+}
+
+func workspaceIDParam(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("workspace_id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid workspace ID"})
+		return 0, false
+	}
+	return id, true
+}
+
+// workspaceError maps workspace service errors to responses.
+func (h *Handlers) workspaceError(c *gin.Context, err error, action string) {
+	switch {
+	case errors.Is(err, services.ErrWorkspaceNotFound):
+		c.JSON(404, gin.H{"error": "Workspace not found"})
+	case errors.Is(err, services.ErrUserNotFound):
+		c.JSON(404, gin.H{"error": "User not found"})
+	case errors.Is(err, services.ErrWorkspaceForbidden):
+		c.JSON(403, gin.H{"error": "Only workspace owners and admins can do this"})
+	case errors.Is(err, services.ErrCannotRemoveOwner):
+		c.JSON(403, gin.H{"error": "The workspace owner can't be removed"})
+	case errors.Is(err, services.ErrNoSeatsAvailable):
+		c.JSON(409, gin.H{"error": "All seats are taken; add seats to the workspace subscription first"})
+	case errors.Is(err, services.ErrInvitationNotFound):
+		c.JSON(404, gin.H{"error": "Invitation not found or expired"})
+	case errors.Is(err, services.ErrInvitationEmailMismatch):
+		c.JSON(403, gin.H{"error": "This invitation was sent to a different email address"})
+	case errors.Is(err, services.ErrInvalidRole):
+		c.JSON(400, gin.H{"error": "role must be member or admin"})
+	default:
+		log.Printf("Failed to %s: %v", action, err)
+		c.JSON(500, gin.H{"error": "Failed to " + action})
+	}
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
 	"emaildrip-be/databases"
 	"emaildrip-be/handlers"
 	"emaildrip-be/services"
+	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // user timezones must resolve even without system zoneinfo
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -21,46 +27,312 @@ func main() {
 	db := databases.InitDB()
 	defer db.Close()
 
+	// Apply schema changes owned by this service
+	databases.Migrate(db)
+
 	// Initialize services
 	aiService := services.NewAIService(os.Getenv("OPENROUTER_API_KEY"))
-	emailService := services.NewEmailService(db)
+	planService := services.NewPlanService(db)
+	emailService := services.NewEmailService(db, planService)
+	creditService := services.NewCreditService(db)
+	grantService := services.NewGrantService(db)
+	workspaceService := services.NewWorkspaceService(db)
+	apiKeyService := services.NewAPIKeyService(db)
+	userService := services.NewUserService(db)
+	if graceDays := os.Getenv("ACCOUNT_DELETION_GRACE_DAYS"); graceDays != "" {
+		days, err := strconv.Atoi(graceDays)
+		if err != nil || days < 0 {
+			log.Fatalf("Invalid ACCOUNT_DELETION_GRACE_DAYS %q", graceDays)
+		}
+		services.AccountDeletionGracePeriod = time.Duration(days) * 24 * time.Hour
+	}
+	adminService := services.NewAdminService(db, planService, emailService)
+	auditService := services.NewAuditService(db)
 	lemonSqueezyService := services.NewLemonSqueezyService(
 		os.Getenv("LEMONSQUEEZY_API_KEY"),
 		os.Getenv("LEMONSQUEEZY_WEBHOOK_SECRET"),
 		db,
 	)
+	if apiURL := os.Getenv("LEMONSQUEEZY_API_URL"); apiURL != "" {
+		lemonSqueezyService.BaseURL = apiURL
+	}
+	lemonSqueezyService.StoreID = os.Getenv("LEMONSQUEEZY_STORE_ID")
+	lemonSqueezyService.AllowTestMode = os.Getenv("LEMONSQUEEZY_TEST_MODE") == "true"
+	for plan, env := range map[string]string{
+		services.CheckoutPlanMonthly: "LEMONSQUEEZY_VARIANT_MONTHLY",
+		services.CheckoutPlanYearly:  "LEMONSQUEEZY_VARIANT_YEARLY",
+		services.CheckoutPlanTeam:    "LEMONSQUEEZY_VARIANT_TEAM",
+	} {
+		if variantID := os.Getenv(env); variantID != "" {
+			lemonSqueezyService.Variants[plan] = variantID
+		}
+	}
+	if err := lemonSqueezyService.SyncPlanVariants(); err != nil {
+		log.Fatalf("Failed to sync LemonSqueezy variants: %v", err)
+	}
+	stripeService := services.NewStripeService(
+		os.Getenv("STRIPE_SECRET_KEY"),
+		os.Getenv("STRIPE_WEBHOOK_SECRET"),
+		db,
+	)
+	stripeService.SuccessURL = os.Getenv("STRIPE_SUCCESS_URL")
+	stripeService.CancelURL = os.Getenv("STRIPE_CANCEL_URL")
+	stripeService.PortalReturnURL = os.Getenv("STRIPE_PORTAL_RETURN_URL")
+	for plan, env := range map[string]string{
+		services.CheckoutPlanMonthly: "STRIPE_PRICE_MONTHLY",
+		services.CheckoutPlanYearly:  "STRIPE_PRICE_YEARLY",
+		services.CheckoutPlanTeam:    "STRIPE_PRICE_TEAM",
+	} {
+		if priceID := os.Getenv(env); priceID != "" {
+			stripeService.Prices[plan] = priceID
+		}
+	}
+	billingProviders := map[string]services.BillingProvider{
+		services.BillingProviderLemonSqueezy: lemonSqueezyService,
+		services.BillingProviderStripe:       stripeService,
+	}
+	billingProviderName := os.Getenv("BILLING_PROVIDER")
+	if billingProviderName == "" {
+		billingProviderName = services.BillingProviderLemonSqueezy
+	}
+	billingProvider, ok := billingProviders[billingProviderName]
+	if !ok {
+		log.Fatalf("Unknown BILLING_PROVIDER %q", billingProviderName)
+	}
+	if billingProviderName == services.BillingProviderLemonSqueezy {
+		if lemonSqueezyService.StoreID == "" {
+			log.Fatal("LEMONSQUEEZY_STORE_ID is required")
+		}
+		if lemonSqueezyService.Variants[services.CheckoutPlanMonthly] == "" {
+			log.Fatal("LEMONSQUEEZY_VARIANT_MONTHLY is required")
+		}
+	}
+	if graceDays := os.Getenv("DUNNING_GRACE_DAYS"); graceDays != "" {
+		days, err := strconv.Atoi(graceDays)
+		if err != nil || days < 0 {
+			log.Fatalf("Invalid DUNNING_GRACE_DAYS %q", graceDays)
+		}
+		services.PaymentGracePeriod = time.Duration(days) * 24 * time.Hour
+	}
+	var mailer services.Mailer = services.LogMailer{}
+	if smtpAddr := os.Getenv("SMTP_ADDR"); smtpAddr != "" {
+		mailer = &services.SMTPMailer{
+			Addr:     smtpAddr,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("SMTP_FROM"),
+		}
+	}
+	workspaceService.Mailer = mailer
+	workspaceService.InvitationURL = os.Getenv("WORKSPACE_INVITATION_URL")
+	dunningService := services.NewDunningService(db, mailer)
+	dunningService.BillingURL = os.Getenv("DUNNING_BILLING_URL")
+	if emailDays := os.Getenv("DUNNING_EMAIL_DAYS"); emailDays != "" {
+		dunningService.Steps = nil
+		for _, day := range strings.Split(emailDays, ",") {
+			parsed, err := strconv.Atoi(strings.TrimSpace(day))
+			if err != nil || parsed < 0 {
+				log.Fatalf("Invalid DUNNING_EMAIL_DAYS %q", emailDays)
+			}
+			dunningService.Steps = append(dunningService.Steps, parsed)
+		}
+	}
+	billingWorker := services.NewBillingWorker(db, lemonSqueezyService, 15*time.Minute)
+	billingWorker.Dunning = dunningService
+	billingWorker.Users = userService
+	if interval := os.Getenv("BILLING_WORKER_INTERVAL"); interval != "" {
+		parsed, err := time.ParseDuration(interval)
+		if err != nil {
+			log.Fatalf("Invalid BILLING_WORKER_INTERVAL: %v", err)
+		}
+		billingWorker.Interval = parsed
+	}
+
+	// Admin subcommands run against the database and exit
+	if len(os.Args) > 1 {
+		var err error
+		switch os.Args[1] {
+		case "webhooks":
+			err = runWebhooksCommand(os.Args[2:], lemonSqueezyService)
+		case "reconcile":
+			err = billingWorker.RunOnce(context.Background())
+		case "usage":
+			err = runUsageCommand(os.Args[2:], lemonSqueezyService)
+		default:
+			err = fmt.Errorf("unknown command %q", os.Args[1])
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	tokenVerifier := services.NewTokenVerifier(os.Getenv("AUTH_JWT_SECRET"), os.Getenv("AUTH_JWKS_URL"))
+	tokenVerifier.Issuer = os.Getenv("AUTH_ISSUER")
+	tokenVerifier.Audience = os.Getenv("AUTH_AUDIENCE")
+	if !tokenVerifier.Configured() {
+		log.Println("Neither AUTH_JWT_SECRET nor AUTH_JWKS_URL is set; all authenticated requests will be rejected")
+	}
+
+	var rateLimitStore services.RateLimitStore
+	switch store := os.Getenv("RATE_LIMIT_STORE"); store {
+	case "", "memory":
+		rateLimitStore = services.NewMemoryRateLimitStore()
+	case "postgres":
+		rateLimitStore = services.NewPostgresRateLimitStore(db)
+	default:
+		log.Fatalf("Unknown RATE_LIMIT_STORE %q", store)
+	}
+
+	// Frontends allowed to call the API and to be returned to after checkout
+	allowedOrigins := []string{"http://localhost:5173", "https://emaildrip.vercel.app", "https://emaildrip-ai.com"}
 
 	// Initialize handlers
 	handlers := &handlers.Handlers{
-		AI:           aiService,
-		Email:        emailService,
-		LemonSqueezy: lemonSqueezyService,
+		AI:               aiService,
+		Email:            emailService,
+		Plans:            planService,
+		Credits:          creditService,
+		Grants:           grantService,
+		Workspaces:       workspaceService,
+		Users:            userService,
+		Dunning:          dunningService,
+		Tokens:           tokenVerifier,
+		APIKeys:          apiKeyService,
+		RateLimits:       rateLimitStore,
+		Admin:            adminService,
+		Audit:            auditService,
+		AdminAPIKey:      os.Getenv("ADMIN_API_KEY"),
+		AllowedOrigins:   allowedOrigins,
+		LemonSqueezy:     lemonSqueezyService,
+		Billing:          billingProvider,
+		BillingProviders: billingProviders,
+		Subscriptions:    services.NewSubscriptionStore(db),
+	}
+
+	// Expire entitlements and reconcile subscriptions in the background.
+	// An interval of 0 disables the worker, e.g. when it runs as a cron job.
+	if billingWorker.Interval > 0 {
+		go billingWorker.Run(context.Background())
 	}
 
 	// Setup Gin router
 	r := gin.Default()
 
+	// Only take the client IP from forwarding headers set by our own proxies,
+	// so clients can't choose the IP they are rate limited by
+	var trustedProxies []string
+	if proxies := os.Getenv("TRUSTED_PROXIES"); proxies != "" {
+		for _, proxy := range strings.Split(proxies, ",") {
+			trustedProxies = append(trustedProxies, strings.TrimSpace(proxy))
+		}
+	}
+	if err := r.SetTrustedProxies(trustedProxies); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+	// A header the hosting platform sets to the client IP, e.g. CF-Connecting-IP
+	r.TrustedPlatform = os.Getenv("TRUSTED_PLATFORM")
+
 	// CORS middleware
 	r.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"http://localhost:5173", "https://emaildrip.vercel.app", "https://emaildrip-ai.com"},
+		AllowOrigins:     allowedOrigins,
 		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization", "X-Signature"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization", "X-Signature", "X-Admin-Key", "X-Request-ID"},
+		ExposeHeaders:    []string{"RateLimit-Policy", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After", "X-Request-ID"},
 		AllowCredentials: true,
 	}))
+	r.Use(handlers.RequestID)
 
 	// Health check
 	r.GET("/health", func(c *gin.Context) {
 		c.JSON(200, gin.H{"status": "healthy"})
 	})
 
-	// API routes
+	// Rate limit policies. Every API request counts against its client IP;
+	// rewrites and checkouts are also limited per user. API keys have one
+	// bucket each, refilled at their plan's rate limit.
+	ipPolicy := services.RateLimitPolicy{Name: "ip", Limit: 300, Period: time.Minute}
+	rewritePolicy := services.RateLimitPolicy{Name: "rewrite", Limit: 30, Period: time.Minute, Burst: 10}
+	checkoutPolicy := services.RateLimitPolicy{Name: "checkout", Limit: 20, Period: time.Hour, Burst: 5}
+
+	// API routes. Webhooks are verified by their signatures and aren't rate
+	// limited, so provider bursts aren't dropped. Credit packs are public;
+	// everything else acts as the user of the bearer token. Personal API
+	// keys only work on the routes that name their scope.
 	api := r.Group("/api")
 	{
-		api.POST("/rewrite", handlers.RewriteEmail)
-		api.GET("/usage/:user_id", handlers.GetUsage)
-		api.GET("/emails/:user_id", handlers.GetUserEmails)
-		api.POST("/checkout", handlers.CreateCheckout)
-		api.POST("/lemonsqueezy/webhook", handlers.LemonSqueezyWebhook)
+		api.POST("/lemonsqueezy/webhook", handlers.BillingWebhook(lemonSqueezyService))
+		api.POST("/stripe/webhook", handlers.BillingWebhook(stripeService))
+	}
+	limited := api.Group("", handlers.RateLimit(ipPolicy))
+	{
+		limited.POST("/rewrite", handlers.AllowAPIKey(services.ScopeRewriteWrite), handlers.RateLimit(rewritePolicy), handlers.RewriteEmail)
+		limited.GET("/usage/:user_id", handlers.AllowAPIKey(services.ScopeHistoryRead), handlers.GetUsage)
+		limited.GET("/usage/:user_id/history", handlers.AllowAPIKey(services.ScopeHistoryRead), handlers.GetUsageHistory)
+		limited.GET("/emails/:user_id", handlers.AllowAPIKey(services.ScopeHistoryRead), handlers.GetUserEmails)
+		limited.GET("/credits/packs", handlers.GetCreditPacks)
+	}
+	authed := limited.Group("", handlers.RequireAuth)
+	{
+		authed.PUT("/users/:user_id", handlers.UpdateProfile)
+		authed.DELETE("/users/:user_id", handlers.DeleteAccount)
+		authed.PUT("/users/:user_id/timezone", handlers.SetTimezone)
+		authed.POST("/checkout", handlers.RateLimit(checkoutPolicy), handlers.CreateCheckout)
+		authed.POST("/credits/checkout", handlers.RateLimit(checkoutPolicy), handlers.CreateCreditCheckout)
+		authed.GET("/credits/:user_id", handlers.GetCreditBalance)
+		authed.GET("/credits/:user_id/ledger", handlers.GetCreditLedger)
+		authed.GET("/billing/:user_id/history", handlers.GetBillingHistory)
+		authed.GET("/billing/:user_id/subscription", handlers.GetSubscription)
+		authed.GET("/billing/:user_id/portal", handlers.GetBillingPortal)
+		authed.POST("/billing/:user_id/subscription/cancel", handlers.CancelSubscription)
+		authed.POST("/billing/:user_id/subscription/resume", handlers.ResumeSubscription)
+		authed.POST("/billing/:user_id/subscription/pause", handlers.PauseSubscription)
+		authed.POST("/billing/:user_id/subscription/unpause", handlers.UnpauseSubscription)
+		authed.POST("/billing/:user_id/subscription/plan", handlers.ChangeSubscriptionPlan)
+		authed.POST("/workspaces", handlers.CreateWorkspace)
+		authed.GET("/users/:user_id/workspaces", handlers.ListWorkspaces)
+		authed.GET("/workspaces/:workspace_id", handlers.GetWorkspace)
+		authed.POST("/workspaces/:workspace_id/invitations", handlers.InviteWorkspaceMember)
+		authed.DELETE("/workspaces/:workspace_id/members/:member_id", handlers.RemoveWorkspaceMember)
+		authed.POST("/invitations/accept", handlers.AcceptInvitation)
+		authed.GET("/keys", handlers.ListAPIKeys)
+		authed.POST("/keys", handlers.CreateAPIKey)
+		authed.DELETE("/keys/:id", handlers.RevokeAPIKey)
+	}
+
+	// Accounts scheduled for deletion can still be looked at and restored
+	account := limited.Group("", handlers.RequireAccount)
+	{
+		account.GET("/users/:user_id", handlers.GetProfile)
+		account.POST("/users/:user_id/restore", handlers.RestoreAccount)
+	}
+
+	// Admin routes, for staff signed in with a staff role or the admin API
+	// key. Support staff can look things up; the rest needs the admin role.
+	admin := r.Group("/admin", handlers.RequireStaff)
+	{
+		admin.GET("/users", handlers.SearchUsers)
+		admin.GET("/users/:user_id", handlers.GetAdminUser)
+		admin.GET("/users/:user_id/emails", handlers.GetAdminUserEmails)
+		admin.GET("/users/:user_id/grants", handlers.ListUserGrants)
+		admin.GET("/ai-errors", handlers.ListAIErrors)
+	}
+	adminOnly := admin.Group("", handlers.RequireRole(services.StaffRoleAdmin))
+	{
+		adminOnly.PUT("/users/:user_id/quota", handlers.SetUserQuota)
+		adminOnly.POST("/users/:user_id/usage/reset", handlers.ResetUserUsage)
+		adminOnly.POST("/users/:user_id/grants", handlers.CreateGrant)
+		adminOnly.DELETE("/grants/:id", handlers.RevokeGrant)
+		adminOnly.PUT("/staff/:user_id", handlers.SetStaffRole)
+		adminOnly.DELETE("/staff/:user_id", handlers.RemoveStaffRole)
+		adminOnly.GET("/webhooks", handlers.ListWebhookEvents)
+		adminOnly.GET("/webhooks/:id", handlers.GetWebhookEvent)
+		adminOnly.POST("/webhooks/replay", handlers.ReplayWebhookEvents)
+		adminOnly.GET("/subscriptions/unmatched", handlers.ListUnmatchedSubscriptions)
+		adminOnly.POST("/subscriptions/unmatched/:subscription_id/link", handlers.LinkUnmatchedSubscription)
+		adminOnly.GET("/usage/reconciliation", handlers.GetUsageReconciliation)
+		adminOnly.GET("/audit", handlers.ListAuditLog)
+		adminOnly.GET("/audit/export.csv", handlers.ExportAuditLog)
 	}
 
 	// Start server
@@ -0,0 +1,336 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Staff roles. Admins can do everything; support staff can only look.
+const (
+	StaffRoleAdmin   = "admin"
+	StaffRoleSupport = "support"
+)
+
+// maxUserSearchResults bounds a user search.
+const maxUserSearchResults = 50
+
+// ErrInvalidStaffRole is returned for roles other than admin and support.
+var ErrInvalidStaffRole = errors.New("invalid staff role")
+
+// AdminService backs the staff-only admin API. Every change it makes is
+// written to the audit log in the same transaction.
+type AdminService struct {
+	DB    *sql.DB
+	Plans *PlanService
+	Email *EmailService
+}
+
+// UserSummary is a user as listed in search results.
+type UserSummary struct {
+	ID       string `json:"id"`
+	Email    string `json:"email"`
+	PlanID   string `json:"plan_id"`
+	IsPro    bool   `json:"is_pro"`
+	Timezone string `json:"timezone"`
+}
+
+// AdminSubscription is a subscription row as staff see it.
+type AdminSubscription struct {
+	Provider        string     `json:"provider"`
+	SubscriptionID  string     `json:"subscription_id"`
+	Status          string     `json:"status"`
+	PlanID          string     `json:"plan_id"`
+	Quantity        int        `json:"quantity"`
+	WorkspaceID     *int64     `json:"workspace_id,omitempty"`
+	RenewsAt        *time.Time `json:"renews_at"`
+	EndsAt          *time.Time `json:"ends_at"`
+	PaymentFailedAt *time.Time `json:"payment_failed_at"`
+}
+
+// UserQuota is the per-user override of the plan quota and the time usage
+// was last reset, the state changed by the quota endpoints.
+type UserQuota struct {
+	RequestLimitOverride *int       `json:"request_limit_override"`
+	UsageResetAt         *time.Time `json:"usage_reset_at"`
+}
+
+// AdminUserView is everything staff need to answer a question about a user's
+// plan or usage.
+type AdminUserView struct {
+	User          UserSummary         `json:"user"`
+	Plan          *Plan               `json:"plan"`
+	Usage         *Usage              `json:"usage"`
+	Quota         UserQuota           `json:"quota"`
+	Subscriptions []AdminSubscription `json:"subscriptions"`
+	Entitlements  []Entitlement       `json:"entitlements"` // including expired ones
+}
+
+// AIError is a failed AI call.
+type AIError struct {
+	ID        int64     `json:"id"`
+	UserID    string    `json:"user_id"`
+	Operation string    `json:"operation"`
+	Error     string    `json:"error"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func NewAdminService(db *sql.DB, plans *PlanService, email *EmailService) *AdminService {
+	return &AdminService{DB: db, Plans: plans, Email: email}
+}
+
+// StaffRole returns the user's staff role, or "" if they aren't staff.
+func (s *AdminService) StaffRole(userID string) (string, error) {
+	var role string
+	err := s.DB.QueryRow(`SELECT role FROM staff_roles WHERE user_id = $1`, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+// SetStaffRole gives the user a staff role, or takes it away when role is "".
+func (s *AdminService) SetStaffRole(actor AuditActor, userID, role string) error {
+	if role != "" && role != StaffRoleAdmin && role != StaffRoleSupport {
+		return ErrInvalidStaffRole
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)`, userID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrUserNotFound
+	}
+
+	var before sql.NullString
+	err = tx.QueryRow(`SELECT role FROM staff_roles WHERE user_id = $1 FOR UPDATE`, userID).Scan(&before)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	if role == "" {
+		_, err = tx.Exec(`DELETE FROM staff_roles WHERE user_id = $1`, userID)
+	} else {
+		_, err = tx.Exec(`
+			INSERT INTO staff_roles (user_id, role) VALUES ($1, $2)
+			ON CONFLICT (user_id) DO UPDATE SET role = EXCLUDED.role
+		`, userID, role)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = recordAudit(tx, actor, "staff.role_set", "user", userID,
+		map[string]string{"role": before.String}, map[string]string{"role": role})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SearchUsers finds users by ID or by part of their email.
+func (s *AdminService) SearchUsers(query string, limit int) ([]UserSummary, error) {
+	if limit <= 0 || limit > maxUserSearchResults {
+		limit = maxUserSearchResults
+	}
+
+	rows, err := s.DB.Query(`
+		SELECT id, COALESCE(email, ''), plan_id, is_pro, timezone
+		FROM users
+		WHERE id::text = $1 OR email ILIKE '%' || $1 || '%'
+		ORDER BY email
+		LIMIT $2
+	`, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []UserSummary{}
+	for rows.Next() {
+		var user UserSummary
+		if err := rows.Scan(&user.ID, &user.Email, &user.PlanID, &user.IsPro, &user.Timezone); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// GetUserView returns the user's plan, usage, subscriptions and entitlements.
+func (s *AdminService) GetUserView(userID string) (*AdminUserView, error) {
+	view := AdminUserView{Subscriptions: []AdminSubscription{}, Entitlements: []Entitlement{}}
+
+	var limitOverride sql.NullInt64
+	var usageResetAt sql.NullTime
+	err := s.DB.QueryRow(`
+		SELECT id, COALESCE(email, ''), plan_id, is_pro, timezone, request_limit_override, usage_reset_at
+		FROM users
+		WHERE id = $1
+	`, userID).Scan(&view.User.ID, &view.User.Email, &view.User.PlanID, &view.User.IsPro, &view.User.Timezone,
+		&limitOverride, &usageResetAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	view.Quota = userQuota(limitOverride, usageResetAt)
+
+	if view.Plan, err = s.Plans.GetUserPlan(userID); err != nil {
+		return nil, err
+	}
+	if view.Usage, err = s.Email.GetUserUsage(userID, view.Plan); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.DB.Query(`
+		SELECT
+			CASE WHEN lemonsqueezy_subscription_id IS NOT NULL THEN $2 ELSE $3 END,
+			COALESCE(lemonsqueezy_subscription_id, stripe_subscription_id),
+			status, COALESCE(plan_id, ''), quantity, workspace_id, current_period_end, ends_at, payment_failed_at
+		FROM subscriptions
+		WHERE user_id = $1
+		ORDER BY updated_at DESC
+	`, userID, BillingProviderLemonSqueezy, BillingProviderStripe)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var sub AdminSubscription
+		var workspaceID sql.NullInt64
+		var renewsAt, endsAt, paymentFailedAt sql.NullTime
+		err := rows.Scan(&sub.Provider, &sub.SubscriptionID, &sub.Status, &sub.PlanID, &sub.Quantity,
+			&workspaceID, &renewsAt, &endsAt, &paymentFailedAt)
+		if err != nil {
+			return nil, err
+		}
+		if workspaceID.Valid {
+			sub.WorkspaceID = &workspaceID.Int64
+		}
+		sub.RenewsAt = nullTimePtr(renewsAt)
+		sub.EndsAt = nullTimePtr(endsAt)
+		sub.PaymentFailedAt = nullTimePtr(paymentFailedAt)
+		view.Subscriptions = append(view.Subscriptions, sub)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	entitlements, err := s.DB.Query(`
+		SELECT e.source, e.source_id, e.plan_id, e.status, e.expires_at, e.workspace_id
+		FROM entitlements e
+		WHERE `+entitlementHolderSQL+`
+		ORDER BY e.expires_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer entitlements.Close()
+	for entitlements.Next() {
+		var entitlement Entitlement
+		var workspaceID sql.NullInt64
+		err := entitlements.Scan(&entitlement.Source, &entitlement.SourceID, &entitlement.PlanID,
+			&entitlement.Status, &entitlement.ExpiresAt, &workspaceID)
+		if err != nil {
+			return nil, err
+		}
+		if workspaceID.Valid {
+			entitlement.WorkspaceID = &workspaceID.Int64
+		}
+		view.Entitlements = append(view.Entitlements, entitlement)
+	}
+	if err := entitlements.Err(); err != nil {
+		return nil, err
+	}
+
+	return &view, nil
+}
+
+// SetRequestLimitOverride replaces the request limit of the user's plan, or
+// goes back to the plan's limit when limit is nil.
+func (s *AdminService) SetRequestLimitOverride(actor AuditActor, userID string, limit *int) (*UserQuota, error) {
+	return s.updateQuota(actor, userID, "user.quota_set", `request_limit_override = $2`, limit)
+}
+
+// ResetUsage starts the user's quota afresh. Earlier usage stays recorded for
+// history and billing but no longer counts against the quota.
+func (s *AdminService) ResetUsage(actor AuditActor, userID string) (*UserQuota, error) {
+	return s.updateQuota(actor, userID, "user.usage_reset", `usage_reset_at = NOW()`)
+}
+
+func (s *AdminService) updateQuota(actor AuditActor, userID, action, set string, args ...interface{}) (*UserQuota, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// The users trigger logs the change under this action
+	if err := setAuditContext(tx, actor, action); err != nil {
+		return nil, err
+	}
+
+	var limitOverride sql.NullInt64
+	var usageResetAt sql.NullTime
+	err = tx.QueryRow(`
+		UPDATE users SET `+set+`, updated_at = NOW()
+		WHERE id = $1
+		RETURNING request_limit_override, usage_reset_at
+	`, append([]interface{}{userID}, args...)...).Scan(&limitOverride, &usageResetAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	quota := userQuota(limitOverride, usageResetAt)
+	return &quota, nil
+}
+
+func userQuota(limitOverride sql.NullInt64, usageResetAt sql.NullTime) UserQuota {
+	quota := UserQuota{UsageResetAt: nullTimePtr(usageResetAt)}
+	if limitOverride.Valid {
+		n := int(limitOverride.Int64)
+		quota.RequestLimitOverride = &n
+	}
+	return quota
+}
+
+// ListAIErrors returns the most recent failed AI calls, optionally only the
+// user's.
+func (s *AdminService) ListAIErrors(userID string, limit int) ([]AIError, error) {
+	rows, err := s.DB.Query(`
+		SELECT id, COALESCE(user_id::text, ''), operation, error, created_at
+		FROM ai_errors
+		WHERE $1 = '' OR user_id::text = $1
+		ORDER BY created_at DESC
+		LIMIT $2
+	`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	errs := []AIError{}
+	for rows.Next() {
+		var aiErr AIError
+		if err := rows.Scan(&aiErr.ID, &aiErr.UserID, &aiErr.Operation, &aiErr.Error, &aiErr.CreatedAt); err != nil {
+			return nil, err
+		}
+		errs = append(errs, aiErr)
+	}
+	return errs, rows.Err()
+}
@@ -37,6 +37,10 @@ func NewAIService(apiKey string) *AIService {
 	}
 }
 
+// RewriteTones are the tones RewriteEmail has guidelines for. Any other tone
+// gets a plain professional rewrite.
+var RewriteTones = []string{"Polite", "Funny", "Direct", "Karen"}
+
 func (ai *AIService) RewriteEmail(email, tone string) (string, error) {
 	var toneGuidelines string
 
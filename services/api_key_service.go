@@ -0,0 +1,246 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// API key scopes. A key can only call the endpoints its scopes allow.
+const (
+	ScopeRewriteWrite = "rewrite:write"
+	ScopeHistoryRead  = "history:read"
+)
+
+// APIKeyPrefix starts every personal API key, so they can be told apart from
+// session tokens and found by secret scanners.
+const APIKeyPrefix = "edk_"
+
+// maxAPIKeysPerUser bounds the active keys a user can hold.
+const maxAPIKeysPerUser = 20
+
+var (
+	// ErrInvalidAPIKey is returned for unknown or revoked keys.
+	ErrInvalidAPIKey = errors.New("invalid API key")
+	// ErrAPIKeyNotFound is returned when revoking a key the user doesn't have.
+	ErrAPIKeyNotFound = errors.New("API key not found")
+	// ErrInvalidAPIKeyRequest is returned for unknown scopes, a missing name,
+	// or too many keys.
+	ErrInvalidAPIKeyRequest = errors.New("invalid API key request")
+)
+
+var validScopes = map[string]bool{
+	ScopeRewriteWrite: true,
+	ScopeHistoryRead:  true,
+}
+
+// APIKey is a personal API key. Key is only set when the key is created;
+// afterwards only its hash is stored.
+type APIKey struct {
+	ID         int64      `json:"id"`
+	UserID     string     `json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Key        string     `json:"key,omitempty"`
+	Scopes     []string   `json:"scopes"`
+	RateLimit  int        `json:"rate_limit"` // requests per minute, from the owner's plan
+	Requests   int        `json:"requests"`   // rewrites made with the key
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// HasScope reports whether the key grants the scope.
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type APIKeyService struct {
+	DB *sql.DB
+}
+
+func NewAPIKeyService(db *sql.DB) *APIKeyService {
+	return &APIKeyService{DB: db}
+}
+
+// IsAPIKey reports whether a bearer token is a personal API key rather than
+// a session token.
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
+
+// CreateKey creates a key for the user. The returned key is the only time
+// its secret is available.
+func (s *APIKeyService) CreateKey(actor AuditActor, userID, name string, scopes []string) (*APIKey, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(scopes) == 0 {
+		return nil, ErrInvalidAPIKeyRequest
+	}
+	for _, scope := range scopes {
+		if !validScopes[scope] {
+			return nil, ErrInvalidAPIKeyRequest
+		}
+	}
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := setAuditContext(tx, actor, "api_key.create"); err != nil {
+		return nil, err
+	}
+
+	var active int
+	err = tx.QueryRow(`
+		SELECT COUNT(*) FROM api_keys WHERE user_id = $1 AND revoked_at IS NULL
+	`, userID).Scan(&active)
+	if err != nil {
+		return nil, err
+	}
+	if active >= maxAPIKeysPerUser {
+		return nil, ErrInvalidAPIKeyRequest
+	}
+
+	plan, err := getUserPlan(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	key := &APIKey{
+		UserID:    userID,
+		Name:      name,
+		Key:       APIKeyPrefix + hex.EncodeToString(secret),
+		Scopes:    scopes,
+		RateLimit: plan.APIKeyRateLimit,
+	}
+	key.Prefix = key.Key[:len(APIKeyPrefix)+8]
+
+	err = tx.QueryRow(`
+		INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`, userID, key.Name, key.Prefix, hashAPIKey(key.Key), pq.Array(key.Scopes),
+	).Scan(&key.ID, &key.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ListKeys returns the user's keys, newest first, including revoked ones.
+func (s *APIKeyService) ListKeys(userID string) ([]APIKey, error) {
+	plan, err := getUserPlan(s.DB, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.DB.Query(`
+		SELECT k.id, k.user_id, k.name, k.prefix, k.scopes,
+			(SELECT COUNT(*) FROM usage_reservations r WHERE r.api_key_id = k.id AND r.status = 'committed'),
+			k.created_at, k.last_used_at, k.revoked_at
+		FROM api_keys k
+		WHERE k.user_id = $1
+		ORDER BY k.created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var key APIKey
+		var lastUsedAt, revokedAt sql.NullTime
+		err := rows.Scan(&key.ID, &key.UserID, &key.Name, &key.Prefix, pq.Array(&key.Scopes),
+			&key.Requests, &key.CreatedAt, &lastUsedAt, &revokedAt)
+		if err != nil {
+			return nil, err
+		}
+		key.RateLimit = plan.APIKeyRateLimit
+		key.LastUsedAt = nullTimePtr(lastUsedAt)
+		key.RevokedAt = nullTimePtr(revokedAt)
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// RevokeKey stops one of the user's keys from working.
+func (s *APIKeyService) RevokeKey(actor AuditActor, userID string, id int64) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := setAuditContext(tx, actor, "api_key.revoke"); err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(`
+		UPDATE api_keys SET revoked_at = NOW()
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+	`, id, userID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return tx.Commit()
+}
+
+// Authenticate looks up an active key and records that it was used. The
+// key's rate limit is that of its owner's plan.
+func (s *APIKeyService) Authenticate(secret string) (*APIKey, error) {
+	var key APIKey
+	var lastUsedAt sql.NullTime
+	err := s.DB.QueryRow(`
+		UPDATE api_keys SET last_used_at = NOW()
+		WHERE key_hash = $1 AND revoked_at IS NULL
+		RETURNING id, user_id, name, prefix, scopes, created_at, last_used_at
+	`, hashAPIKey(secret)).Scan(&key.ID, &key.UserID, &key.Name, &key.Prefix, pq.Array(&key.Scopes),
+		&key.CreatedAt, &lastUsedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	key.LastUsedAt = nullTimePtr(lastUsedAt)
+
+	plan, err := getUserPlan(s.DB, key.UserID)
+	if err != nil {
+		return nil, err
+	}
+	key.RateLimit = plan.APIKeyRateLimit
+	return &key, nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,271 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Audit actor types. Changes made outside a request, such as by the billing
+// worker, are logged as system changes.
+const (
+	AuditActorStaff    = "staff"
+	AuditActorAdminKey = "admin_key"
+	AuditActorUser     = "user"
+	AuditActorWebhook  = "webhook"
+	AuditActorSystem   = "system"
+)
+
+// maxAuditEntries bounds a page of audit entries.
+const maxAuditEntries = 500
+
+// AuditActor is who performed an audited action, and the request they did
+// it in.
+type AuditActor struct {
+	Type      string
+	ID        string
+	RequestID string
+	IP        string
+}
+
+// AuditEntry is a row of the append-only audit log. Before and After are JSON
+// snapshots of the target, either of which may be empty.
+type AuditEntry struct {
+	ID         int64           `json:"id"`
+	ActorType  string          `json:"actor_type"`
+	ActorID    string          `json:"actor_id,omitempty"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"target_type"`
+	TargetID   string          `json:"target_id"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+	RequestID  string          `json:"request_id,omitempty"`
+	IP         string          `json:"ip,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+}
+
+// AuditFilter selects audit entries. Zero values match all. BeforeID pages
+// backwards from the last entry of the previous page.
+type AuditFilter struct {
+	ActorType  string
+	ActorID    string
+	Action     string
+	TargetType string
+	TargetID   string
+	Since      *time.Time
+	Until      *time.Time
+	BeforeID   int64
+	Limit      int
+}
+
+type AuditService struct {
+	DB *sql.DB
+}
+
+func NewAuditService(db *sql.DB) *AuditService {
+	return &AuditService{DB: db}
+}
+
+// Record appends an entry outside of any transaction, for reads and for
+// changes made by services that don't write their own entries.
+func (s *AuditService) Record(actor AuditActor, action, targetType, targetID string, before, after interface{}) error {
+	return recordAudit(s.DB, actor, action, targetType, targetID, before, after)
+}
+
+// setAuditContext attributes the changes the transaction goes on to make to
+// users and subscriptions, which are logged by trigger, to the actor. action
+// replaces the trigger's default of e.g. "user.update"; pass "" to keep it.
+func setAuditContext(tx *sql.Tx, actor AuditActor, action string) error {
+	_, err := tx.Exec(`
+		SELECT
+			set_config('app.audit_actor_type', $1, true),
+			set_config('app.audit_actor_id', $2, true),
+			set_config('app.audit_action', $3, true),
+			set_config('app.audit_request_id', $4, true),
+			set_config('app.audit_ip', $5, true)
+	`, actor.Type, actor.ID, action, actor.RequestID, actor.IP)
+	return err
+}
+
+// recordAudit appends an entry to the audit log. Pass the transaction making
+// the change, so the entry is written if and only if the change is. before
+// and after are marshalled to JSON; nil leaves them empty.
+func recordAudit(q queryer, actor AuditActor, action, targetType, targetID string, before, after interface{}) error {
+	beforeJSON, err := auditJSON(before)
+	if err != nil {
+		return err
+	}
+	afterJSON, err := auditJSON(after)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.Exec(`
+		INSERT INTO audit_log (actor_type, actor_id, action, target_type, target_id, before, after, request_id, ip)
+		VALUES ($1, NULLIF($2, ''), $3, $4, $5, $6, $7, NULLIF($8, ''), NULLIF($9, ''))
+	`, actor.Type, actor.ID, action, targetType, targetID, beforeJSON, afterJSON, actor.RequestID, actor.IP)
+	return err
+}
+
+// auditRedactedColumns are the personal data that audit entries written
+// before snapshots left them out may still hold.
+var auditRedactedColumns = []string{"email", "name", "user_email", "card_brand", "card_last_four"}
+
+// redactAuditEntries removes a purged user's personal data from the audit
+// log: the IP of the requests they made, and their details in the snapshots
+// of their account and subscriptions. Entries themselves are kept.
+func redactAuditEntries(tx *sql.Tx, userID string) error {
+	if _, err := tx.Exec(`SELECT set_config('app.audit_redact', 'on', true)`); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`
+		UPDATE audit_log
+		SET
+			ip = CASE WHEN actor_type = $2 AND actor_id = $1 THEN NULL ELSE ip END,
+			before = before - $3::text[],
+			after = after - $3::text[]
+		WHERE (actor_type = $2 AND actor_id = $1)
+			OR (target_type = 'user' AND target_id = $1)
+			OR before ->> 'user_id' = $1
+			OR after ->> 'user_id' = $1
+	`, userID, AuditActorUser, pq.Array(auditRedactedColumns))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`SELECT set_config('app.audit_redact', 'off', true)`)
+	return err
+}
+
+func auditJSON(v interface{}) ([]byte, error) {
+	if v == nil {
+		return nil, nil
+	}
+	return json.Marshal(v)
+}
+
+func (f AuditFilter) where() (string, []interface{}) {
+	clause := "WHERE TRUE"
+	var args []interface{}
+	add := func(condition string, value interface{}) {
+		args = append(args, value)
+		clause += fmt.Sprintf(" AND "+condition, len(args))
+	}
+
+	if f.ActorType != "" {
+		add("actor_type = $%d", f.ActorType)
+	}
+	if f.ActorID != "" {
+		add("actor_id = $%d", f.ActorID)
+	}
+	if f.Action != "" {
+		add("action = $%d", f.Action)
+	}
+	if f.TargetType != "" {
+		add("target_type = $%d", f.TargetType)
+	}
+	if f.TargetID != "" {
+		add("target_id = $%d", f.TargetID)
+	}
+	if f.Since != nil {
+		add("created_at >= $%d", *f.Since)
+	}
+	if f.Until != nil {
+		add("created_at < $%d", *f.Until)
+	}
+	if f.BeforeID != 0 {
+		add("id < $%d", f.BeforeID)
+	}
+
+	return clause, args
+}
+
+// ListEntries returns a page of entries matching the filter, newest first.
+func (s *AuditService) ListEntries(filter AuditFilter) ([]AuditEntry, error) {
+	if filter.Limit <= 0 || filter.Limit > maxAuditEntries {
+		filter.Limit = maxAuditEntries
+	}
+
+	entries := []AuditEntry{}
+	err := s.eachEntry(filter, func(entry AuditEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, err
+}
+
+// ExportCSV writes every entry matching the filter to w as CSV, newest
+// first. Unlike ListEntries it doesn't limit the entries unless the filter
+// does.
+func (s *AuditService) ExportCSV(w io.Writer, filter AuditFilter) error {
+	out := csv.NewWriter(w)
+	err := out.Write([]string{
+		"id", "created_at", "actor_type", "actor_id", "action",
+		"target_type", "target_id", "before", "after", "request_id", "ip",
+	})
+	if err != nil {
+		return err
+	}
+
+	err = s.eachEntry(filter, func(entry AuditEntry) error {
+		return out.Write([]string{
+			strconv.FormatInt(entry.ID, 10),
+			entry.CreatedAt.UTC().Format(time.RFC3339),
+			entry.ActorType,
+			entry.ActorID,
+			entry.Action,
+			entry.TargetType,
+			entry.TargetID,
+			string(entry.Before),
+			string(entry.After),
+			entry.RequestID,
+			entry.IP,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	out.Flush()
+	return out.Error()
+}
+
+func (s *AuditService) eachEntry(filter AuditFilter, fn func(AuditEntry) error) error {
+	where, args := filter.where()
+	query := `
+		SELECT id, actor_type, COALESCE(actor_id, ''), action, target_type, target_id,
+			before, after, COALESCE(request_id, ''), COALESCE(ip, ''), created_at
+		FROM audit_log
+		` + where + `
+		ORDER BY id DESC`
+	if filter.Limit > 0 {
+		query += " LIMIT " + strconv.Itoa(filter.Limit)
+	}
+
+	rows, err := s.DB.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry AuditEntry
+		var before, after []byte
+		err := rows.Scan(&entry.ID, &entry.ActorType, &entry.ActorID, &entry.Action, &entry.TargetType,
+			&entry.TargetID, &before, &after, &entry.RequestID, &entry.IP, &entry.CreatedAt)
+		if err != nil {
+			return err
+		}
+		entry.Before = before
+		entry.After = after
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,89 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Billing providers subscriptions can be bought through
+const (
+	BillingProviderLemonSqueezy = "lemonsqueezy"
+	BillingProviderStripe       = "stripe"
+)
+
+// ErrInvalidWebhookSignature is returned for deliveries whose signature
+// doesn't match the provider's signing secret.
+var ErrInvalidWebhookSignature = errors.New("invalid webhook signature")
+
+// ErrUnsupportedCheckoutOption is returned for checkout options the billing
+// provider can't honour.
+var ErrUnsupportedCheckoutOption = errors.New("unsupported checkout option")
+
+// BillingProvider is a payment provider users subscribe through. Which one new
+// checkouts use is configuration; handlers only see this interface.
+type BillingProvider interface {
+	Name() string
+	CreateCheckout(userID, email string, opts CheckoutOptions) (string, error)
+	// ParseWebhook verifies a delivery against the request headers and
+	// decodes it.
+	ParseWebhook(payload []byte, header http.Header) (*WebhookDelivery, error)
+	// HandleWebhook applies a verified delivery.
+	HandleWebhook(delivery *WebhookDelivery) (*WebhookEvent, error)
+
+	// The user's subscription with the provider is managed through these;
+	// they return ErrNoSubscription when there is none.
+	GetUserSubscription(userID string) (*SubscriptionSummary, error)
+	GetPortalURLs(userID string) (*PortalURLs, error)
+	CancelSubscription(actor AuditActor, userID string) (*SubscriptionSummary, error)
+	ResumeSubscription(actor AuditActor, userID string) (*SubscriptionSummary, error)
+	PauseSubscription(actor AuditActor, userID string, resumesAt *time.Time) (*SubscriptionSummary, error)
+	UnpauseSubscription(actor AuditActor, userID string) (*SubscriptionSummary, error)
+	ChangeSubscriptionPlan(actor AuditActor, userID, checkoutPlan string) (*SubscriptionSummary, error)
+}
+
+var (
+	_ BillingProvider = (*LemonSqueezyService)(nil)
+	_ BillingProvider = (*StripeService)(nil)
+)
+
+// WebhookDelivery is a verified webhook from a billing provider.
+// Subscription is set for events that change a subscription when the
+// provider applies them through SubscriptionStore.ApplyWebhook. RequestID and
+// IP identify the request it arrived in for the audit log.
+type WebhookDelivery struct {
+	Provider     string
+	EventName    string
+	ResourceID   string
+	Payload      []byte
+	Subscription *SubscriptionEvent
+	RequestID    string
+	IP           string
+}
+
+// auditActor is who the changes the delivery makes are logged as.
+func (d *WebhookDelivery) auditActor() AuditActor {
+	return AuditActor{Type: AuditActorWebhook, ID: d.Provider, RequestID: d.RequestID, IP: d.IP}
+}
+
+// SubscriptionEvent is a subscription's state as reported by its provider,
+// normalized so one store can apply it whatever the provider.
+type SubscriptionEvent struct {
+	Provider       string     `json:"provider"`
+	SubscriptionID string     `json:"subscription_id"`
+	CustomerID     string     `json:"customer_id"`
+	UserID         string     `json:"user_id"`      // from checkout metadata, if any
+	WorkspaceID    string     `json:"workspace_id"` // from checkout metadata, for workspace subscriptions
+	Email          string     `json:"email"`
+	PriceID        string     `json:"price_id"` // LemonSqueezy variant or Stripe price
+	PlanID         string     `json:"plan_id"`
+	Quantity       int        `json:"quantity"` // seats; 0 when the provider didn't say
+	Status         string     `json:"status"`   // one of the Subscription* statuses
+	PeriodStart    time.Time  `json:"period_start"`
+	RenewsAt       time.Time  `json:"renews_at"`
+	EndsAt         *time.Time `json:"ends_at"`
+	TrialEndsAt    *time.Time `json:"trial_ends_at"`
+	CardBrand      string     `json:"card_brand"`
+	CardLastFour   string     `json:"card_last_four"`
+	UpdatedAt      time.Time  `json:"updated_at"` // orders events for the same subscription
+}
@@ -0,0 +1,223 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// BillingWorker periodically downgrades users whose entitlements have run
+// out and reconciles local subscriptions against LemonSqueezy, so a missed
+// webhook can't leave someone on the wrong plan. It also reports the usage of
+// usage-based subscriptions and, when Dunning is set, sends the emails for
+// failed payments. When Users is set it also purges deleted accounts whose
+// grace period has ended.
+type BillingWorker struct {
+	DB           *sql.DB
+	LemonSqueezy *LemonSqueezyService
+	Dunning      *DunningService
+	Users        *UserService
+	Interval     time.Duration
+}
+
+type lemonSqueezySubscriptionList struct {
+	Data  []LemonSqueezySubscription `json:"data"`
+	Links struct {
+		Next string `json:"next"`
+	} `json:"links"`
+}
+
+func NewBillingWorker(db *sql.DB, lemonSqueezy *LemonSqueezyService, interval time.Duration) *BillingWorker {
+	return &BillingWorker{
+		DB:           db,
+		LemonSqueezy: lemonSqueezy,
+		Interval:     interval,
+	}
+}
+
+// Run calls RunOnce every Interval until ctx is cancelled.
+func (w *BillingWorker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.RunOnce(ctx); err != nil {
+			log.Printf("Billing worker run failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// workerStage is one independent step of a billing worker run.
+type workerStage struct {
+	name string
+	run  func(context.Context) error
+}
+
+// RunOnce runs every stage, even after one fails, and returns their errors.
+func (w *BillingWorker) RunOnce(ctx context.Context) error {
+	// One stage failing (e.g. LemonSqueezy being unreachable) mustn't hold
+	// back dunning emails or purges
+	stages := []workerStage{
+		{"expire entitlements", func(context.Context) error { return w.ExpireEntitlements() }},
+	}
+	// Deployments billing only through Stripe don't configure LemonSqueezy
+	if w.LemonSqueezy != nil && w.LemonSqueezy.APIKey != "" {
+		stages = append(stages,
+			workerStage{"reconcile subscriptions", w.ReconcileSubscriptions},
+			workerStage{"report usage", w.LemonSqueezy.ReportUsage},
+		)
+	}
+	if w.Dunning != nil {
+		stages = append(stages, workerStage{"dunning", w.Dunning.Run})
+	}
+	if w.Users != nil {
+		stages = append(stages, workerStage{"purge deleted users", w.Users.PurgeDeletedUsers})
+	}
+
+	var errs []error
+	for _, stage := range stages {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := stage.run(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", stage.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ExpireEntitlements clears the cached pro status of users whose last active
+// entitlement has passed its expiry.
+func (w *BillingWorker) ExpireEntitlements() error {
+	rows, err := w.DB.Query(`
+		UPDATE users u
+		SET is_pro = FALSE, plan_id = 'free', updated_at = NOW()
+		WHERE (u.is_pro OR u.plan_id <> 'free')
+			AND NOT EXISTS (
+				SELECT 1 FROM entitlements e
+				WHERE ` + entitlementHolder("u.id") + `
+					AND e.starts_at <= NOW() AND e.expires_at > NOW()
+			)
+		RETURNING u.id
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			return err
+		}
+		log.Printf("Billing worker: entitlements of user %s expired, downgraded to free", userID)
+	}
+
+	return rows.Err()
+}
+
+// ReconcileSubscriptions lists every subscription of our LemonSqueezy store
+// and applies any whose status or billing dates differ from the local copy,
+// through the same handlers as webhooks.
+func (w *BillingWorker) ReconcileSubscriptions(ctx context.Context) error {
+	next := "/subscriptions?filter[store_id]=" + url.QueryEscape(w.LemonSqueezy.StoreID) + "&page[size]=100"
+	for next != "" {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var page lemonSqueezySubscriptionList
+		if err := w.LemonSqueezy.apiRequest("GET", next, nil, &page); err != nil {
+			return err
+		}
+
+		for _, subscription := range page.Data {
+			if err := w.reconcileSubscription(subscription); err != nil {
+				log.Printf("Billing worker: failed to reconcile subscription %s: %v", subscription.ID, err)
+			}
+		}
+
+		next = page.Links.Next
+	}
+
+	return nil
+}
+
+func (w *BillingWorker) reconcileSubscription(remote LemonSqueezySubscription) error {
+	if remote.Attributes.TestMode && !w.LemonSqueezy.AllowTestMode {
+		return nil
+	}
+	// Other stores on the same account aren't ours to apply
+	if strconv.Itoa(remote.Attributes.StoreID) != w.LemonSqueezy.StoreID {
+		return nil
+	}
+
+	tx, err := w.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status string
+	var renewsAt, endsAt, lastApplied sql.NullTime
+	err = tx.QueryRow(`
+		SELECT status, current_period_end, ends_at, lemonsqueezy_updated_at
+		FROM subscriptions
+		WHERE lemonsqueezy_subscription_id = $1
+		FOR UPDATE
+	`, remote.ID).Scan(&status, &renewsAt, &endsAt, &lastApplied)
+
+	if err == sql.ErrNoRows {
+		var quarantined bool
+		err := tx.QueryRow(`
+			SELECT EXISTS (
+				SELECT 1 FROM unmatched_subscriptions
+				WHERE lemonsqueezy_subscription_id = $1 AND resolved_at IS NULL
+			)
+		`, remote.ID).Scan(&quarantined)
+		if err != nil || quarantined {
+			return err
+		}
+
+		log.Printf("Billing worker: subscription %s missing locally, creating it (%s)", remote.ID, remote.Attributes.Status)
+		if err := w.LemonSqueezy.HandleSubscriptionCreated(tx, remote, "", ""); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+	if err != nil {
+		return err
+	}
+
+	// A webhook newer than this listing has already been applied
+	if lastApplied.Valid && remote.Attributes.UpdatedAt.Before(lastApplied.Time) {
+		return nil
+	}
+
+	drifted := status != remote.Attributes.Status ||
+		!renewsAt.Valid || !renewsAt.Time.Equal(remote.Attributes.RenewsAt) ||
+		endsAt.Valid != (remote.Attributes.EndsAt != nil) ||
+		(endsAt.Valid && !endsAt.Time.Equal(*remote.Attributes.EndsAt))
+	if !drifted {
+		return nil
+	}
+
+	log.Printf("Billing worker: subscription %s drifted: status %s -> %s, renews_at %v -> %v",
+		remote.ID, status, remote.Attributes.Status, renewsAt.Time, remote.Attributes.RenewsAt)
+
+	if err := w.LemonSqueezy.HandleSubscriptionUpdated(tx, remote); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,238 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testStoreID = "4242"
+
+// fakeLemonSqueezy serves subscription listings the way the LemonSqueezy API
+// pages them, and records the requests it gets.
+type fakeLemonSqueezy struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	pages    [][]LemonSqueezySubscription
+	status   int
+	requests []*http.Request
+}
+
+func newFakeLemonSqueezy(t *testing.T, pages ...[]LemonSqueezySubscription) *fakeLemonSqueezy {
+	t.Helper()
+	fake := &fakeLemonSqueezy{pages: pages, status: http.StatusOK}
+	fake.Server = httptest.NewServer(http.HandlerFunc(fake.serve))
+	t.Cleanup(fake.Close)
+	return fake
+}
+
+func (f *fakeLemonSqueezy) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r)
+
+	if f.status != http.StatusOK {
+		w.WriteHeader(f.status)
+		w.Write([]byte(`{"errors":[{"detail":"unavailable"}]}`))
+		return
+	}
+	if r.URL.Path != "/subscriptions" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	page := 0
+	if number, err := strconv.Atoi(r.URL.Query().Get("page[number]")); err == nil {
+		page = number - 1
+	}
+	var list lemonSqueezySubscriptionList
+	if page < len(f.pages) {
+		list.Data = f.pages[page]
+	}
+	if page+1 < len(f.pages) {
+		next := *r.URL
+		query := next.Query()
+		query.Set("page[number]", strconv.Itoa(page+2))
+		next.RawQuery = query.Encode()
+		list.Links.Next = f.URL + next.String()
+	}
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func (f *fakeLemonSqueezy) recorded() []*http.Request {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*http.Request(nil), f.requests...)
+}
+
+func newTestLemonSqueezy(fake *fakeLemonSqueezy) *LemonSqueezyService {
+	ls := NewLemonSqueezyService("test-api-key", "test-webhook-secret", nil)
+	ls.BaseURL = fake.URL
+	ls.StoreID = testStoreID
+	return ls
+}
+
+func testRemoteSubscription(id string, storeID int, status string) LemonSqueezySubscription {
+	now := time.Now().UTC().Truncate(time.Second)
+	var subscription LemonSqueezySubscription
+	subscription.ID = id
+	subscription.Type = "subscriptions"
+	subscription.Attributes.StoreID = storeID
+	subscription.Attributes.Status = status
+	subscription.Attributes.RenewsAt = now.Add(30 * 24 * time.Hour)
+	subscription.Attributes.CreatedAt = now.Add(-24 * time.Hour)
+	subscription.Attributes.UpdatedAt = now
+	return subscription
+}
+
+func TestReconcileSubscriptionsListsOurStoreOnly(t *testing.T) {
+	otherStore := testRemoteSubscription("1001", 7, SubscriptionActive)
+	testMode := testRemoteSubscription("1002", 4242, SubscriptionActive)
+	testMode.Attributes.TestMode = true
+	fake := newFakeLemonSqueezy(t,
+		[]LemonSqueezySubscription{otherStore},
+		[]LemonSqueezySubscription{testMode},
+	)
+
+	// Without a database, touching either subscription would panic
+	worker := NewBillingWorker(nil, newTestLemonSqueezy(fake), time.Minute)
+	if err := worker.ReconcileSubscriptions(context.Background()); err != nil {
+		t.Fatalf("ReconcileSubscriptions() error = %v", err)
+	}
+
+	requests := fake.recorded()
+	if len(requests) != 2 {
+		t.Fatalf("made %d requests, want one per page (2)", len(requests))
+	}
+	for _, r := range requests {
+		if got := r.URL.Query().Get("filter[store_id]"); got != testStoreID {
+			t.Errorf("request %s filter[store_id] = %q, want %q", r.URL, got, testStoreID)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer test-api-key" {
+			t.Errorf("request %s Authorization = %q", r.URL, got)
+		}
+	}
+	if got := requests[0].URL.Query().Get("page[size]"); got != "100" {
+		t.Errorf("page[size] = %q, want 100", got)
+	}
+	if got := requests[1].URL.Query().Get("page[number]"); got != "2" {
+		t.Errorf("second request page[number] = %q, want 2", got)
+	}
+}
+
+func TestReconcileSubscriptionsRejectsForeignNextLink(t *testing.T) {
+	var leaked []string
+	var mu sync.Mutex
+	foreign := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		leaked = append(leaked, r.Header.Get("Authorization"))
+	}))
+	t.Cleanup(foreign.Close)
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var list lemonSqueezySubscriptionList
+		list.Links.Next = foreign.URL + "/subscriptions?page[number]=2"
+		json.NewEncoder(w).Encode(list)
+	}))
+	t.Cleanup(api.Close)
+
+	ls := NewLemonSqueezyService("test-api-key", "test-webhook-secret", nil)
+	ls.BaseURL = api.URL
+	ls.StoreID = testStoreID
+	err := NewBillingWorker(nil, ls, time.Minute).ReconcileSubscriptions(context.Background())
+	if err == nil {
+		t.Fatal("ReconcileSubscriptions() followed a next link to another host")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(leaked) != 0 {
+		t.Errorf("sent %d requests to the foreign host, with Authorization %q", len(leaked), leaked)
+	}
+}
+
+func TestAPIRequestURLs(t *testing.T) {
+	ls := NewLemonSqueezyService("test-api-key", "", nil)
+	ls.BaseURL = "https://api.lemonsqueezy.com/v1"
+
+	tests := []struct {
+		url     string
+		allowed bool
+	}{
+		{"https://api.lemonsqueezy.com/v1/subscriptions?page[number]=2", true},
+		{"https://API.lemonsqueezy.com/v1/subscriptions", true},
+		{"http://api.lemonsqueezy.com/v1/subscriptions", false},
+		{"https://api.lemonsqueezy.com.evil.example/v1/subscriptions", false},
+		{"https://evil.example/v1/subscriptions", false},
+		{"https://user@api.lemonsqueezy.com/v1/subscriptions", false},
+		{"https://api.lemonsqueezy.com:8443/v1/subscriptions", false},
+	}
+	for _, tt := range tests {
+		if err := ls.checkAPIURL(tt.url); (err == nil) != tt.allowed {
+			t.Errorf("checkAPIURL(%q) error = %v, want allowed %v", tt.url, err, tt.allowed)
+		}
+	}
+}
+
+func TestReconcileSubscriptionsAPIError(t *testing.T) {
+	fake := newFakeLemonSqueezy(t)
+	fake.status = http.StatusServiceUnavailable
+
+	worker := NewBillingWorker(nil, newTestLemonSqueezy(fake), time.Minute)
+	err := worker.ReconcileSubscriptions(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("ReconcileSubscriptions() error = %v, want the API's 503", err)
+	}
+}
+
+func TestReconcileSubscriptionsAppliesDrift(t *testing.T) {
+	db := openTestDB(t)
+	userID := createTestUser(t, db)
+	subscriptionID := "ls-" + userID
+
+	_, err := db.Exec(`
+		INSERT INTO subscriptions (user_id, lemonsqueezy_subscription_id, status, current_period_start, current_period_end)
+		VALUES ($1, $2, $3, NOW() - INTERVAL '1 day', NOW() + INTERVAL '29 days')
+	`, userID, subscriptionID, SubscriptionActive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A cancellation whose webhook never arrived
+	remote := testRemoteSubscription(subscriptionID, 4242, SubscriptionCancelled)
+	endsAt := remote.Attributes.RenewsAt
+	remote.Attributes.EndsAt = &endsAt
+	fake := newFakeLemonSqueezy(t, []LemonSqueezySubscription{remote})
+
+	ls := newTestLemonSqueezy(fake)
+	ls.DB = db
+	ls.Subscriptions = NewSubscriptionStore(db)
+	worker := NewBillingWorker(db, ls, time.Minute)
+	if err := worker.ReconcileSubscriptions(context.Background()); err != nil {
+		t.Fatalf("ReconcileSubscriptions() error = %v", err)
+	}
+
+	var status string
+	var localEndsAt *time.Time
+	err = db.QueryRow(`
+		SELECT status, ends_at FROM subscriptions WHERE lemonsqueezy_subscription_id = $1
+	`, subscriptionID).Scan(&status, &localEndsAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != SubscriptionCancelled {
+		t.Errorf("local status = %q, want %q", status, SubscriptionCancelled)
+	}
+	if localEndsAt == nil || !localEndsAt.Equal(endsAt) {
+		t.Errorf("local ends_at = %v, want %v", localEndsAt, endsAt)
+	}
+}
@@ -0,0 +1,142 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Ledger reasons. Grants are positive amounts, consumptions negative.
+const (
+	CreditReasonPurchase    = "purchase"
+	CreditReasonConsumption = "consumption"
+	CreditReasonRelease     = "release"
+)
+
+type CreditService struct {
+	DB *sql.DB
+}
+
+// CreditEntry is a single append-only row of the credits ledger.
+type CreditEntry struct {
+	ID        int64     `json:"id"`
+	UserID    string    `json:"user_id"`
+	Amount    int       `json:"amount"`
+	Reason    string    `json:"reason"`
+	Reference string    `json:"reference,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CreditPack is a one-time LemonSqueezy purchase that grants credits.
+type CreditPack struct {
+	VariantID int    `json:"variant_id"`
+	Name      string `json:"name"`
+	Credits   int    `json:"credits"`
+}
+
+func NewCreditService(db *sql.DB) *CreditService {
+	return &CreditService{DB: db}
+}
+
+func (cs *CreditService) GetBalance(userID string) (int, error) {
+	return creditBalance(cs.DB, userID)
+}
+
+func creditBalance(q queryer, userID string) (int, error) {
+	var balance int
+	err := q.QueryRow(`
+		SELECT COALESCE(SUM(amount), 0) FROM credit_ledger WHERE user_id = $1
+	`, userID).Scan(&balance)
+	return balance, err
+}
+
+func (cs *CreditService) GetLedger(userID string, limit int) ([]CreditEntry, error) {
+	rows, err := cs.DB.Query(`
+		SELECT id, user_id, amount, reason, COALESCE(reference, ''), created_at
+		FROM credit_ledger
+		WHERE user_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2
+	`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []CreditEntry
+	for rows.Next() {
+		var entry CreditEntry
+		err := rows.Scan(&entry.ID, &entry.UserID, &entry.Amount, &entry.Reason,
+			&entry.Reference, &entry.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+func (cs *CreditService) GetPack(variantID int) (*CreditPack, error) {
+	return getCreditPack(cs.DB, variantID)
+}
+
+func getCreditPack(q queryer, variantID int) (*CreditPack, error) {
+	var pack CreditPack
+	err := q.QueryRow(`
+		SELECT lemonsqueezy_variant_id, name, credits
+		FROM credit_packs
+		WHERE lemonsqueezy_variant_id = $1
+	`, variantID).Scan(&pack.VariantID, &pack.Name, &pack.Credits)
+	if err != nil {
+		return nil, err
+	}
+	return &pack, nil
+}
+
+func (cs *CreditService) ListPacks() ([]CreditPack, error) {
+	rows, err := cs.DB.Query(`
+		SELECT lemonsqueezy_variant_id, name, credits
+		FROM credit_packs
+		ORDER BY credits
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var packs []CreditPack
+	for rows.Next() {
+		var pack CreditPack
+		if err := rows.Scan(&pack.VariantID, &pack.Name, &pack.Credits); err != nil {
+			return nil, err
+		}
+		packs = append(packs, pack)
+	}
+
+	return packs, rows.Err()
+}
+
+// addCredits appends a ledger entry. Entries with a reference are unique per
+// reason, so replaying the same grant is a no-op; it reports whether a row
+// was written.
+func addCredits(q queryer, userID string, amount int, reason, reference string) (bool, error) {
+	result, err := q.Exec(`
+		INSERT INTO credit_ledger (user_id, amount, reason, reference)
+		VALUES ($1, $2, $3, NULLIF($4, ''))
+		ON CONFLICT DO NOTHING
+	`, userID, amount, reason, reference)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+func reservationReference(reservationID int64) string {
+	return fmt.Sprintf("reservation:%d", reservationID)
+}
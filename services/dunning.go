@@ -0,0 +1,270 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// DefaultDunningSteps are the days after a renewal payment first fails on
+// which the subscriber is reminded to update their payment method.
+var DefaultDunningSteps = []int{0, 3, 7, 12}
+
+// DunningService follows up on failed renewal payments. Access is kept for
+// PaymentGracePeriod after the first failure; meanwhile the subscriber gets a
+// reminder on each of Steps, and a last email once the grace period has run
+// out and the entitlement has lapsed. Recovering the payment at any point
+// restores the subscription and resets the sequence. Each run also moves the
+// access of failed payments to the current PaymentGracePeriod.
+type DunningService struct {
+	DB     *sql.DB
+	Mailer Mailer
+	Steps  []int
+	// BillingURL is where subscribers update their payment method. It is
+	// included in the emails when set.
+	BillingURL string
+}
+
+// DunningState is what the app shows in its payment failed banner.
+type DunningState struct {
+	Status          string    `json:"status"`
+	PaymentFailedAt time.Time `json:"payment_failed_at"`
+	GraceEndsAt     time.Time `json:"grace_ends_at"`
+	DaysLeft        int       `json:"days_left"`
+	Downgraded      bool      `json:"downgraded"`
+}
+
+type dunningSubscription struct {
+	provider        string
+	subscriptionID  string
+	email           string
+	paymentFailedAt time.Time
+	step            int
+}
+
+func NewDunningService(db *sql.DB, mailer Mailer) *DunningService {
+	return &DunningService{
+		DB:     db,
+		Mailer: mailer,
+		Steps:  DefaultDunningSteps,
+	}
+}
+
+// GetDunningState returns the banner state for the user's subscription with a
+// failed payment, or nil if their payments are in order.
+func (d *DunningService) GetDunningState(userID string) (*DunningState, error) {
+	var state DunningState
+	err := d.DB.QueryRow(`
+		SELECT status, payment_failed_at
+		FROM subscriptions
+		WHERE user_id = $1 AND payment_failed_at IS NOT NULL AND status IN ($2, $3)
+		ORDER BY payment_failed_at DESC
+		LIMIT 1
+	`, userID, SubscriptionPastDue, SubscriptionUnpaid).Scan(&state.Status, &state.PaymentFailedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state.GraceEndsAt = state.PaymentFailedAt.Add(PaymentGracePeriod)
+	remaining := time.Until(state.GraceEndsAt)
+	state.Downgraded = remaining <= 0
+	if !state.Downgraded {
+		state.DaysLeft = int((remaining + 24*time.Hour - 1) / (24 * time.Hour))
+	}
+	return &state, nil
+}
+
+// Run sends the dunning emails that have come due. Each subscription gets at
+// most one email per run; steps missed while the worker was down are skipped
+// in favour of the latest one.
+func (d *DunningService) Run(ctx context.Context) error {
+	if err := d.ApplyGracePeriod(ctx); err != nil {
+		return err
+	}
+
+	subscriptions, err := d.dueSubscriptions()
+	if err != nil {
+		return err
+	}
+
+	for _, sub := range subscriptions {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		step := d.stepDue(sub.paymentFailedAt, time.Now())
+		if step <= sub.step {
+			continue
+		}
+
+		claimed, err := d.claimStep(sub, sub.step, step)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			continue
+		}
+
+		if err := d.Mailer.Send(d.message(sub, step)); err != nil {
+			log.Printf("Dunning email %d for subscription %s failed: %v", step, sub.subscriptionID, err)
+			// Release the step so the next run retries it
+			if _, err := d.claimStep(sub, step, sub.step); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ApplyGracePeriod recomputes the entitlements of subscriptions with a
+// failed payment whose access doesn't end PaymentGracePeriod after the
+// failure, so changing the grace period also applies to payments that have
+// already failed. Lengthening it restores access that had lapsed.
+func (d *DunningService) ApplyGracePeriod(ctx context.Context) error {
+	rows, err := d.DB.Query(`
+		SELECT
+			CASE WHEN s.lemonsqueezy_subscription_id IS NOT NULL THEN $1 ELSE $2 END,
+			COALESCE(s.lemonsqueezy_subscription_id, s.stripe_subscription_id)
+		FROM subscriptions s
+		LEFT JOIN entitlements e ON e.source = $3
+			AND e.source_id = COALESCE(s.lemonsqueezy_subscription_id, s.stripe_subscription_id)
+		WHERE s.user_id IS NOT NULL AND s.payment_failed_at IS NOT NULL AND s.status IN ($4, $5)
+			AND e.expires_at IS DISTINCT FROM s.payment_failed_at + make_interval(secs => $6)
+	`, BillingProviderLemonSqueezy, BillingProviderStripe, EntitlementSourceSubscription,
+		SubscriptionPastDue, SubscriptionUnpaid, PaymentGracePeriod.Seconds())
+	if err != nil {
+		return err
+	}
+	var subscriptions []dunningSubscription
+	for rows.Next() {
+		var sub dunningSubscription
+		if err := rows.Scan(&sub.provider, &sub.subscriptionID); err != nil {
+			rows.Close()
+			return err
+		}
+		subscriptions = append(subscriptions, sub)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, sub := range subscriptions {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := d.refreshEntitlement(sub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *DunningService) refreshEntitlement(sub dunningSubscription) error {
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := setAuditContext(tx, AuditActor{Type: AuditActorSystem}, "entitlement.grace_period"); err != nil {
+		return err
+	}
+	if err := refreshSubscriptionEntitlement(tx, sub.provider, sub.subscriptionID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (d *DunningService) dueSubscriptions() ([]dunningSubscription, error) {
+	rows, err := d.DB.Query(`
+		SELECT
+			CASE WHEN s.lemonsqueezy_subscription_id IS NOT NULL THEN $1 ELSE $2 END,
+			COALESCE(s.lemonsqueezy_subscription_id, s.stripe_subscription_id),
+			u.email, s.payment_failed_at, s.dunning_step
+		FROM subscriptions s
+		JOIN users u ON u.id = s.user_id
+		WHERE s.payment_failed_at IS NOT NULL AND s.status IN ($3, $4)
+	`, BillingProviderLemonSqueezy, BillingProviderStripe, SubscriptionPastDue, SubscriptionUnpaid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subscriptions []dunningSubscription
+	for rows.Next() {
+		var sub dunningSubscription
+		if err := rows.Scan(&sub.provider, &sub.subscriptionID, &sub.email, &sub.paymentFailedAt, &sub.step); err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, sub)
+	}
+	return subscriptions, rows.Err()
+}
+
+// stepDue numbers the reminders from 1 in order of their day; the email sent
+// when the grace period ends is step len(Steps)+1.
+func (d *DunningService) stepDue(paymentFailedAt, now time.Time) int {
+	if !now.Before(paymentFailedAt.Add(PaymentGracePeriod)) {
+		return len(d.Steps) + 1
+	}
+
+	days := append([]int(nil), d.Steps...)
+	sort.Ints(days)
+	step := 0
+	for _, day := range days {
+		if now.Before(paymentFailedAt.AddDate(0, 0, day)) {
+			break
+		}
+		step++
+	}
+	return step
+}
+
+// claimStep moves the subscription from one step to another unless a
+// concurrent run or a webhook has changed it in the meantime.
+func (d *DunningService) claimStep(sub dunningSubscription, from, to int) (bool, error) {
+	columns, err := columnsFor(sub.provider)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := d.DB.Exec(fmt.Sprintf(`
+		UPDATE subscriptions
+		SET dunning_step = $2
+		WHERE %s = $1 AND dunning_step = $3 AND payment_failed_at = $4
+	`, columns.id), sub.subscriptionID, to, from, sub.paymentFailedAt)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (d *DunningService) message(sub dunningSubscription, step int) MailMessage {
+	graceEndsAt := sub.paymentFailedAt.Add(PaymentGracePeriod)
+
+	var message MailMessage
+	message.To = sub.email
+	if step > len(d.Steps) {
+		message.Subject = "Your EmailDrip Pro access has ended"
+		message.Body = "We still couldn't collect the payment for your EmailDrip subscription, " +
+			"so your account has moved to the free plan.\n\n" +
+			"Update your payment method to get Pro back straight away."
+	} else {
+		message.Subject = "Your EmailDrip payment failed"
+		message.Body = fmt.Sprintf("We couldn't collect the latest payment for your EmailDrip subscription.\n\n"+
+			"You keep Pro until %s. Update your payment method before then to avoid losing access.",
+			graceEndsAt.Format("January 2, 2006"))
+	}
+	if d.BillingURL != "" {
+		message.Body += "\n\n" + d.BillingURL
+	}
+	return message
+}
@@ -2,11 +2,35 @@ package services
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
 	"time"
 )
 
+// ErrUsageLimitReached is returned by ReserveUsage when the user has no
+// requests left in the current window.
+var ErrUsageLimitReached = errors.New("usage limit reached")
+
+// ErrUserNotFound is returned when an operation names a user that doesn't exist.
+var ErrUserNotFound = errors.New("user not found")
+
+// ErrInvalidTimezone is returned when a timezone isn't a known IANA name.
+var ErrInvalidTimezone = errors.New("invalid timezone")
+
+// Reservation sources: a unit of the plan quota, or a prepaid credit once the
+// quota is exhausted.
+const (
+	UsageSourceQuota  = "quota"
+	UsageSourceCredit = "credit"
+)
+
+// reservationTTL bounds how long a pending reservation counts against the
+// quota when the request that took it never settled (e.g. the process died).
+const reservationTTL = 5 * time.Minute
+
 type EmailService struct {
-	DB *sql.DB
+	DB    *sql.DB
+	Plans *PlanService
 }
 
 type EmailRecord struct {
@@ -17,26 +41,53 @@ type EmailRecord struct {
 	Roast     string    `json:"roast"`
 	Tone      string    `json:"tone"`
 	RoastMode bool      `json:"roast_mode"`
+	APIKeyID  *int64    `json:"api_key_id,omitempty"` // set when made with a personal API key
 	CreatedAt time.Time `json:"created_at"`
 }
 
-func NewEmailService(db *sql.DB) *EmailService {
-	return &EmailService{DB: db}
+// UsageReservation is a unit of quota held for a single request. It must be
+// settled with either CommitUsage or ReleaseUsage.
+type UsageReservation struct {
+	ID       int64
+	UserID   string
+	Source   string
+	APIKeyID *int64
+}
+
+// Usage is a user's consumption within their plan's current quota window.
+type Usage struct {
+	Count    int
+	ResetsAt time.Time
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func NewEmailService(db *sql.DB, plans *PlanService) *EmailService {
+	return &EmailService{DB: db, Plans: plans}
 }
 
 func (es *EmailService) SaveEmail(email EmailRecord) error {
+	return saveEmail(es.DB, email)
+}
+
+func saveEmail(q queryer, email EmailRecord) error {
 	query := `
-		INSERT INTO emails (user_id, original, rewritten, roast, tone, roast_mode)
-		VALUES ($1, $2, $3, $4, $5, $6)
+		INSERT INTO emails (user_id, original, rewritten, roast, tone, roast_mode, api_key_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
 	`
-	_, err := es.DB.Exec(query, email.UserID, email.Original, email.Rewritten,
-		email.Roast, email.Tone, email.RoastMode)
+	_, err := q.Exec(query, email.UserID, email.Original, email.Rewritten,
+		email.Roast, email.Tone, email.RoastMode, email.APIKeyID)
 	return err
 }
 
 func (es *EmailService) GetUserEmails(userID string, limit int) ([]EmailRecord, error) {
 	query := `
-		SELECT id, user_id, original, rewritten, COALESCE(roast, ''), tone, roast_mode, created_at
+		SELECT id, user_id, original, rewritten, COALESCE(roast, ''), tone, roast_mode, api_key_id, created_at
 		FROM emails
 		WHERE user_id = $1
 		ORDER BY created_at DESC
@@ -52,48 +103,372 @@ func (es *EmailService) GetUserEmails(userID string, limit int) ([]EmailRecord,
 	var emails []EmailRecord
 	for rows.Next() {
 		var email EmailRecord
+		var apiKeyID sql.NullInt64
 		err := rows.Scan(&email.ID, &email.UserID, &email.Original, &email.Rewritten,
-			&email.Roast, &email.Tone, &email.RoastMode, &email.CreatedAt)
+			&email.Roast, &email.Tone, &email.RoastMode, &apiKeyID, &email.CreatedAt)
 		if err != nil {
 			return nil, err
 		}
+		if apiKeyID.Valid {
+			email.APIKeyID = &apiKeyID.Int64
+		}
 		emails = append(emails, email)
 	}
 
 	return emails, nil
 }
 
-func (es *EmailService) IncrementUsage(userID string) error {
-	_, err := es.DB.Exec("SELECT increment_usage($1)", userID)
+// GetUserUsage returns the requests counted against the user's quota in the
+// plan's current window, including reservations still in flight, and when
+// the quota next frees up.
+func (es *EmailService) GetUserUsage(userID string, plan *Plan) (*Usage, error) {
+	return getUsage(es.DB, userID, plan, time.Now())
+}
+
+func getUsage(q queryer, userID string, plan *Plan, now time.Time) (*Usage, error) {
+	since, resetsAt, err := quotaWindow(q, userID, plan, now)
+	if err != nil {
+		return nil, err
+	}
+
+	var usage Usage
+	var oldest sql.NullTime
+	err = q.QueryRow(`
+		SELECT COUNT(*), MIN(created_at)
+		FROM usage_reservations
+		WHERE user_id = $1
+			AND source = 'quota'
+			AND created_at >= $2
+			AND created_at >= COALESCE((SELECT usage_reset_at FROM users WHERE id = $1), $2)
+			AND (
+				status = 'committed'
+				OR (status = 'pending' AND created_at > NOW() - make_interval(secs => $3))
+			)
+	`, userID, since, reservationTTL.Seconds()).Scan(&usage.Count, &oldest)
+	if err != nil {
+		return nil, err
+	}
+
+	// A rolling window frees its next unit when the oldest one ages out
+	if plan.WindowPolicy == WindowRolling && oldest.Valid {
+		resetsAt = oldest.Time.Add(plan.PeriodLength())
+	}
+	usage.ResetsAt = resetsAt
+
+	return &usage, nil
+}
+
+// quotaWindow returns the start and end of the user's quota window
+// containing now. A calendar window held by a recent timezone change widens
+// it until the held window ends.
+func quotaWindow(q queryer, userID string, plan *Plan, now time.Time) (time.Time, time.Time, error) {
+	loc, err := userLocation(q, userID)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	since, resetsAt := plan.Window(now, loc)
+	if plan.WindowPolicy == WindowRolling {
+		return since, resetsAt, nil
+	}
+
+	var heldFrom, heldUntil sql.NullTime
+	err = q.QueryRow(`
+		SELECT quota_window_held_from, quota_window_held_until FROM users WHERE id = $1
+	`, userID).Scan(&heldFrom, &heldUntil)
+	if err != nil && err != sql.ErrNoRows {
+		return time.Time{}, time.Time{}, err
+	}
+	if heldFrom.Valid && heldUntil.Valid && now.Before(heldUntil.Time) {
+		if heldFrom.Time.Before(since) {
+			since = heldFrom.Time
+		}
+		if heldUntil.Time.After(resetsAt) {
+			resetsAt = heldUntil.Time
+		}
+	}
+	return since, resetsAt, nil
+}
+
+// holdQuotaWindow keeps the user's current calendar quota window in effect
+// when they move to another timezone, so a change can't start a fresh window
+// early. A window held by an earlier change that hasn't ended yet is merged
+// in. Callers update the timezone in the same transaction.
+func holdQuotaWindow(tx *sql.Tx, userID, timezone string) error {
+	var current string
+	err := tx.QueryRow(`SELECT timezone FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(&current)
+	if err == sql.ErrNoRows {
+		return nil // the caller's update reports the missing user
+	}
+	if err != nil {
+		return err
+	}
+	if current == timezone {
+		return nil
+	}
+
+	plan, err := getUserPlan(tx, userID)
+	if err != nil {
+		return err
+	}
+	if plan.WindowPolicy == WindowRolling {
+		return nil
+	}
+	from, until, err := quotaWindow(tx, userID, plan, time.Now())
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE users SET quota_window_held_from = $2, quota_window_held_until = $3
+		WHERE id = $1
+	`, userID, from, until)
 	return err
 }
 
-func (es *EmailService) GetUserUsage(userID string) (int, error) {
-	var usage int
-	err := es.DB.QueryRow("SELECT get_user_usage($1)", userID).Scan(&usage)
-	return usage, err
+// Today returns the current date in the user's timezone, at midnight UTC
+// like dates parsed from requests.
+func (es *EmailService) Today(userID string) (time.Time, error) {
+	loc, err := userLocation(es.DB, userID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	now := time.Now().In(loc)
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC), nil
+}
+
+// userLocation returns the user's configured timezone, defaulting to UTC for
+// unknown users or names the server can't load.
+func userLocation(q queryer, userID string) (*time.Location, error) {
+	var name string
+	err := q.QueryRow("SELECT timezone FROM users WHERE id = $1", userID).Scan(&name)
+	if err == sql.ErrNoRows {
+		return time.UTC, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return time.UTC, nil
+	}
+	return loc, nil
+}
+
+// RecordAIError logs a failed AI call for staff to look into. Failures to log
+// are returned but shouldn't fail the request.
+func (es *EmailService) RecordAIError(userID, operation string, aiErr error) error {
+	_, err := es.DB.Exec(`
+		INSERT INTO ai_errors (user_id, operation, error) VALUES ($1, $2, $3)
+	`, userID, operation, aiErr.Error())
+	return err
 }
 
+// SetUserTimezone stores the IANA timezone used for the user's quota windows.
+// The current window runs to its end before windows in the new timezone
+// apply.
+func (es *EmailService) SetUserTimezone(actor AuditActor, userID, timezone string) error {
+	if _, err := time.LoadLocation(timezone); err != nil {
+		return ErrInvalidTimezone
+	}
+
+	tx, err := es.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := setAuditContext(tx, actor, "user.timezone_set"); err != nil {
+		return err
+	}
+	if err := holdQuotaWindow(tx, userID, timezone); err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(`
+		UPDATE users SET timezone = $1, updated_at = NOW()
+		WHERE id = $2
+	`, timezone, userID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+
+	return tx.Commit()
+}
+
+// IsUserPro reports whether the user has any active paid entitlement.
 func (es *EmailService) IsUserPro(userID string) (bool, error) {
 	var isPro bool
-	err := es.DB.QueryRow("SELECT is_user_pro($1)", userID).Scan(&isPro)
+	err := es.DB.QueryRow("SELECT EXISTS ("+activeEntitlementsSQL+")", userID).Scan(&isPro)
 	return isPro, err
 }
 
+// GetActiveEntitlement returns the entitlement deciding the user's plan, or
+// nil when they're on the free plan.
+func (es *EmailService) GetActiveEntitlement(userID string) (*Entitlement, error) {
+	return activeEntitlement(es.DB, userID)
+}
+
 func (es *EmailService) CanUserMakeRequest(userID string) (bool, error) {
-	isPro, err := es.IsUserPro(userID)
+	plan, err := es.Plans.GetUserPlan(userID)
 	if err != nil {
 		return false, err
 	}
 
-	if isPro {
+	if plan.Unlimited() {
 		return true, nil
 	}
 
-	usage, err := es.GetUserUsage(userID)
+	usage, err := es.GetUserUsage(userID, plan)
 	if err != nil {
 		return false, err
 	}
 
-	return usage < 5, nil // Free limit is 5
+	if usage.Count < *plan.RequestLimit {
+		return true, nil
+	}
+
+	// Prepaid credits are used once the free quota is exhausted
+	balance, err := creditBalance(es.DB, userID)
+	if err != nil {
+		return false, err
+	}
+
+	return balance > 0, nil
+}
+
+// ReserveUsage atomically checks the user's quota and holds one unit of it,
+// falling back to a prepaid credit once the quota is used up. It returns
+// ErrUsageLimitReached when neither is left. apiKeyID attributes the usage to
+// the personal API key the request was made with, if any.
+func (es *EmailService) ReserveUsage(userID string, apiKeyID *int64) (*UsageReservation, error) {
+	tx, err := es.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Serialise reservations per user so concurrent requests see each other's rows
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext($1))", userID); err != nil {
+		return nil, err
+	}
+
+	plan, err := getUserPlan(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	source := UsageSourceQuota
+	if !plan.Unlimited() {
+		usage, err := getUsage(tx, userID, plan, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		if usage.Count >= *plan.RequestLimit {
+			balance, err := creditBalance(tx, userID)
+			if err != nil {
+				return nil, err
+			}
+			if balance <= 0 {
+				return nil, ErrUsageLimitReached
+			}
+			source = UsageSourceCredit
+		}
+	}
+
+	reservation := &UsageReservation{UserID: userID, Source: source, APIKeyID: apiKeyID}
+	err = tx.QueryRow(`
+		INSERT INTO usage_reservations (user_id, source, api_key_id)
+		VALUES ($1, $2, $3)
+		RETURNING id
+	`, userID, source, apiKeyID).Scan(&reservation.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Credits are debited up front and given back if the reservation is released
+	if source == UsageSourceCredit {
+		_, err := addCredits(tx, userID, -1, CreditReasonConsumption, reservationReference(reservation.ID))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return reservation, nil
+}
+
+// CommitUsage saves the email and marks the reservation as consumed in a
+// single transaction.
+func (es *EmailService) CommitUsage(reservation *UsageReservation, email EmailRecord) error {
+	tx, err := es.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := saveEmail(tx, email); err != nil {
+		return err
+	}
+
+	if err := settleReservation(tx, reservation, "committed"); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ReleaseUsage gives a reserved unit back to the user, e.g. when the AI call
+// failed, refunding the credit if one was spent.
+func (es *EmailService) ReleaseUsage(reservation *UsageReservation) error {
+	tx, err := es.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := settleReservation(tx, reservation, "released"); err != nil {
+		return err
+	}
+
+	if reservation.Source == UsageSourceCredit {
+		_, err := addCredits(tx, reservation.UserID, 1, CreditReasonRelease, reservationReference(reservation.ID))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func settleReservation(q queryer, reservation *UsageReservation, status string) error {
+	result, err := q.Exec(`
+		UPDATE usage_reservations
+		SET status = $1, settled_at = NOW()
+		WHERE id = $2 AND status = 'pending'
+	`, status, reservation.ID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return fmt.Errorf("usage reservation %d is already settled", reservation.ID)
+	}
+
+	return nil
 }
@@ -0,0 +1,223 @@
+package services
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"emaildrip-be/databases"
+
+	_ "github.com/lib/pq"
+)
+
+// openTestDB connects to the Postgres database in TEST_DATABASE_URL and
+// migrates it, skipping the test when it isn't set. Tests create their own
+// users, so they can share the database.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	databases.Migrate(db)
+	return db
+}
+
+func newTestUUID(t *testing.T) string {
+	t.Helper()
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// createTestUser adds a user on the free plan.
+func createTestUser(t *testing.T, db *sql.DB) string {
+	t.Helper()
+	userID := newTestUUID(t)
+	if _, err := db.Exec(`INSERT INTO users (id, email) VALUES ($1, $2)`, userID, userID+"@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	return userID
+}
+
+// hammerReserveUsage reserves usage for the user from many goroutines at once
+// and returns the reservations that succeeded.
+func hammerReserveUsage(t *testing.T, es *EmailService, userID string, attempts int) []*UsageReservation {
+	t.Helper()
+
+	var (
+		wg           sync.WaitGroup
+		mu           sync.Mutex
+		reservations []*UsageReservation
+		errs         []error
+	)
+	start := make(chan struct{})
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			reservation, err := es.ReserveUsage(userID, nil)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				reservations = append(reservations, reservation)
+			case !errors.Is(err, ErrUsageLimitReached):
+				errs = append(errs, err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	for _, err := range errs {
+		t.Errorf("ReserveUsage() unexpected error: %v", err)
+	}
+	return reservations
+}
+
+func freePlanLimit(t *testing.T, db *sql.DB) int {
+	t.Helper()
+	var limit int
+	if err := db.QueryRow(`SELECT request_limit FROM plans WHERE id = 'free'`).Scan(&limit); err != nil {
+		t.Fatal(err)
+	}
+	return limit
+}
+
+func TestReserveUsageConcurrentQuota(t *testing.T) {
+	db := openTestDB(t)
+	es := NewEmailService(db, NewPlanService(db))
+	userID := createTestUser(t, db)
+	limit := freePlanLimit(t, db)
+
+	reservations := hammerReserveUsage(t, es, userID, 10*limit)
+	if len(reservations) != limit {
+		t.Fatalf("got %d reservations from concurrent requests, want the free limit of %d", len(reservations), limit)
+	}
+	for _, reservation := range reservations {
+		if reservation.Source != UsageSourceQuota {
+			t.Errorf("reservation %d source = %q, want %q", reservation.ID, reservation.Source, UsageSourceQuota)
+		}
+	}
+
+	// Released reservations free their unit for the next request
+	if err := es.ReleaseUsage(reservations[0]); err != nil {
+		t.Fatal(err)
+	}
+	if got := hammerReserveUsage(t, es, userID, 10); len(got) != 1 {
+		t.Fatalf("got %d reservations after releasing one, want 1", len(got))
+	}
+}
+
+func TestReserveUsageConcurrentCredits(t *testing.T) {
+	db := openTestDB(t)
+	es := NewEmailService(db, NewPlanService(db))
+	userID := createTestUser(t, db)
+	limit := freePlanLimit(t, db)
+
+	const credits = 3
+	if _, err := addCredits(db, userID, credits, CreditReasonPurchase, "test-"+userID); err != nil {
+		t.Fatal(err)
+	}
+
+	reservations := hammerReserveUsage(t, es, userID, 10*(limit+credits))
+	if len(reservations) != limit+credits {
+		t.Fatalf("got %d reservations, want %d quota and %d credit", len(reservations), limit, credits)
+	}
+
+	var fromCredits int
+	for _, reservation := range reservations {
+		if reservation.Source == UsageSourceCredit {
+			fromCredits++
+		}
+	}
+	if fromCredits != credits {
+		t.Errorf("%d reservations used credits, want %d", fromCredits, credits)
+	}
+
+	balance, err := creditBalance(db, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != 0 {
+		t.Errorf("credit balance = %d after using every credit, want 0", balance)
+	}
+}
+
+func TestSetUserTimezoneKeepsQuotaWindow(t *testing.T) {
+	db := openTestDB(t)
+	es := NewEmailService(db, NewPlanService(db))
+	userID := createTestUser(t, db)
+	limit := freePlanLimit(t, db)
+
+	now := time.Now().UTC()
+	if now.Hour() == 0 {
+		t.Skip("no timezone's day starts between UTC midnight and now")
+	}
+	// A timezone whose day started at the top of this hour, after the
+	// usage below
+	zone := fmt.Sprintf("Etc/GMT+%d", now.Hour())
+	if now.Hour() > 12 {
+		zone = fmt.Sprintf("Etc/GMT-%d", 24-now.Hour())
+	}
+
+	usedAt := time.Date(now.Year(), now.Month(), now.Day(), 0, 1, 0, 0, time.UTC)
+	_, err := db.Exec(`
+		INSERT INTO usage_reservations (user_id, source, status, created_at, settled_at)
+		SELECT $1, 'quota', 'committed', $2, $2 FROM generate_series(1, $3)
+	`, userID, usedAt, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := es.SetUserTimezone(AuditActor{Type: AuditActorSystem}, userID, zone); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := es.ReserveUsage(userID, nil); !errors.Is(err, ErrUsageLimitReached) {
+		t.Fatalf("ReserveUsage() after moving to %s error = %v, want %v", zone, err, ErrUsageLimitReached)
+	}
+
+	// Moving back and forth can't shrink the held window either
+	if err := es.SetUserTimezone(AuditActor{Type: AuditActorSystem}, userID, "UTC"); err != nil {
+		t.Fatal(err)
+	}
+	if err := es.SetUserTimezone(AuditActor{Type: AuditActorSystem}, userID, zone); err != nil {
+		t.Fatal(err)
+	}
+	usage, err := es.GetUserUsage(userID, mustUserPlan(t, es, userID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Count != limit {
+		t.Errorf("usage count = %d after timezone changes, want %d", usage.Count, limit)
+	}
+}
+
+func mustUserPlan(t *testing.T, es *EmailService, userID string) *Plan {
+	t.Helper()
+	plan, err := es.Plans.GetUserPlan(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plan
+}
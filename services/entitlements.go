@@ -0,0 +1,289 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Subscription statuses reported by LemonSqueezy, plus SubscriptionRefunded
+// which is set locally when the order that started a subscription is refunded.
+// Other providers' statuses are mapped onto these.
+const (
+	SubscriptionOnTrial   = "on_trial"
+	SubscriptionActive    = "active"
+	SubscriptionPaused    = "paused"
+	SubscriptionPastDue   = "past_due"
+	SubscriptionUnpaid    = "unpaid"
+	SubscriptionCancelled = "cancelled"
+	SubscriptionExpired   = "expired"
+	SubscriptionRefunded  = "refunded"
+)
+
+// Entitlement sources other than grants. Legacy entitlements keep the plan
+// of users who were made pro before entitlements existed, without a
+// subscription; they don't expire.
+const (
+	EntitlementSourceSubscription = "subscription"
+	EntitlementSourceLegacy       = "legacy"
+)
+
+// renewalLeeway keeps access across a renewal until its webhook arrives.
+const renewalLeeway = 24 * time.Hour
+
+// PaymentGracePeriod keeps access for this long after a renewal payment first
+// fails, while the provider retries it and the user is reminded to update
+// their card. It is set from configuration at startup.
+var PaymentGracePeriod = 14 * 24 * time.Hour
+
+// Entitlement is access to a plan from one source, valid until ExpiresAt.
+type Entitlement struct {
+	Source      string    `json:"source"`
+	SourceID    string    `json:"source_id"`
+	PlanID      string    `json:"plan_id"`
+	Status      string    `json:"status"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	WorkspaceID *int64    `json:"workspace_id,omitempty"` // shared with the workspace's members
+}
+
+// SubscriptionAccessUntil maps a subscription's status and dates to the time
+// its access ends. It returns nil for statuses that grant no access.
+//
+//	on_trial   until trial_ends_at
+//	active     until renews_at, plus leeway for the renewal webhook
+//	past_due   until the grace period after the first failed payment
+//	unpaid     as past_due, if a renewal payment failed; otherwise no access
+//	cancelled  until ends_at; the paid period still runs out
+//	paused, expired, refunded  no access
+//
+// A paused subscription isn't paid for, so its holder falls back to the free
+// plan until it is unpaused; subscriptions are only paused in void mode.
+// past_due and unpaid are treated alike because providers differ in which
+// one they report while retrying, and access should not depend on that.
+func SubscriptionAccessUntil(status string, renewsAt time.Time, endsAt, trialEndsAt, paymentFailedAt *time.Time) *time.Time {
+	var until time.Time
+	switch status {
+	case SubscriptionOnTrial:
+		until = renewsAt
+		if trialEndsAt != nil {
+			until = *trialEndsAt
+		}
+		until = until.Add(renewalLeeway)
+	case SubscriptionActive:
+		until = renewsAt.Add(renewalLeeway)
+	case SubscriptionPastDue:
+		until = renewsAt
+		if paymentFailedAt != nil {
+			until = *paymentFailedAt
+		}
+		until = until.Add(PaymentGracePeriod)
+	case SubscriptionUnpaid:
+		if paymentFailedAt == nil {
+			return nil
+		}
+		until = paymentFailedAt.Add(PaymentGracePeriod)
+	case SubscriptionCancelled:
+		until = renewsAt
+		if endsAt != nil {
+			until = *endsAt
+		}
+	default:
+		return nil
+	}
+	return &until
+}
+
+// refreshSubscriptionEntitlement recomputes the entitlement granted by a
+// subscription from its stored row and updates the cached pro status of
+// everyone it covers. A workspace subscription also sets the workspace's seats.
+func refreshSubscriptionEntitlement(tx *sql.Tx, provider, subscriptionID string) error {
+	columns, err := columnsFor(provider)
+	if err != nil {
+		return err
+	}
+
+	var userID sql.NullString
+	var status, planID string
+	var renewsAt sql.NullTime
+	var endsAt, trialEndsAt, paymentFailedAt sql.NullTime
+	var workspaceID sql.NullInt64
+	var quantity int
+	err = tx.QueryRow(fmt.Sprintf(`
+		SELECT user_id, status, current_period_end, ends_at, trial_ends_at, COALESCE(plan_id, 'pro'),
+			workspace_id, quantity, payment_failed_at
+		FROM subscriptions
+		WHERE %s = $1
+	`, columns.id), subscriptionID).Scan(&userID, &status, &renewsAt, &endsAt, &trialEndsAt, &planID,
+		&workspaceID, &quantity, &paymentFailedAt)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !userID.Valid {
+		return nil
+	}
+
+	expiresAt := time.Now()
+	if until := SubscriptionAccessUntil(status, renewsAt.Time, nullTimePtr(endsAt), nullTimePtr(trialEndsAt),
+		nullTimePtr(paymentFailedAt)); until != nil {
+		expiresAt = *until
+	}
+
+	entitlement := Entitlement{
+		Source:    EntitlementSourceSubscription,
+		SourceID:  subscriptionID,
+		PlanID:    planID,
+		Status:    status,
+		ExpiresAt: expiresAt,
+	}
+	if workspaceID.Valid {
+		entitlement.WorkspaceID = &workspaceID.Int64
+	}
+	if err := upsertEntitlement(tx, userID.String, entitlement); err != nil {
+		return err
+	}
+
+	if workspaceID.Valid {
+		_, err := tx.Exec(`
+			UPDATE workspaces SET seats = GREATEST($2, 1), updated_at = NOW() WHERE id = $1
+		`, workspaceID.Int64, quantity)
+		if err != nil {
+			return err
+		}
+		if err := syncWorkspaceEntitlements(tx, workspaceID.Int64); err != nil {
+			return err
+		}
+	}
+
+	return syncUserEntitlements(tx, userID.String)
+}
+
+func upsertEntitlement(q queryer, userID string, entitlement Entitlement) error {
+	_, err := q.Exec(`
+		INSERT INTO entitlements (user_id, source, source_id, plan_id, status, expires_at, workspace_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (source, source_id)
+		DO UPDATE SET
+			user_id = $1,
+			plan_id = $4,
+			status = $5,
+			expires_at = $6,
+			workspace_id = $7,
+			updated_at = NOW()
+	`, userID, entitlement.Source, entitlement.SourceID, entitlement.PlanID,
+		entitlement.Status, entitlement.ExpiresAt, entitlement.WorkspaceID)
+	return err
+}
+
+// syncUserEntitlements refreshes the is_pro and plan_id columns on users,
+// which cache the user's best active entitlement for other readers.
+func syncUserEntitlements(q queryer, userID string) error {
+	_, err := q.Exec(`
+		UPDATE users
+		SET
+			is_pro = EXISTS (`+activeEntitlementsSQL+`),
+			plan_id = COALESCE((`+bestEntitlementPlanSQL+`), 'free'),
+			updated_at = NOW()
+		WHERE id = $1
+	`, userID)
+	return err
+}
+
+// syncWorkspaceEntitlements refreshes the cached pro status of every member
+// of the workspace.
+func syncWorkspaceEntitlements(q queryer, workspaceID int64) error {
+	rows, err := q.Query(`SELECT user_id FROM workspace_members WHERE workspace_id = $1`, workspaceID)
+	if err != nil {
+		return err
+	}
+
+	var members []string
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return err
+		}
+		members = append(members, userID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, userID := range members {
+		if err := syncUserEntitlements(q, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seatedMemberSQL is true for a workspace member m of workspace w who has a
+// seat. Seats go to the owner first, then in order of joining, so lowering
+// the seats of a workspace leaves its newest members over the limit.
+const seatedMemberSQL = `((
+		SELECT COUNT(*) FROM workspace_members o
+		WHERE o.workspace_id = m.workspace_id
+			AND (o.user_id <> w.owner_id, o.joined_at, o.user_id) < (m.user_id <> w.owner_id, m.joined_at, m.user_id)
+	) < w.seats)`
+
+// entitlementHolder matches entitlements held by the user in userExpr,
+// directly or through a workspace where they have a seat. Workspace
+// entitlements follow membership, not the user who bought them.
+func entitlementHolder(userExpr string) string {
+	return `((e.workspace_id IS NULL AND e.user_id = ` + userExpr + `) OR e.workspace_id IN (
+		SELECT m.workspace_id FROM workspace_members m JOIN workspaces w ON w.id = m.workspace_id
+		WHERE m.user_id = ` + userExpr + ` AND ` + seatedMemberSQL + `
+	))`
+}
+
+// entitlementHolderSQL matches entitlements held by the user in $1.
+var entitlementHolderSQL = entitlementHolder("$1")
+
+// activeEntitlementsSQL selects the active entitlements of the user in $1.
+var activeEntitlementsSQL = `
+	SELECT 1 FROM entitlements e
+	WHERE ` + entitlementHolderSQL + ` AND e.starts_at <= NOW() AND e.expires_at > NOW()`
+
+// bestEntitlementPlanSQL selects the highest ranked plan among the active
+// entitlements of the user in $1.
+var bestEntitlementPlanSQL = `
+	SELECT e.plan_id FROM entitlements e JOIN plans p ON p.id = e.plan_id
+	WHERE ` + entitlementHolderSQL + ` AND e.starts_at <= NOW() AND e.expires_at > NOW()
+	ORDER BY p.rank DESC, e.expires_at DESC
+	LIMIT 1`
+
+// activeEntitlement returns the entitlement that decides the user's plan, or
+// nil when the user has none.
+func activeEntitlement(q queryer, userID string) (*Entitlement, error) {
+	var entitlement Entitlement
+	var workspaceID sql.NullInt64
+	err := q.QueryRow(`
+		SELECT e.source, e.source_id, e.plan_id, e.status, e.expires_at, e.workspace_id
+		FROM entitlements e JOIN plans p ON p.id = e.plan_id
+		WHERE `+entitlementHolderSQL+` AND e.starts_at <= NOW() AND e.expires_at > NOW()
+		ORDER BY p.rank DESC, e.expires_at DESC
+		LIMIT 1
+	`, userID).Scan(&entitlement.Source, &entitlement.SourceID, &entitlement.PlanID,
+		&entitlement.Status, &entitlement.ExpiresAt, &workspaceID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if workspaceID.Valid {
+		entitlement.WorkspaceID = &workspaceID.Int64
+	}
+	return &entitlement, nil
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
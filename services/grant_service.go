@@ -0,0 +1,285 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// Kinds of entitlement grants. Grants are time-boxed and stack with paid
+// subscriptions; the best active entitlement decides the user's plan.
+const (
+	GrantKindTrial = "trial"
+	GrantKindPromo = "promo"
+	GrantKindComp  = "comp"
+)
+
+// EntitlementRevoked is the status of an entitlement whose grant was revoked.
+const EntitlementRevoked = "revoked"
+
+var (
+	// ErrInvalidGrant is returned for grants with an unknown kind or plan, or
+	// that end before they start.
+	ErrInvalidGrant = errors.New("invalid grant")
+	// ErrTrialUsed is returned when a user who already had a trial is given another.
+	ErrTrialUsed = errors.New("trial already used")
+	// ErrGrantNotFound is returned when revoking a grant that doesn't exist
+	// or was already revoked.
+	ErrGrantNotFound = errors.New("grant not found")
+)
+
+// Grant gives a user a plan for a fixed period, independently of billing.
+type Grant struct {
+	ID        int64      `json:"id"`
+	UserID    string     `json:"user_id"`
+	Kind      string     `json:"kind"`
+	PlanID    string     `json:"plan_id"`
+	StartsAt  time.Time  `json:"starts_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	Reason    string     `json:"reason,omitempty"`
+	GrantedBy string     `json:"granted_by,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+type GrantService struct {
+	DB *sql.DB
+}
+
+func NewGrantService(db *sql.DB) *GrantService {
+	return &GrantService{DB: db}
+}
+
+func isGrantKind(kind string) bool {
+	switch kind {
+	case GrantKindTrial, GrantKindPromo, GrantKindComp:
+		return true
+	}
+	return false
+}
+
+const grantColumns = `id, user_id, kind, plan_id, starts_at, expires_at, reason, granted_by, created_at, revoked_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanGrant(row rowScanner) (*Grant, error) {
+	var grant Grant
+	var revokedAt sql.NullTime
+	err := row.Scan(&grant.ID, &grant.UserID, &grant.Kind, &grant.PlanID, &grant.StartsAt,
+		&grant.ExpiresAt, &grant.Reason, &grant.GrantedBy, &grant.CreatedAt, &revokedAt)
+	if err != nil {
+		return nil, err
+	}
+	grant.RevokedAt = nullTimePtr(revokedAt)
+	return &grant, nil
+}
+
+// CreateGrant gives the user the grant's plan from StartsAt (now when zero)
+// until ExpiresAt. The grant is written to the audit log with the change.
+func (gs *GrantService) CreateGrant(actor AuditActor, grant Grant) (*Grant, error) {
+	if grant.StartsAt.IsZero() {
+		grant.StartsAt = time.Now()
+	}
+	if !isGrantKind(grant.Kind) || !grant.ExpiresAt.After(grant.StartsAt) {
+		return nil, ErrInvalidGrant
+	}
+
+	tx, err := gs.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := setAuditContext(tx, actor, "grant.create"); err != nil {
+		return nil, err
+	}
+
+	if _, err := getPlan(tx, grant.PlanID); err == sql.ErrNoRows {
+		return nil, ErrInvalidGrant
+	} else if err != nil {
+		return nil, err
+	}
+
+	var exists bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE id::text = $1)`, grant.UserID).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrUserNotFound
+	}
+
+	created, err := insertGrant(tx, grant)
+	if err != nil {
+		return nil, err
+	}
+	if created == nil {
+		return nil, ErrTrialUsed
+	}
+	if err := recordAudit(tx, actor, "grant.create", "user", created.UserID, nil, created); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// insertGrant stores a grant and the entitlement it backs. It returns nil
+// when the user already had a trial.
+func insertGrant(tx *sql.Tx, grant Grant) (*Grant, error) {
+	created, err := scanGrant(tx.QueryRow(`
+		INSERT INTO entitlement_grants (user_id, kind, plan_id, starts_at, expires_at, reason, granted_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (user_id) WHERE kind = 'trial' DO NOTHING
+		RETURNING `+grantColumns,
+		grant.UserID, grant.Kind, grant.PlanID, grant.StartsAt, grant.ExpiresAt, grant.Reason, grant.GrantedBy))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO entitlements (user_id, source, source_id, plan_id, status, starts_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, created.UserID, created.Kind, strconv.FormatInt(created.ID, 10), created.PlanID,
+		SubscriptionActive, created.StartsAt, created.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syncUserEntitlements(tx, created.UserID); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// RevokeGrant ends a grant and the access it gave right away.
+func (gs *GrantService) RevokeGrant(actor AuditActor, id int64) (*Grant, error) {
+	tx, err := gs.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := setAuditContext(tx, actor, "grant.revoke"); err != nil {
+		return nil, err
+	}
+
+	grant, err := scanGrant(tx.QueryRow(`
+		UPDATE entitlement_grants
+		SET revoked_at = NOW()
+		WHERE id = $1 AND revoked_at IS NULL
+		RETURNING `+grantColumns, id))
+	if err == sql.ErrNoRows {
+		return nil, ErrGrantNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE entitlements
+		SET status = $3, expires_at = LEAST(expires_at, NOW()), updated_at = NOW()
+		WHERE source = $1 AND source_id = $2
+	`, grant.Kind, strconv.FormatInt(grant.ID, 10), EntitlementRevoked)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syncUserEntitlements(tx, grant.UserID); err != nil {
+		return nil, err
+	}
+	if err := recordAudit(tx, actor, "grant.revoke", "user", grant.UserID, nil, grant); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return grant, nil
+}
+
+// ListGrants returns the user's grants, newest first.
+func (gs *GrantService) ListGrants(userID string) ([]Grant, error) {
+	rows, err := gs.DB.Query(`
+		SELECT `+grantColumns+`
+		FROM entitlement_grants
+		WHERE user_id = $1
+		ORDER BY created_at DESC, id DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	grants := []Grant{}
+	for rows.Next() {
+		grant, err := scanGrant(rows)
+		if err != nil {
+			return nil, err
+		}
+		grants = append(grants, *grant)
+	}
+	return grants, rows.Err()
+}
+
+// GetActiveGrant returns the user's best grant that is in effect, or nil.
+// A paid subscription may still outrank it.
+func (gs *GrantService) GetActiveGrant(userID string) (*Grant, error) {
+	grant, err := scanGrant(gs.DB.QueryRow(`
+		SELECT g.id, g.user_id, g.kind, g.plan_id, g.starts_at, g.expires_at, g.reason,
+			g.granted_by, g.created_at, g.revoked_at
+		FROM entitlement_grants g
+		JOIN entitlements e ON e.source = g.kind AND e.source_id = g.id::text
+		JOIN plans p ON p.id = e.plan_id
+		WHERE e.user_id = $1 AND e.starts_at <= NOW() AND e.expires_at > NOW()
+		ORDER BY p.rank DESC, e.expires_at DESC
+		LIMIT 1
+	`, userID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return grant, err
+}
+
+// startSignupTrial gives a new user a trial of the best plan that offers
+// one. Users who already had a trial or a subscription don't get one; it
+// returns nil for them and when no plan has a trial.
+func startSignupTrial(tx *sql.Tx, userID string) (*Grant, error) {
+	var planID string
+	var trialDays int
+	err := tx.QueryRow(`
+		SELECT id, trial_days
+		FROM plans
+		WHERE trial_days > 0
+			AND EXISTS (SELECT 1 FROM users WHERE id = $1)
+			AND NOT EXISTS (
+				SELECT 1 FROM entitlements
+				WHERE user_id = $1 AND source IN ($2, $3)
+			)
+		ORDER BY rank DESC
+		LIMIT 1
+	`, userID, EntitlementSourceSubscription, GrantKindTrial).Scan(&planID, &trialDays)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	return insertGrant(tx, Grant{
+		UserID:    userID,
+		Kind:      GrantKindTrial,
+		PlanID:    planID,
+		StartsAt:  now,
+		ExpiresAt: now.AddDate(0, 0, trialDays),
+		Reason:    "signup",
+	})
+}
@@ -0,0 +1,243 @@
+package services
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+)
+
+// Payment kinds recorded in the payments table
+const (
+	PaymentKindInvoice = "subscription_invoice"
+	PaymentKindOrder   = "order"
+)
+
+// CreditReasonRefund reverses the credits granted by a refunded order.
+const CreditReasonRefund = "refund"
+
+// LemonSqueezyInvoice is the data object of subscription_payment_* webhooks
+type LemonSqueezyInvoice struct {
+	ID         string            `json:"id"`
+	Type       string            `json:"type"`
+	Attributes InvoiceAttributes `json:"attributes"`
+}
+
+type InvoiceAttributes struct {
+	StoreID        int         `json:"store_id"`
+	SubscriptionID int         `json:"subscription_id"`
+	CustomerID     int         `json:"customer_id"`
+	UserName       string      `json:"user_name"`
+	UserEmail      string      `json:"user_email"`
+	BillingReason  string      `json:"billing_reason"`
+	CardBrand      string      `json:"card_brand"`
+	CardLastFour   string      `json:"card_last_four"`
+	Currency       string      `json:"currency"`
+	Status         string      `json:"status"`
+	Refunded       bool        `json:"refunded"`
+	RefundedAt     *time.Time  `json:"refunded_at"`
+	Subtotal       int         `json:"subtotal"`
+	DiscountTotal  int         `json:"discount_total"`
+	Tax            int         `json:"tax"`
+	Total          int         `json:"total"`
+	URLs           InvoiceURLs `json:"urls"`
+	CreatedAt      time.Time   `json:"created_at"`
+	UpdatedAt      time.Time   `json:"updated_at"`
+	TestMode       bool        `json:"test_mode"`
+}
+
+type InvoiceURLs struct {
+	InvoiceURL string `json:"invoice_url"`
+}
+
+// Payment is a row of a user's billing history. Amounts are in cents.
+type Payment struct {
+	ID             int64      `json:"id"`
+	Kind           string     `json:"kind"`
+	ExternalID     string     `json:"external_id"`
+	SubscriptionID string     `json:"subscription_id,omitempty"`
+	Status         string     `json:"status"`
+	BillingReason  string     `json:"billing_reason,omitempty"`
+	Currency       string     `json:"currency"`
+	Total          int        `json:"total"`
+	InvoiceURL     string     `json:"invoice_url,omitempty"`
+	RefundedAt     *time.Time `json:"refunded_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+func (ls *LemonSqueezyService) HandleSubscriptionPaymentSuccess(tx *sql.Tx, invoice LemonSqueezyInvoice) error {
+	return recordInvoice(tx, invoice)
+}
+
+// HandleSubscriptionPaymentFailed records the failed invoice and marks an
+// active or trialing subscription past due until the payment is recovered.
+// The first failure starts the grace period and the dunning emails. The
+// invoice's updated_at orders it against subscription events, so it doesn't
+// undo a later one, such as a cancellation.
+func (ls *LemonSqueezyService) HandleSubscriptionPaymentFailed(tx *sql.Tx, invoice LemonSqueezyInvoice) error {
+	if err := recordInvoice(tx, invoice); err != nil {
+		return err
+	}
+
+	subscriptionID := strconv.Itoa(invoice.Attributes.SubscriptionID)
+	event, err := ls.Subscriptions.Current(tx, BillingProviderLemonSqueezy, subscriptionID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if event.Status != SubscriptionActive && event.Status != SubscriptionOnTrial {
+		return nil
+	}
+
+	stale, err := ls.Subscriptions.IsStale(tx, BillingProviderLemonSqueezy, subscriptionID, invoice.Attributes.UpdatedAt)
+	if err != nil || stale {
+		return err
+	}
+
+	event.Status = SubscriptionPastDue
+	event.UpdatedAt = invoice.Attributes.UpdatedAt
+	_, err = ls.Subscriptions.Apply(tx, event)
+	return err
+}
+
+func (ls *LemonSqueezyService) HandleSubscriptionPaymentRecovered(tx *sql.Tx, invoice LemonSqueezyInvoice) error {
+	if err := recordInvoice(tx, invoice); err != nil {
+		return err
+	}
+
+	subscriptionID := strconv.Itoa(invoice.Attributes.SubscriptionID)
+	_, err := tx.Exec(`
+		UPDATE subscriptions
+		SET status = $2, payment_failed_at = NULL, dunning_step = 0, updated_at = NOW()
+		WHERE lemonsqueezy_subscription_id = $1 AND status IN ($3, $4)
+	`, subscriptionID, SubscriptionActive, SubscriptionPastDue, SubscriptionUnpaid)
+	if err != nil {
+		return err
+	}
+
+	return refreshSubscriptionEntitlement(tx, BillingProviderLemonSqueezy, subscriptionID)
+}
+
+// HandleOrderRefunded records the refund and revokes what the order granted:
+// credits from a credit pack, or Pro from the subscription it started.
+// Partial refunds are recorded but leave entitlements alone.
+func (ls *LemonSqueezyService) HandleOrderRefunded(tx *sql.Tx, order LemonSqueezyOrder, customUserID string) error {
+	userID, err := resolveCheckoutUser(tx, customUserID, order.Attributes.UserEmail)
+	if err != nil {
+		return err
+	}
+
+	if err := recordOrder(tx, order, userID); err != nil {
+		return err
+	}
+
+	if order.Attributes.Status != "refunded" {
+		return nil
+	}
+
+	// Reverse exactly what was granted for this order, once
+	_, err = tx.Exec(`
+		INSERT INTO credit_ledger (user_id, amount, reason, reference)
+		SELECT user_id, -amount, $2, reference
+		FROM credit_ledger
+		WHERE reason = $3 AND reference = $1
+		ON CONFLICT DO NOTHING
+	`, "lemonsqueezy_order:"+order.ID, CreditReasonRefund, CreditReasonPurchase)
+	if err != nil {
+		return err
+	}
+
+	var subscriptionID string
+	err = tx.QueryRow(`
+		UPDATE subscriptions
+		SET status = $2, updated_at = NOW()
+		WHERE lemonsqueezy_order_id = $1
+		RETURNING lemonsqueezy_subscription_id
+	`, order.ID, SubscriptionRefunded).Scan(&subscriptionID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return refreshSubscriptionEntitlement(tx, BillingProviderLemonSqueezy, subscriptionID)
+}
+
+func recordInvoice(tx *sql.Tx, invoice LemonSqueezyInvoice) error {
+	subscriptionID := strconv.Itoa(invoice.Attributes.SubscriptionID)
+	_, err := tx.Exec(`
+		INSERT INTO payments (
+			user_id, kind, external_id, subscription_id, status, billing_reason,
+			currency, total, invoice_url, refunded_at, created_at
+		)
+		VALUES (
+			(SELECT user_id FROM subscriptions WHERE lemonsqueezy_subscription_id = $3),
+			$1, $2, $3, $4, $5, $6, $7, $8, $9, $10
+		)
+		ON CONFLICT (kind, external_id)
+		DO UPDATE SET
+			status = $4,
+			total = $7,
+			invoice_url = $8,
+			refunded_at = $9,
+			updated_at = NOW()
+	`, PaymentKindInvoice, invoice.ID, subscriptionID, invoice.Attributes.Status,
+		invoice.Attributes.BillingReason, invoice.Attributes.Currency, invoice.Attributes.Total,
+		invoice.Attributes.URLs.InvoiceURL, invoice.Attributes.RefundedAt, invoice.Attributes.CreatedAt)
+	return err
+}
+
+func recordOrder(tx *sql.Tx, order LemonSqueezyOrder, userID string) error {
+	_, err := tx.Exec(`
+		INSERT INTO payments (
+			user_id, kind, external_id, status, currency, total, refunded_at, created_at
+		)
+		VALUES (NULLIF($1, '')::uuid, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (kind, external_id)
+		DO UPDATE SET
+			user_id = COALESCE(payments.user_id, EXCLUDED.user_id),
+			status = $4,
+			total = $6,
+			refunded_at = $7,
+			updated_at = NOW()
+	`, userID, PaymentKindOrder, order.ID, order.Attributes.Status, order.Attributes.Currency,
+		order.Attributes.Total, order.Attributes.RefundedAt, order.Attributes.CreatedAt)
+	return err
+}
+
+// GetBillingHistory returns the user's invoices and orders, newest first.
+func (ls *LemonSqueezyService) GetBillingHistory(userID string, limit int) ([]Payment, error) {
+	rows, err := ls.DB.Query(`
+		SELECT id, kind, external_id, COALESCE(subscription_id, ''), status,
+			COALESCE(billing_reason, ''), currency, total, COALESCE(invoice_url, ''),
+			refunded_at, created_at
+		FROM payments
+		WHERE user_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2
+	`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var payments []Payment
+	for rows.Next() {
+		var payment Payment
+		var refundedAt sql.NullTime
+		err := rows.Scan(&payment.ID, &payment.Kind, &payment.ExternalID, &payment.SubscriptionID,
+			&payment.Status, &payment.BillingReason, &payment.Currency, &payment.Total,
+			&payment.InvoiceURL, &refundedAt, &payment.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if refundedAt.Valid {
+			payment.RefundedAt = &refundedAt.Time
+		}
+		payments = append(payments, payment)
+	}
+
+	return payments, rows.Err()
+}
@@ -0,0 +1,85 @@
+package services
+
+import (
+	"database/sql"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// failPayment stores a LemonSqueezy subscription with the status, last
+// updated at updatedAt, then fails a payment for it, returning its new status.
+func failPayment(t *testing.T, db *sql.DB, status string, updatedAt, invoiceUpdatedAt time.Time) string {
+	t.Helper()
+	userID := createTestUser(t, db)
+	subscriptionID := int(time.Now().UnixNano() % 1_000_000_000)
+
+	_, err := db.Exec(`
+		INSERT INTO subscriptions (
+			user_id, lemonsqueezy_subscription_id, status, plan_id,
+			current_period_start, current_period_end, lemonsqueezy_updated_at
+		)
+		VALUES ($1, $2, $3, 'pro', NOW() - INTERVAL '1 day', NOW() + INTERVAL '29 days', $4)
+	`, userID, strconv.Itoa(subscriptionID), status, updatedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ls := &LemonSqueezyService{DB: db, Subscriptions: NewSubscriptionStore(db)}
+	invoice := LemonSqueezyInvoice{ID: "inv-" + newTestUUID(t), Type: "subscription-invoices"}
+	invoice.Attributes.SubscriptionID = subscriptionID
+	invoice.Attributes.UserEmail = "failed@example.com"
+	invoice.Attributes.Status = "failed"
+	invoice.Attributes.Currency = "USD"
+	invoice.Attributes.CreatedAt = invoiceUpdatedAt
+	invoice.Attributes.UpdatedAt = invoiceUpdatedAt
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := setAuditContext(tx, AuditActor{Type: AuditActorSystem}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ls.HandleSubscriptionPaymentFailed(tx, invoice); err != nil {
+		t.Fatalf("HandleSubscriptionPaymentFailed() error = %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	var newStatus string
+	err = db.QueryRow(`
+		SELECT status FROM subscriptions WHERE lemonsqueezy_subscription_id = $1
+	`, strconv.Itoa(subscriptionID)).Scan(&newStatus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newStatus
+}
+
+func TestHandleSubscriptionPaymentFailed(t *testing.T) {
+	db := openTestDB(t)
+	now := time.Now().UTC().Truncate(time.Second)
+
+	tests := []struct {
+		name             string
+		status           string
+		invoiceUpdatedAt time.Time
+		want             string
+	}{
+		{"active", SubscriptionActive, now, SubscriptionPastDue},
+		{"on trial", SubscriptionOnTrial, now, SubscriptionPastDue},
+		{"cancelled", SubscriptionCancelled, now, SubscriptionCancelled},
+		{"expired", SubscriptionExpired, now, SubscriptionExpired},
+		{"older than the stored state", SubscriptionActive, now.Add(-time.Hour), SubscriptionActive},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := failPayment(t, db, tt.status, now.Add(-time.Minute), tt.invoiceUpdatedAt); got != tt.want {
+				t.Errorf("status after a failed payment = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// ErrNoSubscription is returned when the user has no subscription with the
+// billing provider.
+var ErrNoSubscription = errors.New("no subscription")
+
+// PauseModeVoid is the LemonSqueezy pause mode that stops access while
+// paused. Its "free" mode, which keeps access without charging, isn't offered:
+// paused subscriptions grant no entitlement.
+const PauseModeVoid = "void"
+
+// SubscriptionSummary is the customer-facing view of a subscription.
+type SubscriptionSummary struct {
+	ID           string     `json:"id"`
+	PlanID       string     `json:"plan_id"`
+	VariantID    int        `json:"variant_id"`
+	Status       string     `json:"status"`
+	RenewsAt     *time.Time `json:"renews_at"`
+	EndsAt       *time.Time `json:"ends_at"`
+	TrialEndsAt  *time.Time `json:"trial_ends_at"`
+	CardBrand    string     `json:"card_brand"`
+	CardLastFour string     `json:"card_last_four"`
+}
+
+// PortalURLs are signed billing provider links that expire, so they're
+// fetched fresh on each request.
+type PortalURLs struct {
+	UpdatePaymentMethod string `json:"update_payment_method_url"`
+	CustomerPortal      string `json:"customer_portal_url"`
+}
+
+type lemonSqueezySubscriptionDocument struct {
+	Data LemonSqueezySubscription `json:"data"`
+}
+
+type subscriptionPatchDocument struct {
+	Data subscriptionPatch `json:"data"`
+}
+
+type subscriptionPatch struct {
+	Type       string                 `json:"type"`
+	ID         string                 `json:"id"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+// GetUserSubscription returns the user's most recent subscription.
+func (ls *LemonSqueezyService) GetUserSubscription(userID string) (*SubscriptionSummary, error) {
+	var summary SubscriptionSummary
+	var variantID sql.NullInt64
+	var renewsAt, endsAt, trialEndsAt sql.NullTime
+	err := ls.DB.QueryRow(`
+		SELECT s.lemonsqueezy_subscription_id, s.status, s.lemonsqueezy_variant_id,
+			COALESCE(pv.plan_id, 'pro'), s.current_period_end, s.ends_at, s.trial_ends_at,
+			COALESCE(s.card_brand, ''), COALESCE(s.card_last_four, '')
+		FROM subscriptions s
+		LEFT JOIN plan_variants pv ON pv.lemonsqueezy_variant_id = s.lemonsqueezy_variant_id
+		WHERE s.user_id = $1 AND s.lemonsqueezy_subscription_id IS NOT NULL
+		ORDER BY s.created_at DESC
+		LIMIT 1
+	`, userID).Scan(&summary.ID, &summary.Status, &variantID, &summary.PlanID,
+		&renewsAt, &endsAt, &trialEndsAt, &summary.CardBrand, &summary.CardLastFour)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoSubscription
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	summary.VariantID = int(variantID.Int64)
+	summary.RenewsAt = nullTimePtr(renewsAt)
+	summary.EndsAt = nullTimePtr(endsAt)
+	summary.TrialEndsAt = nullTimePtr(trialEndsAt)
+	return &summary, nil
+}
+
+func (ls *LemonSqueezyService) GetPortalURLs(userID string) (*PortalURLs, error) {
+	current, err := ls.GetUserSubscription(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc lemonSqueezySubscriptionDocument
+	if err := ls.apiRequest("GET", "/subscriptions/"+current.ID, nil, &doc); err != nil {
+		return nil, err
+	}
+
+	return &PortalURLs{
+		UpdatePaymentMethod: doc.Data.Attributes.URLs.UpdatePaymentMethod,
+		CustomerPortal:      doc.Data.Attributes.URLs.CustomerPortal,
+	}, nil
+}
+
+// CancelSubscription cancels at the end of the current period.
+func (ls *LemonSqueezyService) CancelSubscription(actor AuditActor, userID string) (*SubscriptionSummary, error) {
+	return ls.changeSubscription(actor, userID, "subscription.cancel", "DELETE", nil)
+}
+
+// ResumeSubscription undoes a cancellation during its grace period.
+func (ls *LemonSqueezyService) ResumeSubscription(actor AuditActor, userID string) (*SubscriptionSummary, error) {
+	return ls.changeSubscription(actor, userID, "subscription.resume", "PATCH", map[string]interface{}{"cancelled": false})
+}
+
+// PauseSubscription pauses payment collection and access, optionally until
+// resumesAt. The user is on the free plan while paused.
+func (ls *LemonSqueezyService) PauseSubscription(actor AuditActor, userID string, resumesAt *time.Time) (*SubscriptionSummary, error) {
+	pause := map[string]interface{}{"mode": PauseModeVoid}
+	if resumesAt != nil {
+		pause["resumes_at"] = resumesAt
+	}
+	return ls.changeSubscription(actor, userID, "subscription.pause", "PATCH", map[string]interface{}{"pause": pause})
+}
+
+func (ls *LemonSqueezyService) UnpauseSubscription(actor AuditActor, userID string) (*SubscriptionSummary, error) {
+	return ls.changeSubscription(actor, userID, "subscription.unpause", "PATCH", map[string]interface{}{"pause": nil})
+}
+
+// ChangeSubscriptionPlan moves the subscription to the variant configured for
+// a checkout plan. LemonSqueezy prorates the difference.
+func (ls *LemonSqueezyService) ChangeSubscriptionPlan(actor AuditActor, userID, checkoutPlan string) (*SubscriptionSummary, error) {
+	variantID, err := strconv.Atoi(ls.Variants[checkoutPlan])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCheckoutPlan, checkoutPlan)
+	}
+	return ls.changeSubscription(actor, userID, "subscription.change_plan", "PATCH", map[string]interface{}{"variant_id": variantID})
+}
+
+// changeSubscription sends a change for the user's subscription to
+// LemonSqueezy and applies the returned subscription locally right away. The
+// webhook that follows confirms it. The local change is logged under action.
+func (ls *LemonSqueezyService) changeSubscription(actor AuditActor, userID, action, method string, attributes map[string]interface{}) (*SubscriptionSummary, error) {
+	current, err := ls.GetUserSubscription(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var body interface{}
+	if attributes != nil {
+		body = subscriptionPatchDocument{Data: subscriptionPatch{
+			Type:       "subscriptions",
+			ID:         current.ID,
+			Attributes: attributes,
+		}}
+	}
+
+	var doc lemonSqueezySubscriptionDocument
+	if err := ls.apiRequest(method, "/subscriptions/"+current.ID, body, &doc); err != nil {
+		return nil, err
+	}
+
+	tx, err := ls.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := setAuditContext(tx, actor, action); err != nil {
+		return nil, err
+	}
+	if err := ls.HandleSubscriptionUpdated(tx, doc.Data); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return ls.GetUserSubscription(userID)
+}
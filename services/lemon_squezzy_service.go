@@ -4,9 +4,13 @@ import (
 	"bytes"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -14,6 +18,13 @@ type LemonSqueezyService struct {
 	DB            *sql.DB
 	WebhookSecret string
 	APIKey        string
+	BaseURL       string
+	StoreID       string
+	Variants      map[string]string // checkout plan -> variant ID
+	Subscriptions *SubscriptionStore
+	// AllowTestMode applies test mode webhooks and subscriptions, which are
+	// paid with test cards. Only set it outside production.
+	AllowTestMode bool
 }
 
 type LemonSqueezySubscription struct {
@@ -24,33 +35,43 @@ type LemonSqueezySubscription struct {
 }
 
 type SubscriptionAttributes struct {
-	StoreID              int           `json:"store_id"`
-	CustomerID           int           `json:"customer_id"`
-	OrderID              int           `json:"order_id"`
-	OrderItemID          int           `json:"order_item_id"`
-	ProductID            int           `json:"product_id"`
-	VariantID            int           `json:"variant_id"`
-	ProductName          string        `json:"product_name"`
-	VariantName          string        `json:"variant_name"`
-	UserName             string        `json:"user_name"`
-	UserEmail            string        `json:"user_email"`
-	Status               string        `json:"status"`
-	StatusFormatted      string        `json:"status_formatted"`
-	CardBrand            string        `json:"card_brand"`
-	CardLastFour         string        `json:"card_last_four"`
-	PausedAt             *time.Time    `json:"paused_at"`
-	SubscriptionItemID   int           `json:"subscription_item_id"`
-	URLs                 URLs          `json:"urls"`
-	RenewsAt             time.Time     `json:"renews_at"`
-	EndsAt               *time.Time    `json:"ends_at"`
-	TrialEndsAt          *time.Time    `json:"trial_ends_at"`
-	Price                string        `json:"price"`
-	IsUsageBased         bool          `json:"is_usage_based"`
-	IsPaused             bool          `json:"is_paused"`
-	SubscriptionInvoices []interface{} `json:"subscription_invoices"`
-	CreatedAt            time.Time     `json:"created_at"`
-	UpdatedAt            time.Time     `json:"updated_at"`
-	TestMode             bool          `json:"test_mode"`
+	StoreID               int               `json:"store_id"`
+	CustomerID            int               `json:"customer_id"`
+	OrderID               int               `json:"order_id"`
+	OrderItemID           int               `json:"order_item_id"`
+	ProductID             int               `json:"product_id"`
+	VariantID             int               `json:"variant_id"`
+	ProductName           string            `json:"product_name"`
+	VariantName           string            `json:"variant_name"`
+	UserName              string            `json:"user_name"`
+	UserEmail             string            `json:"user_email"`
+	Status                string            `json:"status"`
+	StatusFormatted       string            `json:"status_formatted"`
+	CardBrand             string            `json:"card_brand"`
+	CardLastFour          string            `json:"card_last_four"`
+	PausedAt              *time.Time        `json:"paused_at"`
+	SubscriptionItemID    int               `json:"subscription_item_id"`
+	FirstSubscriptionItem *SubscriptionItem `json:"first_subscription_item"`
+	URLs                  URLs              `json:"urls"`
+	RenewsAt              time.Time         `json:"renews_at"`
+	EndsAt                *time.Time        `json:"ends_at"`
+	TrialEndsAt           *time.Time        `json:"trial_ends_at"`
+	Price                 string            `json:"price"`
+	IsUsageBased          bool              `json:"is_usage_based"`
+	IsPaused              bool              `json:"is_paused"`
+	SubscriptionInvoices  []interface{}     `json:"subscription_invoices"`
+	CreatedAt             time.Time         `json:"created_at"`
+	UpdatedAt             time.Time         `json:"updated_at"`
+	TestMode              bool              `json:"test_mode"`
+}
+
+// SubscriptionItem is the priced line of a subscription.
+type SubscriptionItem struct {
+	ID             int  `json:"id"`
+	SubscriptionID int  `json:"subscription_id"`
+	PriceID        int  `json:"price_id"`
+	Quantity       int  `json:"quantity"`
+	IsUsageBased   bool `json:"is_usage_based"`
 }
 
 type SubscriptionRelations struct {
@@ -63,6 +84,127 @@ type SubscriptionRelations struct {
 	SubscriptionInvoices SubscriptionInvoices `json:"subscription-invoices"`
 }
 
+// LemonSqueezyOrder is the data object of order_* webhooks
+type LemonSqueezyOrder struct {
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	Attributes OrderAttributes `json:"attributes"`
+}
+
+type OrderAttributes struct {
+	StoreID        int            `json:"store_id"`
+	CustomerID     int            `json:"customer_id"`
+	Identifier     string         `json:"identifier"`
+	OrderNumber    int            `json:"order_number"`
+	UserName       string         `json:"user_name"`
+	UserEmail      string         `json:"user_email"`
+	Currency       string         `json:"currency"`
+	Subtotal       int            `json:"subtotal"`
+	Total          int            `json:"total"`
+	Status         string         `json:"status"`
+	Refunded       bool           `json:"refunded"`
+	RefundedAt     *time.Time     `json:"refunded_at"`
+	FirstOrderItem FirstOrderItem `json:"first_order_item"`
+	CreatedAt      time.Time      `json:"created_at"`
+	UpdatedAt      time.Time      `json:"updated_at"`
+	TestMode       bool           `json:"test_mode"`
+}
+
+type FirstOrderItem struct {
+	ID          int    `json:"id"`
+	OrderID     int    `json:"order_id"`
+	ProductID   int    `json:"product_id"`
+	VariantID   int    `json:"variant_id"`
+	ProductName string `json:"product_name"`
+	VariantName string `json:"variant_name"`
+	Price       int    `json:"price"`
+	Quantity    int    `json:"quantity"`
+}
+
+// Plans a subscription checkout can be created for
+const (
+	CheckoutPlanMonthly = "monthly"
+	CheckoutPlanYearly  = "yearly"
+	CheckoutPlanTeam    = "team"
+)
+
+// checkoutPlanPlans maps each checkout plan to the plan its variant grants.
+var checkoutPlanPlans = map[string]string{
+	CheckoutPlanMonthly: "pro",
+	CheckoutPlanYearly:  "pro",
+	CheckoutPlanTeam:    "team",
+}
+
+// ErrUnknownCheckoutPlan is returned for a checkout plan with no configured variant.
+var ErrUnknownCheckoutPlan = errors.New("unknown checkout plan")
+
+// CheckoutOptions customise a checkout. CustomPrice is in cents and replaces
+// the variant's price. WorkspaceID buys the subscription for a workspace,
+// with Seats as its quantity.
+type CheckoutOptions struct {
+	Plan         string
+	DiscountCode string
+	RedirectURL  string
+	CustomPrice  *int
+	TestMode     bool
+	WorkspaceID  int64
+	Seats        int
+}
+
+type LemonSqueezyCheckoutRequest struct {
+	Data CheckoutRequestData `json:"data"`
+}
+
+type CheckoutRequestData struct {
+	Type          string                    `json:"type"`
+	Attributes    CheckoutRequestAttributes `json:"attributes"`
+	Relationships CheckoutRelationships     `json:"relationships"`
+}
+
+type CheckoutRequestAttributes struct {
+	CustomPrice     *int                   `json:"custom_price,omitempty"`
+	ProductOptions  CheckoutProductOptions `json:"product_options"`
+	CheckoutOptions CheckoutDisplayOptions `json:"checkout_options"`
+	CheckoutData    CheckoutPrefill        `json:"checkout_data"`
+	TestMode        bool                   `json:"test_mode,omitempty"`
+}
+
+type CheckoutProductOptions struct {
+	RedirectURL string `json:"redirect_url,omitempty"`
+}
+
+type CheckoutDisplayOptions struct {
+	Embed bool `json:"embed"`
+	Media bool `json:"media"`
+	Logo  bool `json:"logo"`
+}
+
+type CheckoutPrefill struct {
+	Email             string            `json:"email"`
+	DiscountCode      string            `json:"discount_code,omitempty"`
+	Custom            map[string]string `json:"custom"`
+	VariantQuantities []VariantQuantity `json:"variant_quantities,omitempty"`
+}
+
+type VariantQuantity struct {
+	VariantID int `json:"variant_id"`
+	Quantity  int `json:"quantity"`
+}
+
+type CheckoutRelationships struct {
+	Store   Relationship `json:"store"`
+	Variant Relationship `json:"variant"`
+}
+
+type Relationship struct {
+	Data ResourceIdentifier `json:"data"`
+}
+
+type ResourceIdentifier struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
 type LemonSqueezyCheckoutResponse struct {
 	Data struct {
 		ID         string `json:"id"`
@@ -108,6 +250,7 @@ type Links struct {
 
 type URLs struct {
 	UpdatePaymentMethod string `json:"update_payment_method"`
+	CustomerPortal      string `json:"customer_portal"`
 }
 
 func NewLemonSqueezyService(apiKey string, webhookSecret string, db *sql.DB) *LemonSqueezyService {
@@ -115,202 +258,298 @@ func NewLemonSqueezyService(apiKey string, webhookSecret string, db *sql.DB) *Le
 		DB:            db,
 		WebhookSecret: webhookSecret,
 		APIKey:        apiKey,
+		BaseURL:       "https://api.lemonsqueezy.com/v1",
+		Variants:      map[string]string{},
+		Subscriptions: NewSubscriptionStore(db),
 	}
 }
 
-func (ls *LemonSqueezyService) HandleSubscriptionCreated(subscription LemonSqueezySubscription) error {
-	// Insert or update subscription
-	_, err := ls.DB.Exec(`
-		INSERT INTO subscriptions (
-			user_id, 
-			lemonsqueezy_subscription_id, 
-			lemonsqueezy_customer_id, 
-			status, 
-			current_period_start, 
-			current_period_end,
-			created_at,
-			updated_at
-		)
-		VALUES (
-			(SELECT id FROM users WHERE email = $1), 
-			$2, 
-			$3, 
-			$4, 
-			$5, 
-			$6,
-			NOW(),
-			NOW()
-		)
-		ON CONFLICT (lemonsqueezy_subscription_id)
-		DO UPDATE SET 
-			status = $4,
-			current_period_start = $5,
-			current_period_end = $6,
-			updated_at = NOW()
-	`,
-		subscription.Attributes.UserEmail,
-		subscription.ID,
-		subscription.Attributes.CustomerID,
-		subscription.Attributes.Status,
-		subscription.Attributes.CreatedAt,
-		subscription.Attributes.RenewsAt,
-	)
+func (ls *LemonSqueezyService) Name() string {
+	return BillingProviderLemonSqueezy
+}
+
+// SyncPlanVariants maps the configured checkout variants to the plans they
+// grant, so entitlements from their subscriptions get the right plan.
+func (ls *LemonSqueezyService) SyncPlanVariants() error {
+	for checkoutPlan, variantID := range ls.Variants {
+		planID, ok := checkoutPlanPlans[checkoutPlan]
+		if !ok || variantID == "" {
+			continue
+		}
+
+		_, err := ls.DB.Exec(`
+			INSERT INTO plan_variants (lemonsqueezy_variant_id, plan_id)
+			VALUES ($1::integer, $2)
+			ON CONFLICT (lemonsqueezy_variant_id) DO UPDATE SET plan_id = $2
+		`, variantID, planID)
+		if err != nil {
+			return fmt.Errorf("mapping variant %s to plan %s: %w", variantID, planID, err)
+		}
+	}
+	return nil
+}
 
+// lemonSqueezySubscriptionEvent normalizes a LemonSqueezy subscription.
+// customUserID and workspaceID come from checkout custom data.
+func lemonSqueezySubscriptionEvent(q queryer, subscription LemonSqueezySubscription, customUserID, workspaceID string) (SubscriptionEvent, error) {
+	var planID string
+	err := q.QueryRow(`
+		SELECT COALESCE(
+			(SELECT plan_id FROM plan_variants WHERE lemonsqueezy_variant_id = $1), 'pro'
+		)
+	`, subscription.Attributes.VariantID).Scan(&planID)
 	if err != nil {
-		return err
+		return SubscriptionEvent{}, err
 	}
 
-	// Update user pro status
-	isActive := subscription.Attributes.Status == "active"
-	_, err = ls.DB.Exec(`
-		UPDATE users 
-		SET is_pro = $1, updated_at = NOW()
-		WHERE email = $2
-	`, isActive, subscription.Attributes.UserEmail)
+	quantity := 0
+	if item := subscription.Attributes.FirstSubscriptionItem; item != nil {
+		quantity = item.Quantity
+	}
 
-	return err
+	return SubscriptionEvent{
+		Provider:       BillingProviderLemonSqueezy,
+		SubscriptionID: subscription.ID,
+		CustomerID:     strconv.Itoa(subscription.Attributes.CustomerID),
+		UserID:         customUserID,
+		WorkspaceID:    workspaceID,
+		Email:          subscription.Attributes.UserEmail,
+		PriceID:        strconv.Itoa(subscription.Attributes.VariantID),
+		PlanID:         planID,
+		Quantity:       quantity,
+		Status:         subscription.Attributes.Status,
+		PeriodStart:    subscription.Attributes.CreatedAt,
+		RenewsAt:       subscription.Attributes.RenewsAt,
+		EndsAt:         subscription.Attributes.EndsAt,
+		TrialEndsAt:    subscription.Attributes.TrialEndsAt,
+		CardBrand:      subscription.Attributes.CardBrand,
+		CardLastFour:   subscription.Attributes.CardLastFour,
+		UpdatedAt:      subscription.Attributes.UpdatedAt,
+	}, nil
 }
 
-func (ls *LemonSqueezyService) HandleSubscriptionUpdated(subscription LemonSqueezySubscription) error {
-	// Update subscription
-	_, err := ls.DB.Exec(`
-		UPDATE subscriptions 
-		SET 
-			status = $1,
-			current_period_start = $2,
-			current_period_end = $3,
-			updated_at = NOW()
-		WHERE lemonsqueezy_subscription_id = $4
-	`,
-		subscription.Attributes.Status,
-		subscription.Attributes.CreatedAt,
-		subscription.Attributes.RenewsAt,
-		subscription.ID,
-	)
+// HandleSubscriptionCreated links a new subscription to the user given in the
+// checkout custom data, falling back to the subscriber's email. Subscriptions
+// matching neither are quarantined for manual linking. workspaceID, also from
+// the custom data, makes it a workspace subscription.
+func (ls *LemonSqueezyService) HandleSubscriptionCreated(tx *sql.Tx, subscription LemonSqueezySubscription, customUserID, workspaceID string) error {
+	event, err := lemonSqueezySubscriptionEvent(tx, subscription, customUserID, workspaceID)
+	if err != nil {
+		return err
+	}
 
+	userID, err := ls.Subscriptions.Apply(tx, event)
 	if err != nil {
 		return err
 	}
+	if userID == "" {
+		return quarantineSubscription(tx, subscription, customUserID)
+	}
 
-	// Update user pro status
-	isActive := subscription.Attributes.Status == "active"
-	_, err = ls.DB.Exec(`
-		UPDATE users 
-		SET is_pro = $1, updated_at = NOW()
-		WHERE id = (
-			SELECT user_id FROM subscriptions 
-			WHERE lemonsqueezy_subscription_id = $2
-		)
-	`, isActive, subscription.ID)
+	// Refunds of the first order revoke the subscription
+	_, err = tx.Exec(`
+		UPDATE subscriptions SET lemonsqueezy_order_id = $2
+		WHERE lemonsqueezy_subscription_id = $1
+	`, subscription.ID, strconv.Itoa(subscription.Attributes.OrderID))
+	if err != nil {
+		return err
+	}
 
-	return err
+	return recordSubscriptionItem(tx, subscription)
 }
 
-func (ls *LemonSqueezyService) HandleSubscriptionCancelled(subscription LemonSqueezySubscription) error {
-	// Update subscription status
-	_, err := ls.DB.Exec(`
-		UPDATE subscriptions 
-		SET 
-			status = $1, 
-			updated_at = NOW()
-		WHERE lemonsqueezy_subscription_id = $2
-	`, subscription.Attributes.Status, subscription.ID)
-
+// HandleSubscriptionUpdated stores the subscription's latest state and lets
+// the entitlement state machine decide what access it grants. The other
+// lifecycle events carry the full subscription too and are applied the same way.
+func (ls *LemonSqueezyService) HandleSubscriptionUpdated(tx *sql.Tx, subscription LemonSqueezySubscription) error {
+	event, err := lemonSqueezySubscriptionEvent(tx, subscription, "", "")
 	if err != nil {
 		return err
 	}
 
-	// Update user pro status to false
-	_, err = ls.DB.Exec(`
-		UPDATE users 
-		SET is_pro = FALSE, updated_at = NOW()
-		WHERE id = (
-			SELECT user_id FROM subscriptions 
-			WHERE lemonsqueezy_subscription_id = $1
-		)
-	`, subscription.ID)
+	// Only subscription_created links a user; unknown subscriptions stay
+	// quarantined until an admin links them
+	event.Email = ""
+
+	userID, err := ls.Subscriptions.Apply(tx, event)
+	if err != nil {
+		return err
+	}
+	if userID != "" {
+		return recordSubscriptionItem(tx, subscription)
+	}
 
+	_, err = refreshQuarantinedSubscription(tx, subscription)
 	return err
 }
 
-func (ls *LemonSqueezyService) HandleSubscriptionResumed(subscription LemonSqueezySubscription) error {
-	return ls.HandleSubscriptionUpdated(subscription)
+// HandleSubscriptionCancelled keeps access until ends_at, when the paid
+// period runs out.
+func (ls *LemonSqueezyService) HandleSubscriptionCancelled(tx *sql.Tx, subscription LemonSqueezySubscription) error {
+	return ls.HandleSubscriptionUpdated(tx, subscription)
 }
 
-func (ls *LemonSqueezyService) HandleSubscriptionExpired(subscription LemonSqueezySubscription) error {
-	return ls.HandleSubscriptionCancelled(subscription)
+func (ls *LemonSqueezyService) HandleSubscriptionResumed(tx *sql.Tx, subscription LemonSqueezySubscription) error {
+	return ls.HandleSubscriptionUpdated(tx, subscription)
 }
 
-func (ls *LemonSqueezyService) HandleSubscriptionPaused(subscription LemonSqueezySubscription) error {
-	// Update subscription status
-	_, err := ls.DB.Exec(`
-		UPDATE subscriptions 
-		SET 
-			status = $1, 
-			updated_at = NOW()
-		WHERE lemonsqueezy_subscription_id = $2
-	`, subscription.Attributes.Status, subscription.ID)
+func (ls *LemonSqueezyService) HandleSubscriptionExpired(tx *sql.Tx, subscription LemonSqueezySubscription) error {
+	return ls.HandleSubscriptionUpdated(tx, subscription)
+}
+
+// HandleSubscriptionPaused revokes access while payment collection is paused.
+func (ls *LemonSqueezyService) HandleSubscriptionPaused(tx *sql.Tx, subscription LemonSqueezySubscription) error {
+	return ls.HandleSubscriptionUpdated(tx, subscription)
+}
 
+func (ls *LemonSqueezyService) HandleSubscriptionUnpaused(tx *sql.Tx, subscription LemonSqueezySubscription) error {
+	return ls.HandleSubscriptionUpdated(tx, subscription)
+}
+
+// HandleOrderCreated records the order and grants credits for paid credit
+// pack orders. Other orders (e.g. the first payment of a subscription) only
+// appear in billing history.
+// customUserID comes from the checkout custom data; the order email is the fallback.
+func (ls *LemonSqueezyService) HandleOrderCreated(tx *sql.Tx, order LemonSqueezyOrder, customUserID string) error {
+	userID, err := resolveCheckoutUser(tx, customUserID, order.Attributes.UserEmail)
 	if err != nil {
 		return err
 	}
 
-	// Keep pro status active for paused subscriptions
-	// You might want to change this behavior based on your needs
-	return nil
+	if err := recordOrder(tx, order, userID); err != nil {
+		return err
+	}
+
+	if order.Attributes.Status != "paid" {
+		return nil
+	}
+
+	pack, err := getCreditPack(tx, order.Attributes.FirstOrderItem.VariantID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if userID == "" {
+		return fmt.Errorf("no user for order %s", order.ID)
+	}
+
+	quantity := order.Attributes.FirstOrderItem.Quantity
+	if quantity < 1 {
+		quantity = 1
+	}
+
+	// The order reference makes webhook retries a no-op
+	_, err = addCredits(tx, userID, pack.Credits*quantity, CreditReasonPurchase, "lemonsqueezy_order:"+order.ID)
+	return err
+}
+
+// CreateCheckout creates a subscription checkout session with LemonSqueezy
+// for the plan chosen in opts (monthly when empty)
+func (ls *LemonSqueezyService) CreateCheckout(userID, email string, opts CheckoutOptions) (string, error) {
+	if opts.Plan == "" {
+		opts.Plan = CheckoutPlanMonthly
+	}
+
+	variantID, ok := ls.Variants[opts.Plan]
+	if !ok || variantID == "" {
+		return "", fmt.Errorf("%w: %s", ErrUnknownCheckoutPlan, opts.Plan)
+	}
+
+	return ls.createVariantCheckout(userID, email, variantID, opts)
 }
 
-func (ls *LemonSqueezyService) HandleSubscriptionUnpaused(subscription LemonSqueezySubscription) error {
-	return ls.HandleSubscriptionUpdated(subscription)
+// CreateCreditCheckoutSession creates a one-time checkout for a credit pack
+func (ls *LemonSqueezyService) CreateCreditCheckoutSession(userID, email string, pack *CreditPack) (string, error) {
+	return ls.createVariantCheckout(userID, email, strconv.Itoa(pack.VariantID), CheckoutOptions{})
 }
 
-// CreateCheckoutSession creates a checkout session with LemonSqueezy
-func (ls *LemonSqueezyService) CreateCheckoutSession(userID, email string) (string, error) {
+func (ls *LemonSqueezyService) createVariantCheckout(userID, email, variantID string, opts CheckoutOptions) (string, error) {
+	custom := map[string]string{"user_id": userID}
+	if opts.WorkspaceID != 0 {
+		custom["workspace_id"] = strconv.FormatInt(opts.WorkspaceID, 10)
+	}
+
+	var variantQuantities []VariantQuantity
+	if opts.Seats > 1 {
+		id, err := strconv.Atoi(variantID)
+		if err != nil {
+			return "", err
+		}
+		variantQuantities = []VariantQuantity{{VariantID: id, Quantity: opts.Seats}}
+	}
+
 	// LemonSqueezy checkout payload
-	checkoutData := map[string]interface{}{
-		"data": map[string]interface{}{
-			"type": "checkouts",
-			"attributes": map[string]interface{}{
-				"checkout_options": map[string]interface{}{
-					"embed": false,
-					"media": false,
-					"logo":  true,
-				},
-				"checkout_data": map[string]interface{}{
-					"email": email,
-					"custom": map[string]interface{}{
-						"user_id": userID,
-					},
+	checkoutData := LemonSqueezyCheckoutRequest{
+		Data: CheckoutRequestData{
+			Type: "checkouts",
+			Attributes: CheckoutRequestAttributes{
+				CustomPrice: opts.CustomPrice,
+				ProductOptions: CheckoutProductOptions{
+					RedirectURL: opts.RedirectURL,
 				},
-				"product_options": map[string]interface{}{},
-			},
-			"relationships": map[string]interface{}{
-				"store": map[string]interface{}{
-					"data": map[string]interface{}{
-						"type": "stores",
-						"id":   "186706", // ✅ your actual store ID
-					},
+				CheckoutOptions: CheckoutDisplayOptions{
+					Embed: false,
+					Media: false,
+					Logo:  true,
 				},
-				"variant": map[string]interface{}{
-					"data": map[string]interface{}{
-						"type": "variants",
-						"id":   "859702", // ✅ your actual variant ID
-					},
+				CheckoutData: CheckoutPrefill{
+					Email:             email,
+					DiscountCode:      opts.DiscountCode,
+					Custom:            custom,
+					VariantQuantities: variantQuantities,
 				},
+				TestMode: opts.TestMode,
+			},
+			Relationships: CheckoutRelationships{
+				Store:   Relationship{Data: ResourceIdentifier{Type: "stores", ID: ls.StoreID}},
+				Variant: Relationship{Data: ResourceIdentifier{Type: "variants", ID: variantID}},
 			},
 		},
 	}
 
-	// Convert to JSON
-	jsonData, err := json.Marshal(checkoutData)
-	if err != nil {
+	// Create the checkout
+	var checkoutResp LemonSqueezyCheckoutResponse
+	if err := ls.apiRequest("POST", "/checkouts", checkoutData, &checkoutResp); err != nil {
 		return "", err
 	}
 
-	// Create HTTP request
-	req, err := http.NewRequest("POST", "https://api.lemonsqueezy.com/v1/checkouts", bytes.NewBuffer(jsonData))
+	// Validate that we got a URL back
+	if checkoutResp.Data.Attributes.URL == "" {
+		return "", fmt.Errorf("no checkout URL returned from LemonSqueezy")
+	}
+
+	return checkoutResp.Data.Attributes.URL, nil
+}
+
+// apiRequest calls the LemonSqueezy API. path is relative to BaseURL unless
+// it's an absolute URL, as in pagination links, which must point at
+// BaseURL's scheme and host: they come from response bodies, and the request
+// carries the API key. body and out are JSON:API documents; either may be
+// nil.
+func (ls *LemonSqueezyService) apiRequest(method, path string, body, out interface{}) error {
+	target := ls.BaseURL + path
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		if err := ls.checkAPIURL(path); err != nil {
+			return err
+		}
+		target = path
+	}
+
+	var reqBody io.Reader
+	if body != nil {
+		jsonData, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewBuffer(jsonData)
+	}
+
+	req, err := http.NewRequest(method, target, reqBody)
 	if err != nil {
-		return "", err
+		return err
 	}
 
 	// Set headers
@@ -322,26 +561,35 @@ func (ls *LemonSqueezyService) CreateCheckoutSession(userID, email string) (stri
 	client := &http.Client{Timeout: 30 * time.Second}
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", err
+		return err
 	}
 	defer resp.Body.Close()
 
 	// IMPORTANT: Check for HTTP errors
-	if resp.StatusCode != http.StatusCreated {
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("LemonSqueezy API error: %d - %s", resp.StatusCode, string(body))
+		return fmt.Errorf("LemonSqueezy API error: %d - %s", resp.StatusCode, string(body))
 	}
 
-	// Parse response
-	var checkoutResp LemonSqueezyCheckoutResponse
-	if err := json.NewDecoder(resp.Body).Decode(&checkoutResp); err != nil {
-		return "", err
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
 	}
 
-	// Validate that we got a URL back
-	if checkoutResp.Data.Attributes.URL == "" {
-		return "", fmt.Errorf("no checkout URL returned from LemonSqueezy")
-	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
 
-	return checkoutResp.Data.Attributes.URL, nil
+// checkAPIURL rejects absolute URLs outside the API at BaseURL.
+func (ls *LemonSqueezyService) checkAPIURL(rawURL string) error {
+	base, err := url.Parse(ls.BaseURL)
+	if err != nil {
+		return err
+	}
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if target.Scheme != base.Scheme || !strings.EqualFold(target.Host, base.Host) || target.User != nil {
+		return fmt.Errorf("refusing LemonSqueezy API request to %s://%s", target.Scheme, target.Host)
+	}
+	return nil
 }
@@ -0,0 +1,314 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Webhook event processing states
+const (
+	WebhookStatusPending   = "pending"
+	WebhookStatusProcessed = "processed"
+	WebhookStatusSkipped   = "skipped" // older than the state already applied
+	WebhookStatusIgnored   = "ignored" // event type we don't handle
+	WebhookStatusFailed    = "failed"
+)
+
+// ErrInvalidWebhookPayload is returned for deliveries that aren't valid JSON.
+var ErrInvalidWebhookPayload = errors.New("invalid webhook payload")
+
+type LemonSqueezyMeta struct {
+	EventName  string                 `json:"event_name"`
+	TestMode   bool                   `json:"test_mode"`
+	CustomData map[string]interface{} `json:"custom_data"`
+}
+
+// UserID returns the user_id passed through checkout custom data, if any.
+func (m LemonSqueezyMeta) UserID() string {
+	userID, _ := m.CustomData["user_id"].(string)
+	return userID
+}
+
+// WorkspaceID returns the workspace_id passed through checkout custom data, if any.
+func (m LemonSqueezyMeta) WorkspaceID() string {
+	workspaceID, _ := m.CustomData["workspace_id"].(string)
+	return workspaceID
+}
+
+type LemonSqueezyWebhookPayload struct {
+	Meta LemonSqueezyMeta `json:"meta"`
+	Data json.RawMessage  `json:"data"`
+}
+
+// WebhookEvent is a verified webhook delivery stored in webhook_events.
+type WebhookEvent struct {
+	ID          int64           `json:"id"`
+	DeliveryKey string          `json:"delivery_key"`
+	EventName   string          `json:"event_name"`
+	ResourceID  string          `json:"resource_id"`
+	Payload     json.RawMessage `json:"payload"`
+	ReceivedAt  time.Time       `json:"received_at"`
+	Status      string          `json:"status"`
+	Error       string          `json:"error,omitempty"`
+	Attempts    int             `json:"attempts"`
+	ProcessedAt *time.Time      `json:"processed_at,omitempty"`
+	Duplicate   bool            `json:"-"`
+}
+
+// ParseWebhook checks the X-Signature header, an HMAC of the body with the
+// webhook secret, and decodes the delivery.
+func (ls *LemonSqueezyService) ParseWebhook(payload []byte, header http.Header) (*WebhookDelivery, error) {
+	mac := hmac.New(sha256.New, []byte(ls.WebhookSecret))
+	mac.Write(payload)
+	expectedMAC := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(header.Get("X-Signature")), []byte(expectedMAC)) {
+		return nil, ErrInvalidWebhookSignature
+	}
+
+	var webhook LemonSqueezyWebhookPayload
+	if err := json.Unmarshal(payload, &webhook); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidWebhookPayload, err)
+	}
+
+	var resource struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(webhook.Data, &resource)
+
+	// Subscription is left unset: ProcessWebhook decodes subscriptions
+	// itself, in the transaction that applies them
+	return &WebhookDelivery{
+		Provider:   BillingProviderLemonSqueezy,
+		EventName:  webhook.Meta.EventName,
+		ResourceID: resource.ID,
+		Payload:    payload,
+	}, nil
+}
+
+// HandleWebhook records and applies a delivery; see ProcessWebhook.
+func (ls *LemonSqueezyService) HandleWebhook(delivery *WebhookDelivery) (*WebhookEvent, error) {
+	return ls.ProcessWebhook(delivery.Payload, delivery.auditActor())
+}
+
+// ProcessWebhook records a verified delivery and applies it. Retries of a
+// delivery that was already applied are reported as duplicates and not
+// processed again; failed deliveries are retried. The changes are logged as
+// the actor's.
+func (ls *LemonSqueezyService) ProcessWebhook(payload []byte, actor AuditActor) (*WebhookEvent, error) {
+	var webhook LemonSqueezyWebhookPayload
+	if err := json.Unmarshal(payload, &webhook); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidWebhookPayload, err)
+	}
+
+	var resource struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(webhook.Data, &resource)
+
+	// LemonSqueezy retries send the same body, so its hash identifies the delivery
+	sum := sha256.Sum256(payload)
+
+	event := &WebhookEvent{
+		DeliveryKey: hex.EncodeToString(sum[:]),
+		EventName:   webhook.Meta.EventName,
+		ResourceID:  resource.ID,
+		Payload:     payload,
+	}
+
+	var inserted bool
+	err := ls.DB.QueryRow(`
+		INSERT INTO webhook_events (delivery_key, event_name, resource_id, payload)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (delivery_key) DO UPDATE SET delivery_key = EXCLUDED.delivery_key
+		RETURNING id, received_at, status, (xmax = 0)
+	`, event.DeliveryKey, event.EventName, event.ResourceID, string(payload)).Scan(
+		&event.ID, &event.ReceivedAt, &event.Status, &inserted)
+	if err != nil {
+		return nil, err
+	}
+
+	if !inserted && event.Status != WebhookStatusPending && event.Status != WebhookStatusFailed {
+		event.Duplicate = true
+		return event, nil
+	}
+
+	return event, ls.processWebhookEvent(event, actor)
+}
+
+// processWebhookEvent applies a stored event and its status update in one
+// transaction. On failure the changes are rolled back and the error recorded.
+func (ls *LemonSqueezyService) processWebhookEvent(event *WebhookEvent, actor AuditActor) error {
+	tx, err := ls.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := setAuditContext(tx, actor, BillingProviderLemonSqueezy+"."+event.EventName); err != nil {
+		return err
+	}
+
+	// Concurrent deliveries of the same event wait here and then see it done
+	err = tx.QueryRow(`
+		SELECT status FROM webhook_events WHERE id = $1 FOR UPDATE
+	`, event.ID).Scan(&event.Status)
+	if err != nil {
+		return err
+	}
+	if event.Status == WebhookStatusProcessed || event.Status == WebhookStatusSkipped || event.Status == WebhookStatusIgnored {
+		event.Duplicate = true
+		return nil
+	}
+
+	status, applyErr := ls.applyWebhook(tx, event.Payload, true)
+	if applyErr != nil {
+		tx.Rollback()
+		event.Status = WebhookStatusFailed
+		event.Error = applyErr.Error()
+		if err := ls.recordWebhookFailure(event.ID, applyErr); err != nil {
+			return fmt.Errorf("%v (recording failure: %v)", applyErr, err)
+		}
+		return applyErr
+	}
+
+	now := time.Now()
+	_, err = tx.Exec(`
+		UPDATE webhook_events
+		SET status = $1, error = NULL, processed_at = $2, attempts = attempts + 1
+		WHERE id = $3
+	`, status, now, event.ID)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	event.Status = status
+	event.Error = ""
+	event.ProcessedAt = &now
+	return nil
+}
+
+// recordWebhookFailure marks a stored event failed with the error that
+// stopped it from applying. It runs outside the rolled back transaction.
+func (ls *LemonSqueezyService) recordWebhookFailure(eventID int64, applyErr error) error {
+	_, err := ls.DB.Exec(`
+		UPDATE webhook_events SET status = $1, error = $2, attempts = attempts + 1 WHERE id = $3
+	`, WebhookStatusFailed, applyErr.Error(), eventID)
+	return err
+}
+
+// applyWebhook dispatches an event to its handler and returns the status to
+// record for it. Replays pass checkOrder=false to apply subscription events
+// even when a newer one has already been applied.
+func (ls *LemonSqueezyService) applyWebhook(tx *sql.Tx, payload []byte, checkOrder bool) (string, error) {
+	var webhook LemonSqueezyWebhookPayload
+	if err := json.Unmarshal(payload, &webhook); err != nil {
+		return "", err
+	}
+
+	// Test mode purchases are made with test cards
+	if webhook.Meta.TestMode && !ls.AllowTestMode {
+		return WebhookStatusIgnored, nil
+	}
+
+	switch eventName := webhook.Meta.EventName; {
+	case isSubscriptionEvent(eventName):
+		var subscription LemonSqueezySubscription
+		if err := json.Unmarshal(webhook.Data, &subscription); err != nil {
+			return "", err
+		}
+
+		if checkOrder {
+			stale, err := ls.Subscriptions.IsStale(tx, BillingProviderLemonSqueezy,
+				subscription.ID, subscription.Attributes.UpdatedAt)
+			if err != nil {
+				return "", err
+			}
+			if stale {
+				return WebhookStatusSkipped, nil
+			}
+		}
+
+		return WebhookStatusProcessed, ls.applySubscriptionEvent(tx, eventName, subscription, webhook.Meta)
+
+	case isPaymentEvent(eventName):
+		var invoice LemonSqueezyInvoice
+		if err := json.Unmarshal(webhook.Data, &invoice); err != nil {
+			return "", err
+		}
+		return WebhookStatusProcessed, ls.applyPaymentEvent(tx, eventName, invoice)
+
+	case eventName == "order_created" || eventName == "order_refunded":
+		var order LemonSqueezyOrder
+		if err := json.Unmarshal(webhook.Data, &order); err != nil {
+			return "", err
+		}
+		if eventName == "order_refunded" {
+			return WebhookStatusProcessed, ls.HandleOrderRefunded(tx, order, webhook.Meta.UserID())
+		}
+		return WebhookStatusProcessed, ls.HandleOrderCreated(tx, order, webhook.Meta.UserID())
+
+	default:
+		return WebhookStatusIgnored, nil
+	}
+}
+
+func isSubscriptionEvent(eventName string) bool {
+	switch eventName {
+	case "subscription_created", "subscription_updated", "subscription_cancelled",
+		"subscription_resumed", "subscription_expired", "subscription_paused",
+		"subscription_unpaused":
+		return true
+	}
+	return false
+}
+
+func isPaymentEvent(eventName string) bool {
+	switch eventName {
+	case "subscription_payment_success", "subscription_payment_failed", "subscription_payment_recovered":
+		return true
+	}
+	return false
+}
+
+func (ls *LemonSqueezyService) applyPaymentEvent(tx *sql.Tx, eventName string, invoice LemonSqueezyInvoice) error {
+	switch eventName {
+	case "subscription_payment_success":
+		return ls.HandleSubscriptionPaymentSuccess(tx, invoice)
+	case "subscription_payment_failed":
+		return ls.HandleSubscriptionPaymentFailed(tx, invoice)
+	case "subscription_payment_recovered":
+		return ls.HandleSubscriptionPaymentRecovered(tx, invoice)
+	}
+	return fmt.Errorf("unhandled payment event %s", eventName)
+}
+
+func (ls *LemonSqueezyService) applySubscriptionEvent(tx *sql.Tx, eventName string, subscription LemonSqueezySubscription, meta LemonSqueezyMeta) error {
+	switch eventName {
+	case "subscription_created":
+		return ls.HandleSubscriptionCreated(tx, subscription, meta.UserID(), meta.WorkspaceID())
+	case "subscription_updated":
+		return ls.HandleSubscriptionUpdated(tx, subscription)
+	case "subscription_cancelled":
+		return ls.HandleSubscriptionCancelled(tx, subscription)
+	case "subscription_resumed":
+		return ls.HandleSubscriptionResumed(tx, subscription)
+	case "subscription_expired":
+		return ls.HandleSubscriptionExpired(tx, subscription)
+	case "subscription_paused":
+		return ls.HandleSubscriptionPaused(tx, subscription)
+	case "subscription_unpaused":
+		return ls.HandleSubscriptionUnpaused(tx, subscription)
+	}
+	return fmt.Errorf("unhandled subscription event %s", eventName)
+}
@@ -0,0 +1,60 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strings"
+)
+
+// MailMessage is a plain text transactional email.
+type MailMessage struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends transactional email.
+type Mailer interface {
+	Send(message MailMessage) error
+}
+
+// LogMailer logs messages instead of sending them. It is used when no mail
+// server is configured.
+type LogMailer struct{}
+
+func (LogMailer) Send(message MailMessage) error {
+	log.Printf("Mail to %s: %s", message.To, message.Subject)
+	return nil
+}
+
+// SMTPMailer sends messages through an SMTP server, authenticating with
+// PLAIN auth when a username is set.
+type SMTPMailer struct {
+	Addr     string // host:port
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(message MailMessage) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, err := net.SplitHostPort(m.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "From: %s\r\n", m.From)
+	fmt.Fprintf(&body, "To: %s\r\n", message.To)
+	fmt.Fprintf(&body, "Subject: %s\r\n", message.Subject)
+	body.WriteString("MIME-Version: 1.0\r\n")
+	body.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	body.WriteString(strings.ReplaceAll(message.Body, "\n", "\r\n"))
+
+	return smtp.SendMail(m.Addr, auth, m.From, []string{message.To}, []byte(body.String()))
+}
@@ -0,0 +1,130 @@
+package services
+
+import (
+	"database/sql"
+	"time"
+)
+
+const (
+	PeriodDaily   = "daily"
+	PeriodMonthly = "monthly"
+)
+
+// Window policies decide where a quota period starts. Calendar windows reset
+// at midnight (or the 1st of the month) in the user's timezone; rolling
+// windows count the trailing period length from now.
+const (
+	WindowCalendar = "calendar"
+	WindowRolling  = "rolling"
+)
+
+// FreePlanID is the plan used for users without a row or a paid plan.
+const FreePlanID = "free"
+
+type PlanService struct {
+	DB *sql.DB
+}
+
+// Plan describes the quota and feature entitlements a user gets.
+type Plan struct {
+	ID             string `json:"id"`
+	Name           string `json:"name"`
+	Period         string `json:"period"`
+	WindowPolicy   string `json:"window_policy"`
+	RequestLimit   *int   `json:"request_limit"` // nil means unlimited
+	AllowRoast     bool   `json:"allow_roast"`
+	MaxInputLength int    `json:"max_input_length"`
+	TrialDays      int    `json:"trial_days"` // length of the signup trial, 0 for none
+	// APIKeyRateLimit is the requests per minute each of the user's API
+	// keys may make.
+	APIKeyRateLimit int `json:"api_key_rate_limit"`
+}
+
+func NewPlanService(db *sql.DB) *PlanService {
+	return &PlanService{DB: db}
+}
+
+const planColumns = `id, name, period, window_policy, request_limit, allow_roast, max_input_length, trial_days, api_key_rate_limit`
+
+func scanPlan(row *sql.Row) (*Plan, error) {
+	var plan Plan
+	var limit sql.NullInt64
+	err := row.Scan(&plan.ID, &plan.Name, &plan.Period, &plan.WindowPolicy, &limit, &plan.AllowRoast,
+		&plan.MaxInputLength, &plan.TrialDays, &plan.APIKeyRateLimit)
+	if err != nil {
+		return nil, err
+	}
+	if limit.Valid {
+		n := int(limit.Int64)
+		plan.RequestLimit = &n
+	}
+	return &plan, nil
+}
+
+func (ps *PlanService) GetPlan(planID string) (*Plan, error) {
+	return getPlan(ps.DB, planID)
+}
+
+func getPlan(q queryer, planID string) (*Plan, error) {
+	return scanPlan(q.QueryRow(`SELECT `+planColumns+` FROM plans WHERE id = $1`, planID))
+}
+
+// GetUserPlan returns the plan of the user's best active entitlement, or the
+// free plan when they have none.
+func (ps *PlanService) GetUserPlan(userID string) (*Plan, error) {
+	return getUserPlan(ps.DB, userID)
+}
+
+func getUserPlan(q queryer, userID string) (*Plan, error) {
+	plan, err := scanPlan(q.QueryRow(`
+		SELECT `+planColumns+`
+		FROM plans
+		WHERE id = COALESCE((`+bestEntitlementPlanSQL+`), $2)
+	`, userID, FreePlanID))
+	if err != nil {
+		return nil, err
+	}
+
+	// Staff can override the request limit of a user's plan
+	var limitOverride sql.NullInt64
+	err = q.QueryRow(`SELECT request_limit_override FROM users WHERE id = $1`, userID).Scan(&limitOverride)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if limitOverride.Valid {
+		n := int(limitOverride.Int64)
+		plan.RequestLimit = &n
+	}
+	return plan, nil
+}
+
+// Unlimited reports whether the plan has no request quota.
+func (p *Plan) Unlimited() bool {
+	return p.RequestLimit == nil
+}
+
+// PeriodLength is the length of a rolling window for the plan's period.
+func (p *Plan) PeriodLength() time.Duration {
+	if p.Period == PeriodMonthly {
+		return 30 * 24 * time.Hour
+	}
+	return 24 * time.Hour
+}
+
+// Window returns the start and end of the quota period containing now, with
+// calendar boundaries taken in loc. For rolling windows the end is only an
+// upper bound; the real reset depends on when the oldest usage was recorded.
+func (p *Plan) Window(now time.Time, loc *time.Location) (time.Time, time.Time) {
+	if p.WindowPolicy == WindowRolling {
+		return now.Add(-p.PeriodLength()), now.Add(p.PeriodLength())
+	}
+
+	now = now.In(loc)
+	if p.Period == PeriodMonthly {
+		start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, loc)
+		return start, start.AddDate(0, 1, 0)
+	}
+
+	start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	return start, start.AddDate(0, 0, 1)
+}
@@ -0,0 +1,189 @@
+package services
+
+import (
+	"database/sql"
+	"math"
+	"sync"
+	"time"
+)
+
+// rateLimitPruneInterval is how often stores drop buckets that have refilled
+// completely, which are no different from missing ones.
+const rateLimitPruneInterval = time.Minute
+
+// RateLimitPolicy is a token bucket: Burst requests at once, refilled at
+// Limit requests per Period. Name separates the buckets of different
+// policies for the same client.
+type RateLimitPolicy struct {
+	Name   string
+	Limit  int
+	Period time.Duration
+	Burst  int // defaults to Limit
+}
+
+// RateLimitResult is the outcome of taking a token.
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int           // the bucket's capacity
+	Remaining  int           // whole tokens left
+	Reset      time.Duration // until the bucket is full again
+	RetryAfter time.Duration // until the next token, when not allowed
+}
+
+// RateLimitStore holds token buckets by key.
+type RateLimitStore interface {
+	Take(key string, policy RateLimitPolicy, now time.Time) (RateLimitResult, error)
+}
+
+func (p RateLimitPolicy) capacity() float64 {
+	if p.Burst > 0 {
+		return float64(p.Burst)
+	}
+	return float64(p.Limit)
+}
+
+// perSecond is the refill rate.
+func (p RateLimitPolicy) perSecond() float64 {
+	return float64(p.Limit) / p.Period.Seconds()
+}
+
+// take refills a bucket last updated at updatedAt and takes a token from it
+// if there is one, returning the bucket's new level. A policy that never
+// refills allows nothing.
+func (p RateLimitPolicy) take(tokens float64, updatedAt, now time.Time) (float64, RateLimitResult) {
+	capacity := p.capacity()
+	rate := p.perSecond()
+	if p.Limit <= 0 || p.Period <= 0 || capacity < 1 {
+		// There's no next token to wait for, so clients back off a minute
+		return 0, RateLimitResult{RetryAfter: time.Minute}
+	}
+
+	if elapsed := now.Sub(updatedAt).Seconds(); elapsed > 0 {
+		tokens = math.Min(capacity, tokens+elapsed*rate)
+	}
+
+	result := RateLimitResult{Limit: int(capacity)}
+	if tokens >= 1 {
+		tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsDuration((1 - tokens) / rate)
+	}
+	result.Remaining = int(tokens)
+	result.Reset = secondsDuration((capacity - tokens) / rate)
+	return tokens, result
+}
+
+func secondsDuration(seconds float64) time.Duration {
+	return time.Duration(math.Ceil(seconds)) * time.Second
+}
+
+type memoryBucket struct {
+	tokens    float64
+	updatedAt time.Time
+	fullAt    time.Time
+}
+
+// MemoryRateLimitStore keeps buckets in process memory. Limits apply per
+// instance, so use PostgresRateLimitStore when running more than one.
+type MemoryRateLimitStore struct {
+	mu       sync.Mutex
+	buckets  map[string]*memoryBucket
+	prunedAt time.Time
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: make(map[string]*memoryBucket)}
+}
+
+func (s *MemoryRateLimitStore) Take(key string, policy RateLimitPolicy, now time.Time) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.prunedAt) > rateLimitPruneInterval {
+		for k, bucket := range s.buckets {
+			if now.After(bucket.fullAt) {
+				delete(s.buckets, k)
+			}
+		}
+		s.prunedAt = now
+	}
+
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &memoryBucket{tokens: policy.capacity(), updatedAt: now}
+		s.buckets[key] = bucket
+	}
+
+	tokens, result := policy.take(bucket.tokens, bucket.updatedAt, now)
+	bucket.tokens = tokens
+	bucket.updatedAt = now
+	bucket.fullAt = now.Add(result.Reset)
+	return result, nil
+}
+
+// PostgresRateLimitStore keeps buckets in the rate_limit_buckets table, so
+// limits hold across instances.
+type PostgresRateLimitStore struct {
+	DB *sql.DB
+
+	mu       sync.Mutex
+	prunedAt time.Time
+}
+
+func NewPostgresRateLimitStore(db *sql.DB) *PostgresRateLimitStore {
+	return &PostgresRateLimitStore{DB: db}
+}
+
+func (s *PostgresRateLimitStore) Take(key string, policy RateLimitPolicy, now time.Time) (RateLimitResult, error) {
+	if err := s.prune(now); err != nil {
+		return RateLimitResult{}, err
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO rate_limit_buckets (key, tokens, updated_at, full_at)
+		VALUES ($1, $2, $3, $3)
+		ON CONFLICT (key) DO NOTHING
+	`, key, policy.capacity(), now)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+
+	var tokens float64
+	var updatedAt time.Time
+	err = tx.QueryRow(`
+		SELECT tokens, updated_at FROM rate_limit_buckets WHERE key = $1 FOR UPDATE
+	`, key).Scan(&tokens, &updatedAt)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+
+	tokens, result := policy.take(tokens, updatedAt, now)
+	_, err = tx.Exec(`
+		UPDATE rate_limit_buckets SET tokens = $2, updated_at = $3, full_at = $4 WHERE key = $1
+	`, key, tokens, now, now.Add(result.Reset))
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+
+	return result, tx.Commit()
+}
+
+func (s *PostgresRateLimitStore) prune(now time.Time) error {
+	s.mu.Lock()
+	if now.Sub(s.prunedAt) < rateLimitPruneInterval {
+		s.mu.Unlock()
+		return nil
+	}
+	s.prunedAt = now
+	s.mu.Unlock()
+
+	_, err := s.DB.Exec(`DELETE FROM rate_limit_buckets WHERE full_at < $1`, now)
+	return err
+}
@@ -0,0 +1,46 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryRateLimitStoreRefills(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	policy := RateLimitPolicy{Name: "test", Limit: 2, Period: time.Minute}
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if result, err := store.Take("key", policy, now); err != nil || !result.Allowed {
+			t.Fatalf("take %d = %+v, %v; want allowed", i, result, err)
+		}
+	}
+	result, err := store.Take("key", policy, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Allowed || result.RetryAfter != 30*time.Second {
+		t.Errorf("take from an empty bucket = %+v, want not allowed with a 30s retry", result)
+	}
+
+	if result, err := store.Take("key", policy, now.Add(30*time.Second)); err != nil || !result.Allowed {
+		t.Errorf("take after a refill = %+v, %v; want allowed", result, err)
+	}
+}
+
+func TestRateLimitPolicyWithoutRateAllowsNothing(t *testing.T) {
+	now := time.Now()
+	for _, policy := range []RateLimitPolicy{
+		{Name: "zero", Limit: 0, Period: time.Minute},
+		{Name: "burst", Limit: 0, Period: time.Minute, Burst: 5},
+		{Name: "no_period", Limit: 10},
+	} {
+		tokens, result := policy.take(policy.capacity(), now.Add(-time.Hour), now)
+		if result.Allowed {
+			t.Errorf("%s: allowed a request", policy.Name)
+		}
+		if tokens != 0 || result.Reset != 0 || result.RetryAfter != time.Minute {
+			t.Errorf("%s: take = %v, %+v; want an empty bucket with a one minute retry", policy.Name, tokens, result)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/stripe/stripe-go/v75"
+	portalsession "github.com/stripe/stripe-go/v75/billingportal/session"
+	"github.com/stripe/stripe-go/v75/subscription"
+)
+
+// GetUserSubscription returns the user's most recent Stripe subscription.
+func (ss *StripeService) GetUserSubscription(userID string) (*SubscriptionSummary, error) {
+	var summary SubscriptionSummary
+	var renewsAt, endsAt, trialEndsAt sql.NullTime
+	err := ss.DB.QueryRow(`
+		SELECT stripe_subscription_id, status, COALESCE(plan_id, 'pro'),
+			current_period_end, ends_at, trial_ends_at,
+			COALESCE(card_brand, ''), COALESCE(card_last_four, '')
+		FROM subscriptions
+		WHERE user_id = $1 AND stripe_subscription_id IS NOT NULL
+		ORDER BY created_at DESC
+		LIMIT 1
+	`, userID).Scan(&summary.ID, &summary.Status, &summary.PlanID,
+		&renewsAt, &endsAt, &trialEndsAt, &summary.CardBrand, &summary.CardLastFour)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoSubscription
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	summary.RenewsAt = nullTimePtr(renewsAt)
+	summary.EndsAt = nullTimePtr(endsAt)
+	summary.TrialEndsAt = nullTimePtr(trialEndsAt)
+	return &summary, nil
+}
+
+// GetPortalURLs opens a Stripe customer portal session. The portal also
+// updates payment methods, so both URLs point at it.
+func (ss *StripeService) GetPortalURLs(userID string) (*PortalURLs, error) {
+	current, err := ss.GetUserSubscription(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var customerID string
+	err = ss.DB.QueryRow(`
+		SELECT COALESCE(stripe_customer_id, '') FROM subscriptions WHERE stripe_subscription_id = $1
+	`, current.ID).Scan(&customerID)
+	if err != nil {
+		return nil, err
+	}
+	if customerID == "" {
+		return nil, fmt.Errorf("no Stripe customer for subscription %s", current.ID)
+	}
+
+	params := &stripe.BillingPortalSessionParams{Customer: stripe.String(customerID)}
+	if ss.PortalReturnURL != "" {
+		params.ReturnURL = stripe.String(ss.PortalReturnURL)
+	}
+	portal, err := portalsession.New(params)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PortalURLs{
+		UpdatePaymentMethod: portal.URL,
+		CustomerPortal:      portal.URL,
+	}, nil
+}
+
+// CancelSubscription cancels at the end of the current period.
+func (ss *StripeService) CancelSubscription(actor AuditActor, userID string) (*SubscriptionSummary, error) {
+	return ss.changeSubscription(actor, userID, "subscription.cancel", func(*stripe.Subscription) (*stripe.SubscriptionParams, error) {
+		return &stripe.SubscriptionParams{CancelAtPeriodEnd: stripe.Bool(true)}, nil
+	})
+}
+
+// ResumeSubscription undoes a cancellation before the period ends.
+func (ss *StripeService) ResumeSubscription(actor AuditActor, userID string) (*SubscriptionSummary, error) {
+	return ss.changeSubscription(actor, userID, "subscription.resume", func(*stripe.Subscription) (*stripe.SubscriptionParams, error) {
+		return &stripe.SubscriptionParams{CancelAtPeriodEnd: stripe.Bool(false)}, nil
+	})
+}
+
+// PauseSubscription pauses payment collection, voiding invoices, optionally
+// until resumesAt. The user is on the free plan while paused.
+func (ss *StripeService) PauseSubscription(actor AuditActor, userID string, resumesAt *time.Time) (*SubscriptionSummary, error) {
+	return ss.changeSubscription(actor, userID, "subscription.pause", func(*stripe.Subscription) (*stripe.SubscriptionParams, error) {
+		pause := &stripe.SubscriptionPauseCollectionParams{Behavior: stripe.String(PauseModeVoid)}
+		if resumesAt != nil {
+			pause.ResumesAt = stripe.Int64(resumesAt.Unix())
+		}
+		return &stripe.SubscriptionParams{PauseCollection: pause}, nil
+	})
+}
+
+func (ss *StripeService) UnpauseSubscription(actor AuditActor, userID string) (*SubscriptionSummary, error) {
+	return ss.changeSubscription(actor, userID, "subscription.unpause", func(*stripe.Subscription) (*stripe.SubscriptionParams, error) {
+		params := &stripe.SubscriptionParams{}
+		params.AddExtra("pause_collection", "")
+		return params, nil
+	})
+}
+
+// ChangeSubscriptionPlan moves the subscription to the price configured for
+// a checkout plan, keeping its quantity. Stripe prorates the difference.
+func (ss *StripeService) ChangeSubscriptionPlan(actor AuditActor, userID, checkoutPlan string) (*SubscriptionSummary, error) {
+	priceID := ss.Prices[checkoutPlan]
+	if priceID == "" {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCheckoutPlan, checkoutPlan)
+	}
+	return ss.changeSubscription(actor, userID, "subscription.change_plan", func(current *stripe.Subscription) (*stripe.SubscriptionParams, error) {
+		if current.Items == nil || len(current.Items.Data) == 0 {
+			return nil, fmt.Errorf("Stripe subscription %s has no items", current.ID)
+		}
+		return &stripe.SubscriptionParams{
+			Items: []*stripe.SubscriptionItemsParams{
+				{ID: stripe.String(current.Items.Data[0].ID), Price: stripe.String(priceID)},
+			},
+			ProrationBehavior: stripe.String("create_prorations"),
+		}, nil
+	})
+}
+
+// changeSubscription updates the user's subscription on Stripe with the
+// params built from its current state and applies the returned subscription
+// locally right away. The webhook that follows confirms it. The local change
+// is logged under action.
+func (ss *StripeService) changeSubscription(actor AuditActor, userID, action string, change func(*stripe.Subscription) (*stripe.SubscriptionParams, error)) (*SubscriptionSummary, error) {
+	current, err := ss.GetUserSubscription(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	remote, err := subscription.Get(current.ID, nil)
+	if err != nil {
+		return nil, err
+	}
+	params, err := change(remote)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := subscription.Update(current.ID, params)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := ss.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := setAuditContext(tx, actor, action); err != nil {
+		return nil, err
+	}
+	// Stripe events are ordered by their creation second, so a webhook for
+	// a later change in the same second still applies
+	event := ss.subscriptionEvent(*updated, time.Now().Truncate(time.Second))
+	if _, err := ss.Subscriptions.Apply(tx, event); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return ss.GetUserSubscription(userID)
+}
@@ -2,89 +2,226 @@ package services
 
 import (
 	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/stripe/stripe-go/v75"
+	"github.com/stripe/stripe-go/v75/checkout/session"
+	"github.com/stripe/stripe-go/v75/webhook"
 )
 
 type StripeService struct {
 	DB            *sql.DB
 	WebhookSecret string
+	Prices        map[string]string // checkout plan -> price ID
+	SuccessURL    string
+	CancelURL     string
+	// PortalReturnURL is where the customer portal links back to
+	PortalReturnURL string
+	Subscriptions   *SubscriptionStore
 }
 
-func NewStripeService(secretKey string) *StripeService {
+func NewStripeService(secretKey, webhookSecret string, db *sql.DB) *StripeService {
 	stripe.Key = secretKey
 	return &StripeService{
-		WebhookSecret: secretKey,
+		DB:            db,
+		WebhookSecret: webhookSecret,
+		Prices:        map[string]string{},
+		Subscriptions: NewSubscriptionStore(db),
 	}
 }
 
-func (ss *StripeService) HandleSubscriptionUpdate(subscription stripe.Subscription) error {
-	// Find user by Stripe customer ID
-	var userID string
-	err := ss.DB.QueryRow(`
-		SELECT user_id FROM subscriptions 
-		WHERE stripe_customer_id = $1
-	`, subscription.Customer.ID).Scan(&userID)
-
-	if err == sql.ErrNoRows {
-		// Create new subscription record
-		// You'd need to get user_id from somewhere (maybe from subscription metadata)
-		return nil
+func (ss *StripeService) Name() string {
+	return BillingProviderStripe
+}
+
+// CreateCheckout creates a Stripe Checkout session for a subscription
+// to the plan chosen in opts. The user ID travels in the subscription
+// metadata so webhooks can find the user. Discount codes are entered on the
+// Stripe checkout page.
+func (ss *StripeService) CreateCheckout(userID, email string, opts CheckoutOptions) (string, error) {
+	if opts.Plan == "" {
+		opts.Plan = CheckoutPlanMonthly
 	}
 
-	if err != nil {
-		return err
-	}
-
-	// Update subscription
-	_, err = ss.DB.Exec(`
-		INSERT INTO subscriptions (user_id, stripe_subscription_id, stripe_customer_id, status, current_period_start, current_period_end)
-		VALUES ($1, $2, $3, $4, $5, $6)
-		ON CONFLICT (stripe_subscription_id)
-		DO UPDATE SET 
-			status = $4,
-			current_period_start = $5,
-			current_period_end = $6,
-			updated_at = NOW()
-	`, userID, subscription.ID, subscription.Customer.ID, string(subscription.Status),
-		time.Unix(subscription.CurrentPeriodStart, 0),
-		time.Unix(subscription.CurrentPeriodEnd, 0))
+	priceID := ss.Prices[opts.Plan]
+	if priceID == "" {
+		return "", fmt.Errorf("%w: %s", ErrUnknownCheckoutPlan, opts.Plan)
+	}
+
+	if opts.CustomPrice != nil {
+		return "", fmt.Errorf("%w: custom_price", ErrUnsupportedCheckoutOption)
+	}
+
+	metadata := map[string]string{"user_id": userID}
+	if opts.WorkspaceID != 0 {
+		metadata["workspace_id"] = strconv.FormatInt(opts.WorkspaceID, 10)
+	}
+
+	quantity := 1
+	if opts.Seats > 1 {
+		quantity = opts.Seats
+	}
 
+	successURL := ss.SuccessURL
+	if opts.RedirectURL != "" {
+		successURL = opts.RedirectURL
+	}
+
+	params := &stripe.CheckoutSessionParams{
+		Mode:                stripe.String(string(stripe.CheckoutSessionModeSubscription)),
+		ClientReferenceID:   stripe.String(userID),
+		CustomerEmail:       stripe.String(email),
+		SuccessURL:          stripe.String(successURL),
+		CancelURL:           stripe.String(ss.CancelURL),
+		AllowPromotionCodes: stripe.Bool(true),
+		LineItems: []*stripe.CheckoutSessionLineItemParams{
+			{Price: stripe.String(priceID), Quantity: stripe.Int64(int64(quantity))},
+		},
+		SubscriptionData: &stripe.CheckoutSessionSubscriptionDataParams{
+			Metadata: metadata,
+		},
+	}
+
+	checkout, err := session.New(params)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	// Update user pro status
-	isActive := subscription.Status == stripe.SubscriptionStatusActive
-	_, err = ss.DB.Exec(`
-		UPDATE users SET is_pro = $1 WHERE id = $2
-	`, isActive, userID)
+	if checkout.URL == "" {
+		return "", fmt.Errorf("no checkout URL returned from Stripe")
+	}
 
-	return err
+	return checkout.URL, nil
 }
 
-func (ss *StripeService) HandleSubscriptionCancellation(subscription stripe.Subscription) error {
-	// Update subscription status
-	_, err := ss.DB.Exec(`
-		UPDATE subscriptions 
-		SET status = $1, updated_at = NOW()
-		WHERE stripe_subscription_id = $2
-	`, string(subscription.Status), subscription.ID)
+// ParseWebhook verifies the Stripe-Signature header against the endpoint's
+// signing secret and decodes the event.
+func (ss *StripeService) ParseWebhook(payload []byte, header http.Header) (*WebhookDelivery, error) {
+	if err := webhook.ValidatePayload(payload, header.Get("Stripe-Signature"), ss.WebhookSecret); err != nil {
+		return nil, ErrInvalidWebhookSignature
+	}
 
-	if err != nil {
-		return err
+	var event stripe.Event
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidWebhookPayload, err)
+	}
+
+	delivery := &WebhookDelivery{
+		Provider:  BillingProviderStripe,
+		EventName: string(event.Type),
+		Payload:   payload,
+	}
+
+	switch event.Type {
+	case "customer.subscription.created", "customer.subscription.updated",
+		"customer.subscription.paused", "customer.subscription.resumed",
+		"customer.subscription.deleted":
+		var subscription stripe.Subscription
+		if err := json.Unmarshal(event.Data.Raw, &subscription); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidWebhookPayload, err)
+		}
+		delivery.ResourceID = subscription.ID
+		subscriptionEvent := ss.subscriptionEvent(subscription, time.Unix(event.Created, 0))
+		delivery.Subscription = &subscriptionEvent
 	}
 
-	// Update user pro status
-	_, err = ss.DB.Exec(`
-		UPDATE users 
-		SET is_pro = FALSE 
-		WHERE id = (
-			SELECT user_id FROM subscriptions 
-			WHERE stripe_subscription_id = $1
-		)
-	`, subscription.ID)
+	return delivery, nil
+}
+
+// HandleWebhook applies subscription events. Stripe doesn't deliver events in
+// order, so each is applied only if it isn't older, by event.Created, than the
+// state already applied (see SubscriptionStore.IsStale). Subscriptions that
+// match no user are quarantined for staff to link. Stripe retries failed
+// deliveries itself, so they aren't recorded.
+func (ss *StripeService) HandleWebhook(delivery *WebhookDelivery) (*WebhookEvent, error) {
+	return ss.Subscriptions.ApplyWebhook(delivery)
+}
+
+// stripeSubscriptionStatus maps a Stripe subscription onto the statuses the
+// entitlement state machine understands.
+func stripeSubscriptionStatus(subscription stripe.Subscription) string {
+	switch subscription.Status {
+	case stripe.SubscriptionStatusTrialing:
+		return SubscriptionOnTrial
+	case stripe.SubscriptionStatusActive:
+		// Stripe keeps subscriptions with paused collection active
+		if subscription.PauseCollection != nil {
+			return SubscriptionPaused
+		}
+		if subscription.CancelAtPeriodEnd || subscription.CancelAt != 0 {
+			return SubscriptionCancelled
+		}
+		return SubscriptionActive
+	case stripe.SubscriptionStatusPastDue:
+		return SubscriptionPastDue
+	case stripe.SubscriptionStatusPaused:
+		return SubscriptionPaused
+	case stripe.SubscriptionStatusUnpaid, stripe.SubscriptionStatusIncomplete:
+		return SubscriptionUnpaid
+	default:
+		return SubscriptionExpired
+	}
+}
+
+// subscriptionEvent normalizes a Stripe subscription. The user comes from the
+// metadata set at checkout.
+func (ss *StripeService) subscriptionEvent(subscription stripe.Subscription, updatedAt time.Time) SubscriptionEvent {
+	customerID := ""
+	if subscription.Customer != nil {
+		customerID = subscription.Customer.ID
+	}
+
+	priceID := ""
+	quantity := 0
+	if subscription.Items != nil && len(subscription.Items.Data) > 0 {
+		item := subscription.Items.Data[0]
+		if item.Price != nil {
+			priceID = item.Price.ID
+		}
+		quantity = int(item.Quantity)
+	}
 
-	return err
+	planID := "pro"
+	for checkoutPlan, id := range ss.Prices {
+		if id == priceID {
+			planID = checkoutPlanPlans[checkoutPlan]
+		}
+	}
+
+	endsAt := unixTimePtr(subscription.CancelAt)
+	if endsAt == nil && subscription.CancelAtPeriodEnd {
+		endsAt = unixTimePtr(subscription.CurrentPeriodEnd)
+	}
+	if endsAt == nil {
+		endsAt = unixTimePtr(subscription.EndedAt)
+	}
+
+	return SubscriptionEvent{
+		Provider:       BillingProviderStripe,
+		SubscriptionID: subscription.ID,
+		CustomerID:     customerID,
+		UserID:         subscription.Metadata["user_id"],
+		WorkspaceID:    subscription.Metadata["workspace_id"],
+		PriceID:        priceID,
+		PlanID:         planID,
+		Quantity:       quantity,
+		Status:         stripeSubscriptionStatus(subscription),
+		PeriodStart:    time.Unix(subscription.CurrentPeriodStart, 0),
+		RenewsAt:       time.Unix(subscription.CurrentPeriodEnd, 0),
+		EndsAt:         endsAt,
+		TrialEndsAt:    unixTimePtr(subscription.TrialEnd),
+		UpdatedAt:      updatedAt,
+	}
+}
+
+func unixTimePtr(seconds int64) *time.Time {
+	if seconds == 0 {
+		return nil
+	}
+	t := time.Unix(seconds, 0)
+	return &t
 }
@@ -0,0 +1,290 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// UnmatchedSubscription is a LemonSqueezy subscription that couldn't be tied
+// to a user. It holds the latest subscription data so it can be linked later.
+type UnmatchedSubscription struct {
+	SubscriptionID string                   `json:"subscription_id"`
+	UserEmail      string                   `json:"user_email"`
+	CustomUserID   string                   `json:"custom_user_id,omitempty"`
+	Subscription   LemonSqueezySubscription `json:"subscription"`
+	CreatedAt      time.Time                `json:"created_at"`
+	UpdatedAt      time.Time                `json:"updated_at"`
+}
+
+// resolveCheckoutUser returns the user a purchase belongs to: the user_id
+// from checkout custom data if it exists, otherwise the user with the buyer's
+// email. It returns "" when neither matches.
+func resolveCheckoutUser(q queryer, customUserID, email string) (string, error) {
+	var userID string
+	if customUserID != "" {
+		err := q.QueryRow(`SELECT id FROM users WHERE id::text = $1`, customUserID).Scan(&userID)
+		if err == nil {
+			return userID, nil
+		}
+		if err != sql.ErrNoRows {
+			return "", err
+		}
+	}
+
+	if email == "" {
+		return "", nil
+	}
+
+	err := q.QueryRow(`SELECT id FROM users WHERE email = $1`, email).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return userID, err
+}
+
+func quarantineSubscription(tx *sql.Tx, subscription LemonSqueezySubscription, customUserID string) error {
+	data, err := json.Marshal(subscription)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO unmatched_subscriptions (
+			lemonsqueezy_subscription_id, user_email, custom_user_id, subscription
+		)
+		VALUES ($1, $2, NULLIF($3, ''), $4)
+		ON CONFLICT (lemonsqueezy_subscription_id)
+		DO UPDATE SET
+			user_email = $2,
+			custom_user_id = COALESCE(NULLIF($3, ''), unmatched_subscriptions.custom_user_id),
+			subscription = $4,
+			updated_at = NOW()
+	`, subscription.ID, subscription.Attributes.UserEmail, customUserID, string(data))
+	return err
+}
+
+// refreshQuarantinedSubscription keeps the stored data of a quarantined
+// subscription current when an update for it arrives. It reports whether the
+// subscription is quarantined.
+func refreshQuarantinedSubscription(tx *sql.Tx, subscription LemonSqueezySubscription) (bool, error) {
+	data, err := json.Marshal(subscription)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := tx.Exec(`
+		UPDATE unmatched_subscriptions
+		SET subscription = $2, updated_at = NOW()
+		WHERE lemonsqueezy_subscription_id = $1 AND resolved_at IS NULL
+	`, subscription.ID, string(data))
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+func (ls *LemonSqueezyService) ListUnmatchedSubscriptions() ([]UnmatchedSubscription, error) {
+	rows, err := ls.DB.Query(`
+		SELECT lemonsqueezy_subscription_id, user_email, COALESCE(custom_user_id, ''),
+			subscription, created_at, updated_at
+		FROM unmatched_subscriptions
+		WHERE resolved_at IS NULL
+		ORDER BY created_at
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var unmatched []UnmatchedSubscription
+	for rows.Next() {
+		var entry UnmatchedSubscription
+		var data []byte
+		err := rows.Scan(&entry.SubscriptionID, &entry.UserEmail, &entry.CustomUserID,
+			&data, &entry.CreatedAt, &entry.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &entry.Subscription); err != nil {
+			return nil, err
+		}
+		unmatched = append(unmatched, entry)
+	}
+
+	return unmatched, rows.Err()
+}
+
+// LinkUnmatchedSubscription assigns a quarantined subscription to a user and
+// applies it as if it had just been created for them.
+func (ls *LemonSqueezyService) LinkUnmatchedSubscription(actor AuditActor, subscriptionID, userID string) error {
+	tx, err := ls.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := setAuditContext(tx, actor, "subscription.link"); err != nil {
+		return err
+	}
+
+	var data []byte
+	err = tx.QueryRow(`
+		SELECT subscription
+		FROM unmatched_subscriptions
+		WHERE lemonsqueezy_subscription_id = $1 AND resolved_at IS NULL
+		FOR UPDATE
+	`, subscriptionID).Scan(&data)
+	if err != nil {
+		return err
+	}
+
+	var subscription LemonSqueezySubscription
+	if err := json.Unmarshal(data, &subscription); err != nil {
+		return err
+	}
+
+	var exists bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE id::text = $1)`, userID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrUserNotFound
+	}
+
+	if err := ls.HandleSubscriptionCreated(tx, subscription, userID, ""); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE unmatched_subscriptions
+		SET resolved_at = NOW(), resolved_user_id = $2
+		WHERE lemonsqueezy_subscription_id = $1
+	`, subscriptionID, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UnmatchedSubscriptionEvent is the latest event of a subscription that
+// matched no user, from a provider whose webhooks go through
+// SubscriptionStore.ApplyWebhook, such as Stripe.
+type UnmatchedSubscriptionEvent struct {
+	Provider       string            `json:"provider"`
+	SubscriptionID string            `json:"subscription_id"`
+	Event          SubscriptionEvent `json:"event"`
+	CreatedAt      time.Time         `json:"created_at"`
+	UpdatedAt      time.Time         `json:"updated_at"`
+}
+
+// quarantine keeps the event of a subscription no user matched until staff
+// link it. An older event than the one already kept is dropped.
+func (s *SubscriptionStore) quarantine(tx *sql.Tx, event SubscriptionEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO unmatched_subscription_events (provider, subscription_id, event, event_updated_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (provider, subscription_id)
+		DO UPDATE SET event = $3, event_updated_at = $4, updated_at = NOW()
+		WHERE unmatched_subscription_events.event_updated_at <= $4
+	`, event.Provider, event.SubscriptionID, string(data), event.UpdatedAt)
+	return err
+}
+
+// resolveQuarantinedEvent marks a quarantined subscription resolved once a
+// later event matches it to a user.
+func resolveQuarantinedEvent(tx *sql.Tx, event SubscriptionEvent, userID string) error {
+	_, err := tx.Exec(`
+		UPDATE unmatched_subscription_events
+		SET resolved_at = NOW(), resolved_user_id = $3
+		WHERE provider = $1 AND subscription_id = $2 AND resolved_at IS NULL
+	`, event.Provider, event.SubscriptionID, userID)
+	return err
+}
+
+func (s *SubscriptionStore) ListUnmatchedSubscriptions() ([]UnmatchedSubscriptionEvent, error) {
+	rows, err := s.DB.Query(`
+		SELECT provider, subscription_id, event, created_at, updated_at
+		FROM unmatched_subscription_events
+		WHERE resolved_at IS NULL
+		ORDER BY created_at
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	unmatched := []UnmatchedSubscriptionEvent{}
+	for rows.Next() {
+		var entry UnmatchedSubscriptionEvent
+		var data []byte
+		err := rows.Scan(&entry.Provider, &entry.SubscriptionID, &data, &entry.CreatedAt, &entry.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &entry.Event); err != nil {
+			return nil, err
+		}
+		unmatched = append(unmatched, entry)
+	}
+
+	return unmatched, rows.Err()
+}
+
+// LinkUnmatchedSubscription assigns a quarantined subscription to a user and
+// applies its latest event as if the user had been in its checkout metadata.
+func (s *SubscriptionStore) LinkUnmatchedSubscription(actor AuditActor, provider, subscriptionID, userID string) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := setAuditContext(tx, actor, "subscription.link"); err != nil {
+		return err
+	}
+
+	var data []byte
+	err = tx.QueryRow(`
+		SELECT event
+		FROM unmatched_subscription_events
+		WHERE provider = $1 AND subscription_id = $2 AND resolved_at IS NULL
+		FOR UPDATE
+	`, provider, subscriptionID).Scan(&data)
+	if err != nil {
+		return err
+	}
+
+	var event SubscriptionEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return err
+	}
+
+	var exists bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE id::text = $1)`, userID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrUserNotFound
+	}
+
+	event.UserID = userID
+	event.Email = ""
+	owner, err := s.Apply(tx, event)
+	if err != nil {
+		return err
+	}
+	if err := resolveQuarantinedEvent(tx, event, owner); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
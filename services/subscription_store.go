@@ -0,0 +1,339 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// subscriptionColumns are the provider specific columns of a subscriptions row.
+type subscriptionColumns struct {
+	id, customer, price, updatedAt string
+}
+
+var providerColumns = map[string]subscriptionColumns{
+	BillingProviderLemonSqueezy: {
+		id:        "lemonsqueezy_subscription_id",
+		customer:  "lemonsqueezy_customer_id",
+		price:     "lemonsqueezy_variant_id",
+		updatedAt: "lemonsqueezy_updated_at",
+	},
+	BillingProviderStripe: {
+		id:        "stripe_subscription_id",
+		customer:  "stripe_customer_id",
+		price:     "stripe_price_id",
+		updatedAt: "stripe_updated_at",
+	},
+}
+
+// dunningColumnsSQL updates the failed payment clock for the new status in
+// $2. It starts when a renewal first goes past due, keeps running if the
+// provider gives up and reports unpaid, and stops on any other status.
+const dunningColumnsSQL = `
+	payment_failed_at = CASE $2
+		WHEN 'past_due' THEN COALESCE(payment_failed_at, NOW())
+		WHEN 'unpaid' THEN payment_failed_at
+	END,
+	dunning_step = CASE WHEN $2 IN ('past_due', 'unpaid') THEN dunning_step ELSE 0 END`
+
+func columnsFor(provider string) (subscriptionColumns, error) {
+	columns, ok := providerColumns[provider]
+	if !ok {
+		return columns, fmt.Errorf("unknown billing provider %q", provider)
+	}
+	return columns, nil
+}
+
+// SubscriptionStore keeps the subscriptions table and the entitlements it
+// grants in step with normalized events from any billing provider.
+type SubscriptionStore struct {
+	DB *sql.DB
+}
+
+func NewSubscriptionStore(db *sql.DB) *SubscriptionStore {
+	return &SubscriptionStore{DB: db}
+}
+
+// UserProvider returns the billing provider of the user's most recent
+// subscription, or ErrNoSubscription when they have none.
+func (s *SubscriptionStore) UserProvider(userID string) (string, error) {
+	var provider string
+	err := s.DB.QueryRow(`
+		SELECT CASE WHEN stripe_subscription_id IS NOT NULL THEN $2 ELSE $3 END
+		FROM subscriptions
+		WHERE user_id = $1
+			AND (stripe_subscription_id IS NOT NULL OR lemonsqueezy_subscription_id IS NOT NULL)
+		ORDER BY created_at DESC
+		LIMIT 1
+	`, userID, BillingProviderStripe, BillingProviderLemonSqueezy).Scan(&provider)
+	if err == sql.ErrNoRows {
+		return "", ErrNoSubscription
+	}
+	return provider, err
+}
+
+// IsStale reports whether the subscription has already applied a newer
+// version than updatedAt. It locks the row so concurrent events for the same
+// subscription apply in order.
+func (s *SubscriptionStore) IsStale(tx *sql.Tx, provider, subscriptionID string, updatedAt time.Time) (bool, error) {
+	columns, err := columnsFor(provider)
+	if err != nil {
+		return false, err
+	}
+
+	var lastApplied sql.NullTime
+	err = tx.QueryRow(fmt.Sprintf(`
+		SELECT %s
+		FROM subscriptions
+		WHERE %s = $1
+		FOR UPDATE
+	`, columns.updatedAt, columns.id), subscriptionID).Scan(&lastApplied)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return lastApplied.Valid && updatedAt.Before(lastApplied.Time), nil
+}
+
+// Current returns the subscription's stored state as an event, for changes a
+// provider reports without the full subscription, such as a failed payment.
+// It locks the row, and returns sql.ErrNoRows for a subscription it doesn't
+// have.
+func (s *SubscriptionStore) Current(tx *sql.Tx, provider, subscriptionID string) (SubscriptionEvent, error) {
+	event := SubscriptionEvent{Provider: provider, SubscriptionID: subscriptionID}
+	columns, err := columnsFor(provider)
+	if err != nil {
+		return event, err
+	}
+
+	var periodStart, renewsAt, endsAt, trialEndsAt, updatedAt sql.NullTime
+	var priceID sql.NullString
+	err = tx.QueryRow(fmt.Sprintf(`
+		SELECT status, COALESCE(plan_id, 'pro'), %s, quantity,
+			current_period_start, current_period_end, ends_at, trial_ends_at, %s
+		FROM subscriptions
+		WHERE %s = $1
+		FOR UPDATE
+	`, columns.price, columns.updatedAt, columns.id), subscriptionID).Scan(
+		&event.Status, &event.PlanID, &priceID, &event.Quantity,
+		&periodStart, &renewsAt, &endsAt, &trialEndsAt, &updatedAt)
+	if err != nil {
+		return event, err
+	}
+
+	event.PriceID = priceID.String
+	event.PeriodStart = periodStart.Time
+	event.RenewsAt = renewsAt.Time
+	event.EndsAt = nullTimePtr(endsAt)
+	event.TrialEndsAt = nullTimePtr(trialEndsAt)
+	event.UpdatedAt = updatedAt.Time
+	return event, nil
+}
+
+// Apply stores the subscription's latest state and lets the entitlement state
+// machine decide what access it grants. A subscription seen for the first
+// time is linked to the user in the event's metadata, then by email, then by
+// an earlier subscription of the same customer, and to the workspace in the
+// metadata if that user owns or administers it. Checkout metadata is set by
+// the buyer, so a workspace they can't manage is ignored and the
+// subscription is theirs alone. It returns the owner, or ""
+// when no user matches and nothing was stored.
+func (s *SubscriptionStore) Apply(tx *sql.Tx, event SubscriptionEvent) (string, error) {
+	columns, err := columnsFor(event.Provider)
+	if err != nil {
+		return "", err
+	}
+
+	// Serialises events for a subscription that has no row to lock yet
+	_, err = tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, event.Provider+":"+event.SubscriptionID)
+	if err != nil {
+		return "", err
+	}
+
+	var userID sql.NullString
+	err = tx.QueryRow(fmt.Sprintf(`
+		UPDATE subscriptions
+		SET
+			status = $2,
+			current_period_start = $3,
+			current_period_end = $4,
+			ends_at = $5,
+			trial_ends_at = $6,
+			plan_id = $7,
+			%s = $8,
+			%s = $9,
+			card_brand = COALESCE(NULLIF($10, ''), card_brand),
+			card_last_four = COALESCE(NULLIF($11, ''), card_last_four),
+			quantity = COALESCE(NULLIF($12, 0), quantity),
+			%s,
+			updated_at = NOW()
+		WHERE %s = $1
+		RETURNING user_id
+	`, columns.price, columns.updatedAt, dunningColumnsSQL, columns.id),
+		event.SubscriptionID,
+		event.Status,
+		event.PeriodStart,
+		event.RenewsAt,
+		event.EndsAt,
+		event.TrialEndsAt,
+		event.PlanID,
+		nullString(event.PriceID),
+		event.UpdatedAt,
+		event.CardBrand,
+		event.CardLastFour,
+		event.Quantity,
+	).Scan(&userID)
+
+	if err == sql.ErrNoRows {
+		return s.insert(tx, columns, event)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return userID.String, refreshSubscriptionEntitlement(tx, event.Provider, event.SubscriptionID)
+}
+
+func (s *SubscriptionStore) insert(tx *sql.Tx, columns subscriptionColumns, event SubscriptionEvent) (string, error) {
+	userID, err := resolveCheckoutUser(tx, event.UserID, event.Email)
+	if err != nil {
+		return "", err
+	}
+
+	if userID == "" && event.CustomerID != "" {
+		err = tx.QueryRow(fmt.Sprintf(`
+			SELECT user_id FROM subscriptions
+			WHERE %s = $1 AND user_id IS NOT NULL
+			LIMIT 1
+		`, columns.customer), event.CustomerID).Scan(&userID)
+		if err != nil && err != sql.ErrNoRows {
+			return "", err
+		}
+	}
+
+	if userID == "" {
+		return "", nil
+	}
+
+	_, err = tx.Exec(fmt.Sprintf(`
+		INSERT INTO subscriptions (
+			user_id,
+			%s,
+			%s,
+			status,
+			current_period_start,
+			current_period_end,
+			ends_at,
+			trial_ends_at,
+			plan_id,
+			%s,
+			%s,
+			card_brand,
+			card_last_four,
+			quantity,
+			workspace_id,
+			payment_failed_at,
+			created_at,
+			updated_at
+		)
+		VALUES (
+			$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, NULLIF($12, ''), NULLIF($13, ''),
+			GREATEST($14, 1),
+			(
+				SELECT m.workspace_id FROM workspace_members m
+				WHERE m.workspace_id::text = $15 AND m.user_id = $1 AND m.role IN ($16, $17)
+			),
+			CASE WHEN $4 = 'past_due' THEN NOW() END,
+			NOW(), NOW()
+		)
+	`, columns.id, columns.customer, columns.price, columns.updatedAt),
+		userID,
+		event.SubscriptionID,
+		nullString(event.CustomerID),
+		event.Status,
+		event.PeriodStart,
+		event.RenewsAt,
+		event.EndsAt,
+		event.TrialEndsAt,
+		event.PlanID,
+		nullString(event.PriceID),
+		event.UpdatedAt,
+		event.CardBrand,
+		event.CardLastFour,
+		event.Quantity,
+		event.WorkspaceID,
+		WorkspaceRoleOwner,
+		WorkspaceRoleAdmin,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return userID, refreshSubscriptionEntitlement(tx, event.Provider, event.SubscriptionID)
+}
+
+// ApplyWebhook applies a delivery's subscription event in its own
+// transaction, skipping events older than the stored state. Providers whose
+// other events need no handling of their own use it as their HandleWebhook.
+func (s *SubscriptionStore) ApplyWebhook(delivery *WebhookDelivery) (*WebhookEvent, error) {
+	result := &WebhookEvent{
+		EventName:  delivery.EventName,
+		ResourceID: delivery.ResourceID,
+		Payload:    delivery.Payload,
+		ReceivedAt: time.Now(),
+		Status:     WebhookStatusIgnored,
+	}
+
+	event := delivery.Subscription
+	if event == nil {
+		return result, nil
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := setAuditContext(tx, delivery.auditActor(), delivery.Provider+"."+delivery.EventName); err != nil {
+		return nil, err
+	}
+
+	stale, err := s.IsStale(tx, event.Provider, event.SubscriptionID, event.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	result.Status = WebhookStatusSkipped
+	if !stale {
+		userID, err := s.Apply(tx, *event)
+		if err != nil {
+			return nil, err
+		}
+		if userID == "" {
+			err = s.quarantine(tx, *event)
+		} else {
+			err = resolveQuarantinedEvent(tx, *event, userID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		result.Status = WebhookStatusProcessed
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	result.ProcessedAt = &now
+	return result, nil
+}
+
+// nullString stores empty provider fields as NULL.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
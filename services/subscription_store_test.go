@@ -0,0 +1,159 @@
+package services
+
+import (
+	"database/sql"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// applyTestSubscription applies a new Stripe subscription bought by the user,
+// tagged with the workspace as checkout metadata would be.
+func applyTestSubscription(t *testing.T, db *sql.DB, userID string, workspaceID int64, seats int) string {
+	t.Helper()
+	now := time.Now().UTC().Truncate(time.Second)
+	event := SubscriptionEvent{
+		Provider:       BillingProviderStripe,
+		SubscriptionID: "sub_" + newTestUUID(t),
+		UserID:         userID,
+		WorkspaceID:    strconv.FormatInt(workspaceID, 10),
+		PlanID:         "team",
+		Quantity:       seats,
+		Status:         SubscriptionActive,
+		PeriodStart:    now,
+		RenewsAt:       now.Add(30 * 24 * time.Hour),
+		UpdatedAt:      now,
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := setAuditContext(tx, AuditActor{Type: AuditActorSystem}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	owner, err := NewSubscriptionStore(db).Apply(tx, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner != userID {
+		t.Fatalf("Apply() owner = %q, want the buyer %q", owner, userID)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	return event.SubscriptionID
+}
+
+func subscriptionWorkspace(t *testing.T, db *sql.DB, subscriptionID string) sql.NullInt64 {
+	t.Helper()
+	var workspaceID sql.NullInt64
+	err := db.QueryRow(`
+		SELECT workspace_id FROM subscriptions WHERE stripe_subscription_id = $1
+	`, subscriptionID).Scan(&workspaceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return workspaceID
+}
+
+func TestApplyIgnoresForgedWorkspace(t *testing.T) {
+	db := openTestDB(t)
+	owner := createTestUser(t, db)
+	buyer := createTestUser(t, db)
+
+	workspace, err := NewWorkspaceService(db).CreateWorkspace(AuditActor{Type: AuditActorSystem}, owner, "Victims")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`UPDATE workspaces SET seats = 10 WHERE id = $1`, workspace.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	subscriptionID := applyTestSubscription(t, db, buyer, workspace.ID, 1)
+
+	if got := subscriptionWorkspace(t, db, subscriptionID); got.Valid {
+		t.Errorf("subscription linked to workspace %d the buyer doesn't manage", got.Int64)
+	}
+	var seats int
+	if err := db.QueryRow(`SELECT seats FROM workspaces WHERE id = $1`, workspace.ID).Scan(&seats); err != nil {
+		t.Fatal(err)
+	}
+	if seats != 10 {
+		t.Errorf("workspace seats = %d after a forged checkout, want 10", seats)
+	}
+}
+
+func TestApplyLinksManagedWorkspace(t *testing.T) {
+	db := openTestDB(t)
+	owner := createTestUser(t, db)
+
+	workspace, err := NewWorkspaceService(db).CreateWorkspace(AuditActor{Type: AuditActorSystem}, owner, "Ours")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subscriptionID := applyTestSubscription(t, db, owner, workspace.ID, 5)
+
+	if got := subscriptionWorkspace(t, db, subscriptionID); !got.Valid || got.Int64 != workspace.ID {
+		t.Errorf("subscription workspace = %v, want %d", got, workspace.ID)
+	}
+}
+
+func TestApplyWebhookQuarantinesUnmatchedSubscription(t *testing.T) {
+	db := openTestDB(t)
+	store := NewSubscriptionStore(db)
+	now := time.Now().UTC().Truncate(time.Second)
+	event := SubscriptionEvent{
+		Provider:       BillingProviderStripe,
+		SubscriptionID: "sub_" + newTestUUID(t),
+		CustomerID:     "cus_" + newTestUUID(t),
+		UserID:         newTestUUID(t), // no such user
+		PlanID:         "pro",
+		Status:         SubscriptionActive,
+		PeriodStart:    now,
+		RenewsAt:       now.Add(30 * 24 * time.Hour),
+		UpdatedAt:      now,
+	}
+
+	result, err := store.ApplyWebhook(&WebhookDelivery{
+		Provider:     BillingProviderStripe,
+		EventName:    "customer.subscription.created",
+		ResourceID:   event.SubscriptionID,
+		Subscription: &event,
+	})
+	if err != nil {
+		t.Fatalf("ApplyWebhook() error = %v, want the subscription quarantined", err)
+	}
+	if result.Status != WebhookStatusProcessed {
+		t.Errorf("ApplyWebhook() status = %q, want %q", result.Status, WebhookStatusProcessed)
+	}
+
+	userID := createTestUser(t, db)
+	err = store.LinkUnmatchedSubscription(AuditActor{Type: AuditActorSystem}, BillingProviderStripe, event.SubscriptionID, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var owner string
+	err = db.QueryRow(`
+		SELECT user_id FROM subscriptions WHERE stripe_subscription_id = $1
+	`, event.SubscriptionID).Scan(&owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner != userID {
+		t.Errorf("linked subscription owner = %q, want %q", owner, userID)
+	}
+
+	unmatched, err := store.ListUnmatchedSubscriptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range unmatched {
+		if entry.SubscriptionID == event.SubscriptionID {
+			t.Errorf("subscription %s still quarantined after linking", event.SubscriptionID)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrTokenExpired = errors.New("token expired")
+)
+
+const (
+	// tokenClockSkew tolerates clock drift between us and the token issuer.
+	tokenClockSkew = time.Minute
+	// jwksRefreshInterval bounds how often the key set is fetched, so tokens
+	// with made up key IDs or an issuer outage can't hammer the issuer.
+	jwksRefreshInterval = time.Minute
+)
+
+// TokenClaims are the verified claims of an access token. Subject is the
+// user ID.
+type TokenClaims struct {
+	Subject   string        `json:"sub"`
+	Email     string        `json:"email"`
+	Issuer    string        `json:"iss"`
+	Audience  tokenAudience `json:"aud"`
+	ExpiresAt int64         `json:"exp"`
+	NotBefore int64         `json:"nbf"`
+	IssuedAt  int64         `json:"iat"`
+}
+
+// tokenAudience is the aud claim, which may be a string or a list.
+type tokenAudience []string
+
+func (a *tokenAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = tokenAudience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// TokenVerifier verifies bearer JWTs: HS256 tokens signed with HMACSecret,
+// and RS256/ES256 tokens signed by a key from the JWKS at JWKSURL, such as
+// those issued by Supabase. The subject must be the user's UUID, so issuers
+// with other subjects (e.g. Auth0's "auth0|..." IDs) aren't supported. The
+// key set is cached for CacheTTL and refetched early when a token names a key
+// it doesn't contain, so key rotation works without a restart.
+type TokenVerifier struct {
+	HMACSecret []byte
+	JWKSURL    string
+	Issuer     string // required iss, if set
+	Audience   string // required aud, if set
+	CacheTTL   time.Duration
+	HTTPClient *http.Client
+
+	// mu guards the cached keys; fetchMu lets one request at a time fetch
+	// the key set, without holding mu, so cached keys verify meanwhile.
+	mu          sync.Mutex
+	fetchMu     sync.Mutex
+	keys        map[string]crypto.PublicKey
+	fetchedAt   time.Time
+	attemptedAt time.Time
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func NewTokenVerifier(hmacSecret, jwksURL string) *TokenVerifier {
+	verifier := &TokenVerifier{
+		JWKSURL:    jwksURL,
+		CacheTTL:   time.Hour,
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+	}
+	if hmacSecret != "" {
+		verifier.HMACSecret = []byte(hmacSecret)
+	}
+	return verifier
+}
+
+// Configured reports whether the verifier has any key to verify with.
+func (v *TokenVerifier) Configured() bool {
+	return len(v.HMACSecret) > 0 || v.JWKSURL != ""
+}
+
+// Verify checks the token's signature and registered claims and returns its
+// claims. It returns ErrTokenExpired for an expired token and ErrInvalidToken
+// for anything else wrong with it.
+func (v *TokenVerifier) Verify(token string) (*TokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	var header tokenHeader
+	if err := decodeTokenSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	// The key is chosen by algorithm first, so a token can't get an HMAC
+	// checked against a public key or vice versa
+	switch header.Alg {
+	case "HS256":
+		if len(v.HMACSecret) == 0 {
+			return nil, ErrInvalidToken
+		}
+		mac := hmac.New(sha256.New, v.HMACSecret)
+		mac.Write(signed)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return nil, ErrInvalidToken
+		}
+	case "RS256", "ES256":
+		key, err := v.publicKey(header.Kid)
+		if err != nil {
+			return nil, err
+		}
+		if !verifyTokenSignature(header.Alg, key, signed, signature) {
+			return nil, ErrInvalidToken
+		}
+	default:
+		return nil, ErrInvalidToken
+	}
+
+	var claims TokenClaims
+	if err := decodeTokenSegment(parts[1], &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if err := v.validateClaims(&claims, time.Now()); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+func (v *TokenVerifier) validateClaims(claims *TokenClaims, now time.Time) error {
+	if claims.Subject == "" || claims.ExpiresAt == 0 {
+		return ErrInvalidToken
+	}
+	if now.Add(-tokenClockSkew).After(time.Unix(claims.ExpiresAt, 0)) {
+		return ErrTokenExpired
+	}
+	if claims.NotBefore != 0 && now.Add(tokenClockSkew).Before(time.Unix(claims.NotBefore, 0)) {
+		return ErrInvalidToken
+	}
+	if v.Issuer != "" && claims.Issuer != v.Issuer {
+		return ErrInvalidToken
+	}
+	if v.Audience != "" {
+		for _, audience := range claims.Audience {
+			if audience == v.Audience {
+				return nil
+			}
+		}
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+func decodeTokenSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func verifyTokenSignature(alg string, key crypto.PublicKey, signed, signature []byte) bool {
+	digest := sha256.Sum256(signed)
+
+	switch alg {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature) == nil
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || ecKey.Curve != elliptic.P256() || len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(ecKey, digest[:], r, s)
+	}
+	return false
+}
+
+// publicKey returns the JWKS key with the given ID, refreshing the cached
+// key set when it is stale or doesn't contain the key.
+func (v *TokenVerifier) publicKey(kid string) (crypto.PublicKey, error) {
+	if v.JWKSURL == "" {
+		return nil, ErrInvalidToken
+	}
+
+	key, ok, fresh := v.cachedKey(kid)
+	if ok && fresh {
+		return key, nil
+	}
+
+	// A stale key keeps working while another request refreshes the set
+	if !v.fetchMu.TryLock() {
+		if ok {
+			return key, nil
+		}
+		v.fetchMu.Lock()
+	}
+	defer v.fetchMu.Unlock()
+
+	// The set may have been refreshed while waiting
+	key, ok, fresh = v.cachedKey(kid)
+	if ok && fresh {
+		return key, nil
+	}
+	v.mu.Lock()
+	throttled := time.Since(v.attemptedAt) < jwksRefreshInterval
+	if !throttled {
+		v.attemptedAt = time.Now()
+	}
+	v.mu.Unlock()
+	if throttled {
+		if ok {
+			return key, nil
+		}
+		return nil, ErrInvalidToken
+	}
+
+	keys, err := v.fetchKeys()
+	if err != nil {
+		// Keep verifying with the keys we have if the issuer is down
+		if ok {
+			return key, nil
+		}
+		return nil, err
+	}
+
+	v.mu.Lock()
+	v.keys = keys
+	v.fetchedAt = time.Now()
+	v.mu.Unlock()
+
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, ErrInvalidToken
+}
+
+// cachedKey looks up a key in the cached set and reports whether the set is
+// still within CacheTTL.
+func (v *TokenVerifier) cachedKey(kid string) (crypto.PublicKey, bool, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	key, ok := v.keys[kid]
+	return key, ok, time.Since(v.fetchedAt) <= v.CacheTTL
+}
+
+func (v *TokenVerifier) fetchKeys() (map[string]crypto.PublicKey, error) {
+	resp, err := v.HTTPClient.Get(v.JWKSURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS request failed with status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("failed to decode JWKS: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			// Skip key types we don't verify with rather than failing the set
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("RSA exponent out of range")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		// ecdsa.Verify rejects points that aren't on the curve
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", jwk.Kty)
+}
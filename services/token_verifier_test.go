@@ -0,0 +1,375 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testSubject = "6f1d9a52-3c1e-4f7b-9a55-0d6c2b8e4a10"
+
+var (
+	testRSAKeyOnce sync.Once
+	testRSAKeys    [2]*rsa.PrivateKey
+)
+
+// rsaTestKeys generates two RSA keys once for the whole package.
+func rsaTestKeys(t *testing.T) (*rsa.PrivateKey, *rsa.PrivateKey) {
+	t.Helper()
+	testRSAKeyOnce.Do(func() {
+		for i := range testRSAKeys {
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			if err != nil {
+				panic(err)
+			}
+			testRSAKeys[i] = key
+		}
+	})
+	return testRSAKeys[0], testRSAKeys[1]
+}
+
+func encodeSegment(t *testing.T, v interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// signToken builds a JWT with the given header and claims. key is a
+// []byte HMAC secret, an RSA or ECDSA private key, or nil for no signature.
+func signToken(t *testing.T, header map[string]string, claims map[string]interface{}, key interface{}) string {
+	t.Helper()
+	signed := encodeSegment(t, header) + "." + encodeSegment(t, claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch key := key.(type) {
+	case nil:
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	default:
+		t.Fatalf("unsupported key %T", key)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func validClaims() map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"sub": testSubject,
+		"iss": "https://issuer.example",
+		"aud": "emaildrip",
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	}
+}
+
+func withClaims(changes map[string]interface{}) map[string]interface{} {
+	claims := validClaims()
+	for name, value := range changes {
+		if value == nil {
+			delete(claims, name)
+			continue
+		}
+		claims[name] = value
+	}
+	return claims
+}
+
+func rsaJWK(kid string, key *rsa.PublicKey) jsonWebKey {
+	return jsonWebKey{
+		Kty: "RSA",
+		Kid: kid,
+		Use: "sig",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func ecJWK(kid string, key *ecdsa.PublicKey) jsonWebKey {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	key.X.FillBytes(x)
+	key.Y.FillBytes(y)
+	return jsonWebKey{
+		Kty: "EC",
+		Kid: kid,
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(x),
+		Y:   base64.RawURLEncoding.EncodeToString(y),
+	}
+}
+
+// jwksServer serves a key set that tests can swap out or break.
+type jwksServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	keys     []jsonWebKey
+	status   int
+	requests int
+	block    chan struct{}
+}
+
+func newJWKSServer(t *testing.T, keys ...jsonWebKey) *jwksServer {
+	t.Helper()
+	s := &jwksServer{keys: keys, status: http.StatusOK}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests++
+		block, status, keys := s.block, s.status, s.keys
+		s.mu.Unlock()
+
+		if block != nil {
+			<-block
+		}
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *jwksServer) set(status int, keys ...jsonWebKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+	s.keys = keys
+}
+
+func (s *jwksServer) requestCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func newTestVerifier(secret string, jwksURL string) *TokenVerifier {
+	v := NewTokenVerifier(secret, jwksURL)
+	v.Issuer = "https://issuer.example"
+	v.Audience = "emaildrip"
+	return v
+}
+
+// allowRefetch lifts the throttle on JWKS fetches, as if
+// jwksRefreshInterval had passed.
+func allowRefetch(v *TokenVerifier) {
+	v.mu.Lock()
+	v.attemptedAt = time.Time{}
+	v.mu.Unlock()
+}
+
+func TestTokenVerifierVerify(t *testing.T) {
+	secret := []byte("test-hmac-secret")
+	rsaKey, otherRSAKey := rsaTestKeys(t)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newJWKSServer(t, rsaJWK("rsa-1", &rsaKey.PublicKey), ecJWK("ec-1", &ecKey.PublicKey))
+
+	publicDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})
+
+	hs256 := map[string]string{"alg": "HS256", "typ": "JWT"}
+	rs256 := map[string]string{"alg": "RS256", "kid": "rsa-1"}
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		secret  string // HMAC secret of the verifier
+		token   string
+		wantErr error
+	}{
+		{"HS256", string(secret), signToken(t, hs256, validClaims(), secret), nil},
+		{"RS256", "", signToken(t, rs256, validClaims(), rsaKey), nil},
+		{"ES256", "", signToken(t, map[string]string{"alg": "ES256", "kid": "ec-1"}, validClaims(), ecKey), nil},
+
+		{"malformed", string(secret), "not.a-jwt", ErrInvalidToken},
+		{"HS256 with wrong secret", string(secret), signToken(t, hs256, validClaims(), []byte("other")), ErrInvalidToken},
+		{"HS256 without a secret configured", "", signToken(t, hs256, validClaims(), secret), ErrInvalidToken},
+		{"alg none", string(secret), signToken(t, map[string]string{"alg": "none"}, validClaims(), nil), ErrInvalidToken},
+		{"alg None", string(secret), signToken(t, map[string]string{"alg": "None"}, validClaims(), nil), ErrInvalidToken},
+		{"missing alg", string(secret), signToken(t, map[string]string{}, validClaims(), secret), ErrInvalidToken},
+		{"unsupported alg", string(secret), signToken(t, map[string]string{"alg": "HS512"}, validClaims(), secret), ErrInvalidToken},
+		// HS/RS confusion: an HMAC made with the public key must not pass
+		// as an RS256 signature, nor as HS256 when no secret is set
+		{"HS256 keyed with the RSA public key", "", signToken(t, map[string]string{"alg": "HS256", "kid": "rsa-1"}, validClaims(), publicPEM), ErrInvalidToken},
+		{"RS256 header with an HMAC signature", string(secret), signToken(t, rs256, validClaims(), secret), ErrInvalidToken},
+		{"RS256 signed by another key", "", signToken(t, rs256, validClaims(), otherRSAKey), ErrInvalidToken},
+		{"ES256 header on an RSA key", "", signToken(t, map[string]string{"alg": "ES256", "kid": "rsa-1"}, validClaims(), ecKey), ErrInvalidToken},
+		{"RS256 header on an EC key", "", signToken(t, map[string]string{"alg": "RS256", "kid": "ec-1"}, validClaims(), rsaKey), ErrInvalidToken},
+
+		{"expired", string(secret), signToken(t, hs256, withClaims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()}), secret), ErrTokenExpired},
+		{"expired within clock skew", string(secret), signToken(t, hs256, withClaims(map[string]interface{}{"exp": now.Add(-tokenClockSkew / 2).Unix()}), secret), nil},
+		{"missing exp", string(secret), signToken(t, hs256, withClaims(map[string]interface{}{"exp": nil}), secret), ErrInvalidToken},
+		{"not yet valid", string(secret), signToken(t, hs256, withClaims(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()}), secret), ErrInvalidToken},
+		{"nbf within clock skew", string(secret), signToken(t, hs256, withClaims(map[string]interface{}{"nbf": now.Add(tokenClockSkew / 2).Unix()}), secret), nil},
+		{"nbf passed", string(secret), signToken(t, hs256, withClaims(map[string]interface{}{"nbf": now.Add(-time.Minute).Unix()}), secret), nil},
+		{"missing sub", string(secret), signToken(t, hs256, withClaims(map[string]interface{}{"sub": nil}), secret), ErrInvalidToken},
+		{"wrong issuer", string(secret), signToken(t, hs256, withClaims(map[string]interface{}{"iss": "https://evil.example"}), secret), ErrInvalidToken},
+		{"aud list containing ours", string(secret), signToken(t, hs256, withClaims(map[string]interface{}{"aud": []string{"other", "emaildrip"}}), secret), nil},
+		{"aud list without ours", string(secret), signToken(t, hs256, withClaims(map[string]interface{}{"aud": []string{"other", "another"}}), secret), ErrInvalidToken},
+		{"wrong aud", string(secret), signToken(t, hs256, withClaims(map[string]interface{}{"aud": "other"}), secret), ErrInvalidToken},
+		{"missing aud", string(secret), signToken(t, hs256, withClaims(map[string]interface{}{"aud": nil}), secret), ErrInvalidToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newTestVerifier(tt.secret, server.URL)
+			claims, err := v.Verify(tt.token)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && claims.Subject != testSubject {
+				t.Fatalf("Verify() subject = %q, want %q", claims.Subject, testSubject)
+			}
+		})
+	}
+}
+
+func TestTokenVerifierJWKS(t *testing.T) {
+	oldKey, newKey := rsaTestKeys(t)
+	oldToken := signToken(t, map[string]string{"alg": "RS256", "kid": "old"}, validClaims(), oldKey)
+	newToken := signToken(t, map[string]string{"alg": "RS256", "kid": "new"}, validClaims(), newKey)
+
+	t.Run("unknown kid", func(t *testing.T) {
+		server := newJWKSServer(t, rsaJWK("old", &oldKey.PublicKey))
+		v := newTestVerifier("", server.URL)
+
+		if _, err := v.Verify(newToken); !errors.Is(err, ErrInvalidToken) {
+			t.Fatalf("Verify() error = %v, want %v", err, ErrInvalidToken)
+		}
+		// Made up key IDs don't refetch the set on every request
+		requests := server.requestCount()
+		for i := 0; i < 5; i++ {
+			v.Verify(newToken)
+		}
+		if got := server.requestCount(); got != requests {
+			t.Fatalf("JWKS fetched %d times for unknown kids, want %d", got, requests)
+		}
+	})
+
+	t.Run("key rotation", func(t *testing.T) {
+		server := newJWKSServer(t, rsaJWK("old", &oldKey.PublicKey))
+		v := newTestVerifier("", server.URL)
+
+		if _, err := v.Verify(oldToken); err != nil {
+			t.Fatalf("Verify(old) error = %v", err)
+		}
+
+		server.set(http.StatusOK, rsaJWK("new", &newKey.PublicKey))
+		allowRefetch(v)
+		if _, err := v.Verify(newToken); err != nil {
+			t.Fatalf("Verify(new) after rotation error = %v", err)
+		}
+		if _, err := v.Verify(oldToken); !errors.Is(err, ErrInvalidToken) {
+			t.Fatalf("Verify(old) after rotation error = %v, want %v", err, ErrInvalidToken)
+		}
+	})
+
+	t.Run("outage keeps cached keys", func(t *testing.T) {
+		server := newJWKSServer(t, rsaJWK("old", &oldKey.PublicKey))
+		v := newTestVerifier("", server.URL)
+		if _, err := v.Verify(oldToken); err != nil {
+			t.Fatalf("Verify() error = %v", err)
+		}
+
+		server.set(http.StatusInternalServerError)
+		v.mu.Lock()
+		v.fetchedAt = time.Now().Add(-2 * v.CacheTTL)
+		v.mu.Unlock()
+		allowRefetch(v)
+
+		if _, err := v.Verify(oldToken); err != nil {
+			t.Fatalf("Verify() with a stale key during an outage error = %v", err)
+		}
+	})
+
+	t.Run("outage without the key", func(t *testing.T) {
+		server := newJWKSServer(t)
+		server.set(http.StatusServiceUnavailable)
+		v := newTestVerifier("", server.URL)
+
+		_, err := v.Verify(oldToken)
+		if err == nil || errors.Is(err, ErrInvalidToken) || errors.Is(err, ErrTokenExpired) {
+			t.Fatalf("Verify() error = %v, want a fetch error", err)
+		}
+	})
+
+	t.Run("cached keys verify during a slow fetch", func(t *testing.T) {
+		server := newJWKSServer(t, rsaJWK("old", &oldKey.PublicKey))
+		v := newTestVerifier("", server.URL)
+		if _, err := v.Verify(oldToken); err != nil {
+			t.Fatalf("Verify() error = %v", err)
+		}
+
+		block := make(chan struct{})
+		server.mu.Lock()
+		server.block = block
+		server.mu.Unlock()
+		defer close(block)
+		allowRefetch(v)
+
+		requests := server.requestCount()
+		go v.Verify(newToken) // unknown kid, fetches and hangs
+		for deadline := time.Now().Add(5 * time.Second); server.requestCount() == requests; {
+			if time.Now().After(deadline) {
+				t.Fatal("JWKS fetch never started")
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := v.Verify(oldToken)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Verify() with a cached key waited for the JWKS fetch")
+		}
+	})
+}
@@ -0,0 +1,402 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Usage report states
+const (
+	UsageReportPending  = "pending"
+	UsageReportReported = "reported"
+	UsageReportFailed   = "failed"
+)
+
+// Usage report actions. Reports used to set the period's usage; they now
+// increment it by the rewrites they bill.
+const (
+	UsageActionSet       = "set"
+	UsageActionIncrement = "increment"
+)
+
+// UsageReport is an entry in the ledger of usage reported to LemonSqueezy.
+// Each adds Quantity to the usage of the billing period that was current when
+// it was sent, and bills the reservations that point at it. The reservations
+// of a failed report are released, so the next report bills them.
+type UsageReport struct {
+	ID                 int64      `json:"id"`
+	SubscriptionID     string     `json:"subscription_id"`
+	SubscriptionItemID int        `json:"subscription_item_id"`
+	PeriodStart        time.Time  `json:"period_start"`
+	PeriodEnd          time.Time  `json:"period_end"`
+	Action             string     `json:"action"`
+	Quantity           int        `json:"quantity"`
+	Status             string     `json:"status"`
+	UsageRecordID      string     `json:"usage_record_id,omitempty"`
+	Error              string     `json:"error,omitempty"`
+	CreatedAt          time.Time  `json:"created_at"`
+	ReportedAt         *time.Time `json:"reported_at,omitempty"`
+}
+
+// UsageReconciliation compares the usage reported for a metered
+// subscription's current period, according to the ledger, with the usage
+// LemonSqueezy has. UnreportedQuantity is the billable rewrites waiting for
+// the next report.
+type UsageReconciliation struct {
+	SubscriptionID     string       `json:"subscription_id"`
+	SubscriptionItemID int          `json:"subscription_item_id"`
+	UserID             string       `json:"user_id"`
+	PeriodStart        time.Time    `json:"period_start"`
+	PeriodEnd          time.Time    `json:"period_end"`
+	LocalQuantity      int          `json:"local_quantity"`
+	ReportedQuantity   int          `json:"reported_quantity"`
+	UnreportedQuantity int          `json:"unreported_quantity"`
+	InSync             bool         `json:"in_sync"`
+	LastReport         *UsageReport `json:"last_report,omitempty"`
+	Error              string       `json:"error,omitempty"`
+}
+
+// meteredSubscription is a usage-based subscription that still accrues usage.
+// Rewrites are billed to it from BillingFrom: when it started, or after the
+// last report that set its usage.
+type meteredSubscription struct {
+	SubscriptionID string
+	ItemID         int
+	UserID         string
+	WorkspaceID    sql.NullInt64
+	BillingFrom    time.Time
+}
+
+type subscriptionItemUsage struct {
+	Meta struct {
+		PeriodStart time.Time `json:"period_start"`
+		PeriodEnd   time.Time `json:"period_end"`
+		Quantity    int       `json:"quantity"`
+	} `json:"meta"`
+}
+
+type usageRecordDocument struct {
+	Data usageRecordData `json:"data"`
+}
+
+type usageRecordData struct {
+	Type          string                  `json:"type"`
+	ID            string                  `json:"id,omitempty"`
+	Attributes    usageRecordAttributes   `json:"attributes"`
+	Relationships map[string]Relationship `json:"relationships,omitempty"`
+}
+
+type usageRecordAttributes struct {
+	Quantity int    `json:"quantity"`
+	Action   string `json:"action"`
+}
+
+// recordSubscriptionItem stores which item usage is reported against and
+// whether the subscription is usage-based.
+func recordSubscriptionItem(tx *sql.Tx, subscription LemonSqueezySubscription) error {
+	itemID := subscription.Attributes.SubscriptionItemID
+	usageBased := subscription.Attributes.IsUsageBased
+	if item := subscription.Attributes.FirstSubscriptionItem; item != nil {
+		itemID = item.ID
+		usageBased = item.IsUsageBased
+	}
+	if itemID == 0 {
+		return nil
+	}
+
+	_, err := tx.Exec(`
+		UPDATE subscriptions
+		SET lemonsqueezy_subscription_item_id = $2, is_usage_based = $3
+		WHERE lemonsqueezy_subscription_id = $1
+	`, subscription.ID, itemID, usageBased)
+	return err
+}
+
+func (ls *LemonSqueezyService) meteredSubscriptions() ([]meteredSubscription, error) {
+	rows, err := ls.DB.Query(`
+		SELECT s.lemonsqueezy_subscription_id, s.lemonsqueezy_subscription_item_id, s.user_id, s.workspace_id,
+			GREATEST(s.created_at, COALESCE((
+				SELECT MAX(r.created_at) FROM usage_reports r
+				WHERE r.subscription_item_id = s.lemonsqueezy_subscription_item_id
+					AND r.action = $5 AND r.status = $6
+			), '-infinity'))
+		FROM subscriptions s
+		WHERE s.is_usage_based
+			AND s.lemonsqueezy_subscription_item_id IS NOT NULL
+			AND s.user_id IS NOT NULL
+			AND s.status IN ($1, $2, $3, $4)
+	`, SubscriptionActive, SubscriptionOnTrial, SubscriptionPastDue, SubscriptionCancelled,
+		UsageActionSet, UsageReportReported)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subscriptions []meteredSubscription
+	for rows.Next() {
+		var subscription meteredSubscription
+		if err := rows.Scan(&subscription.SubscriptionID, &subscription.ItemID,
+			&subscription.UserID, &subscription.WorkspaceID, &subscription.BillingFrom); err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+	return subscriptions, rows.Err()
+}
+
+// unreportedRewritesSQL matches the reservations billable to a subscription
+// that no report has billed yet: rewrites paid from the plan quota, not with
+// credits, by its owner or by any member of a workspace subscription's
+// workspace. $1 is the owner, $2 the workspace and $3 the subscription's
+// BillingFrom.
+const unreportedRewritesSQL = `
+	status = 'committed'
+	AND source = 'quota'
+	AND usage_report_id IS NULL
+	AND created_at >= $3
+	AND (user_id = $1 OR user_id IN (
+		SELECT user_id FROM workspace_members WHERE workspace_id = $2
+	))`
+
+// unreportedRewrites counts the rewrites the next report would bill.
+func (ls *LemonSqueezyService) unreportedRewrites(subscription meteredSubscription) (int, error) {
+	var count int
+	err := ls.DB.QueryRow(`SELECT COUNT(*) FROM usage_reservations WHERE `+unreportedRewritesSQL,
+		subscription.UserID, subscription.WorkspaceID, subscription.BillingFrom).Scan(&count)
+	return count, err
+}
+
+// reportedUsage is the usage the ledger has reported for the period starting
+// at periodStart: the last total set for it, plus the increments since.
+func (ls *LemonSqueezyService) reportedUsage(itemID int, periodStart time.Time) (int, error) {
+	var quantity int
+	err := ls.DB.QueryRow(`
+		WITH last_set AS (
+			SELECT quantity, created_at FROM usage_reports
+			WHERE subscription_item_id = $1 AND period_start = $2 AND action = $3 AND status = $5
+			ORDER BY created_at DESC, id DESC
+			LIMIT 1
+		)
+		SELECT COALESCE((SELECT quantity FROM last_set), 0) + COALESCE(SUM(quantity), 0)
+		FROM usage_reports
+		WHERE subscription_item_id = $1 AND period_start = $2 AND action = $4 AND status = $5
+			AND created_at > COALESCE((SELECT created_at FROM last_set), '-infinity')
+	`, itemID, periodStart, UsageActionSet, UsageActionIncrement, UsageReportReported).Scan(&quantity)
+	return quantity, err
+}
+
+func (ls *LemonSqueezyService) subscriptionItemUsage(itemID int) (*subscriptionItemUsage, error) {
+	var usage subscriptionItemUsage
+	if err := ls.apiRequest("GET", fmt.Sprintf("/subscription-items/%d/current-usage", itemID), nil, &usage); err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+// ReportUsage adds the rewrites of every metered subscription that haven't
+// been billed yet to the usage of its current billing period, recording each
+// report in the ledger. Subscriptions without new rewrites are skipped.
+func (ls *LemonSqueezyService) ReportUsage(ctx context.Context) error {
+	subscriptions, err := ls.meteredSubscriptions()
+	if err != nil {
+		return err
+	}
+
+	for _, subscription := range subscriptions {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := ls.reportSubscriptionUsage(subscription); err != nil {
+			log.Printf("Failed to report usage of subscription %s: %v", subscription.SubscriptionID, err)
+		}
+	}
+	return nil
+}
+
+func (ls *LemonSqueezyService) reportSubscriptionUsage(subscription meteredSubscription) error {
+	pending, err := ls.unreportedRewrites(subscription)
+	if err != nil || pending == 0 {
+		return err
+	}
+
+	// The period the increment lands in, for the ledger
+	usage, err := ls.subscriptionItemUsage(subscription.ItemID)
+	if err != nil {
+		return err
+	}
+
+	reportID, quantity, err := ls.claimUnreportedRewrites(subscription, usage)
+	if err != nil || quantity == 0 {
+		return err
+	}
+
+	record := usageRecordDocument{Data: usageRecordData{
+		Type:       "usage-records",
+		Attributes: usageRecordAttributes{Quantity: quantity, Action: UsageActionIncrement},
+		Relationships: map[string]Relationship{
+			"subscription-item": {Data: ResourceIdentifier{
+				Type: "subscription-items",
+				ID:   strconv.Itoa(subscription.ItemID),
+			}},
+		},
+	}}
+
+	var created usageRecordDocument
+	if apiErr := ls.apiRequest("POST", "/usage-records", record, &created); apiErr != nil {
+		if err := ls.failUsageReport(reportID, apiErr); err != nil {
+			return fmt.Errorf("%v (recording failure: %v)", apiErr, err)
+		}
+		return apiErr
+	}
+
+	_, err = ls.DB.Exec(`
+		UPDATE usage_reports SET status = $2, usage_record_id = $3, reported_at = NOW() WHERE id = $1
+	`, reportID, UsageReportReported, created.Data.ID)
+	return err
+}
+
+// claimUnreportedRewrites creates a pending report and assigns it the
+// subscription's unreported reservations, returning how many it bills.
+func (ls *LemonSqueezyService) claimUnreportedRewrites(subscription meteredSubscription, usage *subscriptionItemUsage) (int64, int, error) {
+	tx, err := ls.DB.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	var reportID int64
+	err = tx.QueryRow(`
+		INSERT INTO usage_reports (
+			lemonsqueezy_subscription_id, subscription_item_id, period_start, period_end, action, quantity, status
+		)
+		VALUES ($1, $2, $3, $4, $5, 0, $6)
+		RETURNING id
+	`, subscription.SubscriptionID, subscription.ItemID, usage.Meta.PeriodStart, usage.Meta.PeriodEnd,
+		UsageActionIncrement, UsageReportPending).Scan(&reportID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	result, err := tx.Exec(`
+		UPDATE usage_reservations SET usage_report_id = $4
+		WHERE `+unreportedRewritesSQL,
+		subscription.UserID, subscription.WorkspaceID, subscription.BillingFrom, reportID)
+	if err != nil {
+		return 0, 0, err
+	}
+	claimed, err := result.RowsAffected()
+	if err != nil || claimed == 0 {
+		// A concurrent run claimed them first
+		return 0, 0, err
+	}
+
+	if _, err := tx.Exec(`UPDATE usage_reports SET quantity = $2 WHERE id = $1`, reportID, claimed); err != nil {
+		return 0, 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	return reportID, int(claimed), nil
+}
+
+// failUsageReport records why a report failed and releases its reservations
+// for the next report.
+func (ls *LemonSqueezyService) failUsageReport(reportID int64, reportErr error) error {
+	tx, err := ls.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE usage_reports SET status = $2, error = $3 WHERE id = $1
+	`, reportID, UsageReportFailed, reportErr.Error())
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE usage_reservations SET usage_report_id = NULL WHERE usage_report_id = $1`, reportID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ReconcileUsage reports, for every metered subscription, whether the usage
+// LemonSqueezy bills for the current period matches the local rewrites.
+func (ls *LemonSqueezyService) ReconcileUsage(ctx context.Context) ([]UsageReconciliation, error) {
+	subscriptions, err := ls.meteredSubscriptions()
+	if err != nil {
+		return nil, err
+	}
+
+	results := []UsageReconciliation{}
+	for _, subscription := range subscriptions {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+
+		result := UsageReconciliation{
+			SubscriptionID:     subscription.SubscriptionID,
+			SubscriptionItemID: subscription.ItemID,
+			UserID:             subscription.UserID,
+		}
+
+		last, err := ls.lastUsageReport(subscription.ItemID)
+		if err != nil {
+			return results, err
+		}
+		result.LastReport = last
+
+		usage, err := ls.subscriptionItemUsage(subscription.ItemID)
+		if err != nil {
+			result.Error = err.Error()
+			results = append(results, result)
+			continue
+		}
+		result.PeriodStart = usage.Meta.PeriodStart
+		result.PeriodEnd = usage.Meta.PeriodEnd
+		result.ReportedQuantity = usage.Meta.Quantity
+
+		result.LocalQuantity, err = ls.reportedUsage(subscription.ItemID, usage.Meta.PeriodStart)
+		if err != nil {
+			return results, err
+		}
+		result.UnreportedQuantity, err = ls.unreportedRewrites(subscription)
+		if err != nil {
+			return results, err
+		}
+		result.InSync = result.LocalQuantity == result.ReportedQuantity
+
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (ls *LemonSqueezyService) lastUsageReport(itemID int) (*UsageReport, error) {
+	var report UsageReport
+	var recordID, reportErr sql.NullString
+	var reportedAt sql.NullTime
+	err := ls.DB.QueryRow(`
+		SELECT id, lemonsqueezy_subscription_id, subscription_item_id, period_start, period_end,
+			action, quantity, status, usage_record_id, error, created_at, reported_at
+		FROM usage_reports
+		WHERE subscription_item_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT 1
+	`, itemID).Scan(&report.ID, &report.SubscriptionID, &report.SubscriptionItemID, &report.PeriodStart,
+		&report.PeriodEnd, &report.Action, &report.Quantity, &report.Status, &recordID, &reportErr, &report.CreatedAt, &reportedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	report.UsageRecordID = recordID.String
+	report.Error = reportErr.String
+	report.ReportedAt = nullTimePtr(reportedAt)
+	return &report, nil
+}
@@ -0,0 +1,160 @@
+package services
+
+import (
+	"time"
+)
+
+// Features counted in usage history. Every email is a rewrite; roasts are the
+// optional add-on requested with roast mode.
+const (
+	FeatureRewrite = "rewrite"
+	FeatureRoast   = "roast"
+)
+
+const dateLayout = "2006-01-02"
+
+// UsageBreakdown counts emails by tone and feature.
+type UsageBreakdown struct {
+	Total     int            `json:"total"`
+	ByTone    map[string]int `json:"by_tone"`
+	ByFeature map[string]int `json:"by_feature"`
+}
+
+type DailyUsage struct {
+	Date string `json:"date"`
+	UsageBreakdown
+}
+
+type UsageHistory struct {
+	From          string         `json:"from"`
+	To            string         `json:"to"`
+	Timezone      string         `json:"timezone"`
+	Days          []DailyUsage   `json:"days"`
+	Totals        UsageBreakdown `json:"totals"`
+	CurrentStreak int            `json:"current_streak"`
+	LongestStreak int            `json:"longest_streak"`
+}
+
+func newUsageBreakdown() UsageBreakdown {
+	return UsageBreakdown{ByTone: map[string]int{}, ByFeature: map[string]int{}}
+}
+
+func (b *UsageBreakdown) add(tone string, roastMode bool, count int) {
+	b.Total += count
+	b.ByTone[tone] += count
+	b.ByFeature[FeatureRewrite] += count
+	if roastMode {
+		b.ByFeature[FeatureRoast] += count
+	}
+}
+
+// GetUsageHistory returns per-day email counts between the from and to dates
+// (inclusive), with days taken in the user's timezone. Only the calendar date
+// of from and to is used.
+func (es *EmailService) GetUsageHistory(userID string, from, to time.Time) (*UsageHistory, error) {
+	loc, err := userLocation(es.DB, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, loc)
+	end := time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, loc).AddDate(0, 0, 1)
+
+	history := &UsageHistory{
+		From:     start.Format(dateLayout),
+		To:       end.AddDate(0, 0, -1).Format(dateLayout),
+		Timezone: loc.String(),
+		Totals:   newUsageBreakdown(),
+	}
+
+	// Dense series so clients can chart the range without filling gaps
+	index := map[string]int{}
+	for day := start; day.Before(end); day = day.AddDate(0, 0, 1) {
+		date := day.Format(dateLayout)
+		index[date] = len(history.Days)
+		history.Days = append(history.Days, DailyUsage{Date: date, UsageBreakdown: newUsageBreakdown()})
+	}
+
+	rows, err := es.DB.Query(`
+		SELECT to_char(created_at AT TIME ZONE $4, 'YYYY-MM-DD') AS day, tone, roast_mode, COUNT(*)
+		FROM emails
+		WHERE user_id = $1 AND created_at >= $2 AND created_at < $3
+		GROUP BY day, tone, roast_mode
+	`, userID, start, end, loc.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var date, tone string
+		var roastMode bool
+		var count int
+		if err := rows.Scan(&date, &tone, &roastMode, &count); err != nil {
+			return nil, err
+		}
+		if i, ok := index[date]; ok {
+			history.Days[i].add(tone, roastMode, count)
+		}
+		history.Totals.add(tone, roastMode, count)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	history.CurrentStreak, history.LongestStreak, err = es.usageStreaks(userID, loc)
+	if err != nil {
+		return nil, err
+	}
+
+	return history, nil
+}
+
+// usageStreaks returns the run of consecutive active days ending today (or
+// yesterday, so a streak isn't lost before the user's first email of the day)
+// and the longest run ever.
+func (es *EmailService) usageStreaks(userID string, loc *time.Location) (int, int, error) {
+	rows, err := es.DB.Query(`
+		SELECT DISTINCT (created_at AT TIME ZONE $2)::date AS day
+		FROM emails
+		WHERE user_id = $1
+		ORDER BY day DESC
+	`, userID, loc.String())
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+
+	now := time.Now().In(loc)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	current, longest, run := 0, 0, 0
+	inCurrent := true
+	var previous time.Time
+	for rows.Next() {
+		var day time.Time
+		if err := rows.Scan(&day); err != nil {
+			return 0, 0, err
+		}
+		day = time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+
+		if run > 0 && previous.AddDate(0, 0, -1).Equal(day) {
+			run++
+		} else {
+			if run > 0 {
+				inCurrent = false
+			}
+			run = 1
+		}
+		previous = day
+
+		if inCurrent && (current > 0 || !day.Before(today.AddDate(0, 0, -1))) {
+			current = run
+		}
+		if run > longest {
+			longest = run
+		}
+	}
+
+	return current, longest, rows.Err()
+}
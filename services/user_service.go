@@ -0,0 +1,429 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// AccountDeletionGracePeriod is how long a deleted account can be restored
+// before it is purged.
+var AccountDeletionGracePeriod = 30 * 24 * time.Hour
+
+// maxProfileNameLength bounds a user's display name, in characters.
+const maxProfileNameLength = 100
+
+var (
+	// ErrInvalidUserID is returned for user IDs that aren't UUIDs, such as
+	// the subject of a token from a misconfigured identity provider.
+	ErrInvalidUserID = errors.New("invalid user ID")
+	// ErrInvalidProfile is returned for an unknown tone or language, or a
+	// name that is too long.
+	ErrInvalidProfile = errors.New("invalid profile")
+	// ErrSubscriptionActive is returned when deleting an account that still
+	// has a subscription that will bill it.
+	ErrSubscriptionActive = errors.New("subscription still active")
+	// ErrOwnsWorkspace is returned when deleting an account that owns a
+	// workspace other users are members of.
+	ErrOwnsWorkspace = errors.New("owns a workspace with other members")
+	// ErrAccountNotDeleted is returned when restoring an account that isn't
+	// waiting to be purged.
+	ErrAccountNotDeleted = errors.New("account not scheduled for deletion")
+)
+
+var (
+	uuidPattern     = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	languagePattern = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z0-9]{2,8})*$`) // BCP 47, e.g. en or pt-BR
+)
+
+// User is a user's account and profile. DeletedAt is set while the account
+// waits to be purged at PurgeAfter.
+type User struct {
+	ID          string     `json:"id"`
+	Email       string     `json:"email"`
+	Name        string     `json:"name"`
+	Timezone    string     `json:"timezone"`
+	DefaultTone string     `json:"default_tone"`
+	Language    string     `json:"language"`
+	PlanID      string     `json:"plan_id"`
+	IsPro       bool       `json:"is_pro"`
+	CreatedAt   time.Time  `json:"created_at"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+	PurgeAfter  *time.Time `json:"purge_after,omitempty"`
+}
+
+// ProfileUpdate changes the fields that are set. An empty Name, DefaultTone
+// or Language clears it.
+type ProfileUpdate struct {
+	Name        *string
+	Timezone    *string
+	DefaultTone *string
+	Language    *string
+}
+
+type UserService struct {
+	DB *sql.DB
+}
+
+func NewUserService(db *sql.DB) *UserService {
+	return &UserService{DB: db}
+}
+
+const userColumns = `id, COALESCE(email, ''), COALESCE(name, ''), timezone, COALESCE(default_tone, ''),
+	COALESCE(language, ''), plan_id, is_pro, created_at, deleted_at, purge_after`
+
+func scanUser(row rowScanner) (*User, error) {
+	var user User
+	var deletedAt, purgeAfter sql.NullTime
+	err := row.Scan(&user.ID, &user.Email, &user.Name, &user.Timezone, &user.DefaultTone,
+		&user.Language, &user.PlanID, &user.IsPro, &user.CreatedAt, &deletedAt, &purgeAfter)
+	if err != nil {
+		return nil, err
+	}
+	user.DeletedAt = nullTimePtr(deletedAt)
+	user.PurgeAfter = nullTimePtr(purgeAfter)
+	return &user, nil
+}
+
+// EnsureUser returns the user, creating them on their first authenticated
+// request. New users start the signup trial, if a plan offers one.
+func (s *UserService) EnsureUser(actor AuditActor, userID, email string) (*User, error) {
+	if !uuidPattern.MatchString(userID) {
+		return nil, ErrInvalidUserID
+	}
+
+	user, err := s.GetUser(userID)
+	if err != ErrUserNotFound {
+		return user, err
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := setAuditContext(tx, actor, "user.signup"); err != nil {
+		return nil, err
+	}
+
+	// Concurrent first requests race to insert; the loser reads the winner's row
+	user, err = scanUser(tx.QueryRow(`
+		INSERT INTO users (id, email) VALUES ($1, NULLIF($2, ''))
+		ON CONFLICT (id) DO NOTHING
+		RETURNING `+userColumns, userID, email))
+	if err == sql.ErrNoRows {
+		return s.GetUser(userID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := startSignupTrial(tx, userID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	// The trial changes the user's plan
+	return s.GetUser(userID)
+}
+
+// GetUser returns the user, including one scheduled for deletion.
+func (s *UserService) GetUser(userID string) (*User, error) {
+	if !uuidPattern.MatchString(userID) {
+		return nil, ErrInvalidUserID
+	}
+	user, err := scanUser(s.DB.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = $1`, userID))
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	return user, err
+}
+
+// UpdateProfile changes the user's name, timezone, default tone or language.
+// A timezone change keeps the current quota window, as in SetUserTimezone.
+func (s *UserService) UpdateProfile(actor AuditActor, userID string, update ProfileUpdate) (*User, error) {
+	if update.Timezone != nil {
+		if _, err := time.LoadLocation(*update.Timezone); err != nil || *update.Timezone == "" {
+			return nil, ErrInvalidTimezone
+		}
+	}
+	if update.Name != nil {
+		*update.Name = strings.TrimSpace(*update.Name)
+		if len([]rune(*update.Name)) > maxProfileNameLength {
+			return nil, ErrInvalidProfile
+		}
+	}
+	if update.DefaultTone != nil && *update.DefaultTone != "" && !isRewriteTone(*update.DefaultTone) {
+		return nil, ErrInvalidProfile
+	}
+	if update.Language != nil && *update.Language != "" && !languagePattern.MatchString(*update.Language) {
+		return nil, ErrInvalidProfile
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := setAuditContext(tx, actor, "user.profile_update"); err != nil {
+		return nil, err
+	}
+	if update.Timezone != nil {
+		if err := holdQuotaWindow(tx, userID, *update.Timezone); err != nil {
+			return nil, err
+		}
+	}
+
+	// Unset fields keep their value; empty ones are cleared
+	user, err := scanUser(tx.QueryRow(`
+		UPDATE users SET
+			name = CASE WHEN $2 THEN NULLIF($3, '') ELSE name END,
+			timezone = CASE WHEN $4 THEN $5 ELSE timezone END,
+			default_tone = CASE WHEN $6 THEN NULLIF($7, '') ELSE default_tone END,
+			language = CASE WHEN $8 THEN NULLIF($9, '') ELSE language END,
+			updated_at = NOW()
+		WHERE id = $1
+		RETURNING `+userColumns,
+		userID,
+		update.Name != nil, stringValue(update.Name),
+		update.Timezone != nil, stringValue(update.Timezone),
+		update.DefaultTone != nil, stringValue(update.DefaultTone),
+		update.Language != nil, stringValue(update.Language),
+	))
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// DeleteAccount schedules the user's account to be purged after
+// AccountDeletionGracePeriod. Their API keys stop working right away. Users
+// must cancel subscriptions that would still bill them first, and can't
+// delete an account that owns a workspace others are members of.
+func (s *UserService) DeleteAccount(actor AuditActor, userID string) (*User, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := setAuditContext(tx, actor, "user.delete"); err != nil {
+		return nil, err
+	}
+
+	var billing bool
+	err = tx.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM subscriptions
+			WHERE user_id = $1 AND status IN ($2, $3, $4, $5, $6)
+		)
+	`, userID, SubscriptionOnTrial, SubscriptionActive, SubscriptionPaused, SubscriptionPastDue,
+		SubscriptionUnpaid).Scan(&billing)
+	if err != nil {
+		return nil, err
+	}
+	if billing {
+		return nil, ErrSubscriptionActive
+	}
+
+	owns, err := ownsSharedWorkspace(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if owns {
+		return nil, ErrOwnsWorkspace
+	}
+
+	// Deleting twice keeps the original purge date
+	user, err := scanUser(tx.QueryRow(`
+		UPDATE users SET
+			deleted_at = COALESCE(deleted_at, NOW()),
+			purge_after = COALESCE(purge_after, NOW() + make_interval(secs => $2)),
+			updated_at = NOW()
+		WHERE id = $1
+		RETURNING `+userColumns, userID, AccountDeletionGracePeriod.Seconds()))
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE api_keys SET revoked_at = NOW()
+		WHERE user_id = $1 AND revoked_at IS NULL
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// RestoreAccount cancels the deletion of an account that hasn't been purged
+// yet. API keys revoked by the deletion stay revoked.
+func (s *UserService) RestoreAccount(actor AuditActor, userID string) (*User, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := setAuditContext(tx, actor, "user.restore"); err != nil {
+		return nil, err
+	}
+
+	user, err := scanUser(tx.QueryRow(`
+		UPDATE users SET deleted_at = NULL, purge_after = NULL, updated_at = NOW()
+		WHERE id = $1 AND deleted_at IS NOT NULL
+		RETURNING `+userColumns, userID))
+	if err == sql.ErrNoRows {
+		return nil, ErrAccountNotDeleted
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// PurgeDeletedUsers deletes the accounts whose grace period has ended, with
+// their emails, usage, API keys and everything else they own. Subscriptions
+// and payments are kept for billing, unlinked from the user. Audit entries
+// are kept too, with the user's personal data redacted.
+func (s *UserService) PurgeDeletedUsers(ctx context.Context) error {
+	rows, err := s.DB.Query(`
+		SELECT id FROM users
+		WHERE deleted_at IS NOT NULL AND purge_after <= NOW()
+	`)
+	if err != nil {
+		return err
+	}
+	var userIDs []string
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, userID := range userIDs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := s.purgeUser(userID); err != nil {
+			log.Printf("Failed to purge deleted user %s: %v", userID, err)
+			continue
+		}
+		log.Printf("Purged deleted user %s", userID)
+	}
+	return nil
+}
+
+func (s *UserService) purgeUser(userID string) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := setAuditContext(tx, AuditActor{Type: AuditActorSystem}, "user.purge"); err != nil {
+		return err
+	}
+
+	// Restored since it was listed
+	var due bool
+	err = tx.QueryRow(`
+		SELECT deleted_at IS NOT NULL AND purge_after <= NOW() FROM users WHERE id = $1 FOR UPDATE
+	`, userID).Scan(&due)
+	if err == sql.ErrNoRows || (err == nil && !due) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Members may have joined since the deletion; their workspace would go
+	// with the owner, so the purge waits until it has no other members
+	owns, err := ownsSharedWorkspace(tx, userID)
+	if err != nil {
+		return err
+	}
+	if owns {
+		return ErrOwnsWorkspace
+	}
+
+	// Tables whose rows reference users without ON DELETE CASCADE
+	for _, query := range []string{
+		`DELETE FROM emails WHERE user_id = $1`,
+		`DELETE FROM ai_errors WHERE user_id = $1`,
+		`UPDATE subscriptions SET user_id = NULL, updated_at = NOW() WHERE user_id = $1`,
+		`DELETE FROM users WHERE id = $1`,
+	} {
+		if _, err := tx.Exec(query, userID); err != nil {
+			return err
+		}
+	}
+
+	if err := redactAuditEntries(tx, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ownsSharedWorkspace reports whether the user owns a workspace with other
+// members, which deleting the user would delete along with their seats.
+func ownsSharedWorkspace(q queryer, userID string) (bool, error) {
+	var owns bool
+	err := q.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM workspaces w
+			JOIN workspace_members m ON m.workspace_id = w.id
+			WHERE w.owner_id = $1 AND m.user_id <> $1
+		)
+	`, userID).Scan(&owns)
+	return owns, err
+}
+
+func isRewriteTone(tone string) bool {
+	for _, t := range RewriteTones {
+		if t == tone {
+			return true
+		}
+	}
+	return false
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
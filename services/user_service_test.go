@@ -0,0 +1,64 @@
+package services
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDeleteAccountOwningSharedWorkspace(t *testing.T) {
+	db := openTestDB(t)
+	users := NewUserService(db)
+	owner := createTestUser(t, db)
+	member := createTestUser(t, db)
+	actor := AuditActor{Type: AuditActorSystem}
+
+	workspace, err := NewWorkspaceService(db).CreateWorkspace(actor, owner, "Team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`
+		INSERT INTO workspace_members (workspace_id, user_id, role) VALUES ($1, $2, $3)
+	`, workspace.ID, member, WorkspaceRoleMember)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := users.DeleteAccount(actor, owner); !errors.Is(err, ErrOwnsWorkspace) {
+		t.Fatalf("DeleteAccount() error = %v, want %v", err, ErrOwnsWorkspace)
+	}
+
+	// A member who joined after the deletion was scheduled still stops the purge
+	_, err = db.Exec(`
+		UPDATE users SET deleted_at = NOW(), purge_after = NOW() WHERE id = $1
+	`, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := users.purgeUser(owner); !errors.Is(err, ErrOwnsWorkspace) {
+		t.Fatalf("purgeUser() error = %v, want %v", err, ErrOwnsWorkspace)
+	}
+	var members int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM workspace_members WHERE workspace_id = $1`, workspace.ID).Scan(&members); err != nil {
+		t.Fatal(err)
+	}
+	if members != 2 {
+		t.Errorf("workspace has %d members after the failed purge, want 2", members)
+	}
+}
+
+func TestDeleteAccountOwningSoloWorkspace(t *testing.T) {
+	db := openTestDB(t)
+	owner := createTestUser(t, db)
+	actor := AuditActor{Type: AuditActorSystem}
+
+	if _, err := NewWorkspaceService(db).CreateWorkspace(actor, owner, "Solo"); err != nil {
+		t.Fatal(err)
+	}
+	user, err := NewUserService(db).DeleteAccount(actor, owner)
+	if err != nil {
+		t.Fatalf("DeleteAccount() error = %v", err)
+	}
+	if user.DeletedAt == nil {
+		t.Error("DeleteAccount() left deleted_at unset")
+	}
+}
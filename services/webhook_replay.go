@@ -0,0 +1,303 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// WebhookEventFilter selects stored webhook events. Zero values match all.
+type WebhookEventFilter struct {
+	ID         int64
+	ResourceID string
+	EventName  string
+	Status     string
+	Since      *time.Time
+	Until      *time.Time
+	Limit      int
+}
+
+// StateChange is a single field that applying an event changed (or, in a
+// dry run, would change).
+type StateChange struct {
+	Field  string `json:"field"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+type ReplayResult struct {
+	EventID   int64         `json:"event_id"`
+	EventName string        `json:"event_name"`
+	Status    string        `json:"status"`
+	Error     string        `json:"error,omitempty"`
+	Changes   []StateChange `json:"changes"`
+}
+
+func (f WebhookEventFilter) where() (string, []interface{}) {
+	clause := "WHERE TRUE"
+	var args []interface{}
+	add := func(condition string, value interface{}) {
+		args = append(args, value)
+		clause += fmt.Sprintf(" AND "+condition, len(args))
+	}
+
+	if f.ID != 0 {
+		add("id = $%d", f.ID)
+	}
+	if f.ResourceID != "" {
+		add("resource_id = $%d", f.ResourceID)
+	}
+	if f.EventName != "" {
+		add("event_name = $%d", f.EventName)
+	}
+	if f.Status != "" {
+		add("status = $%d", f.Status)
+	}
+	if f.Since != nil {
+		add("received_at >= $%d", *f.Since)
+	}
+	if f.Until != nil {
+		add("received_at < $%d", *f.Until)
+	}
+
+	return clause, args
+}
+
+// ListWebhookEvents returns stored events matching the filter, oldest first
+// so they can be replayed in the order they arrived.
+func (ls *LemonSqueezyService) ListWebhookEvents(filter WebhookEventFilter) ([]WebhookEvent, error) {
+	where, args := filter.where()
+	query := `
+		SELECT id, delivery_key, event_name, resource_id, payload, received_at,
+			status, COALESCE(error, ''), attempts, processed_at
+		FROM webhook_events
+		` + where + `
+		ORDER BY received_at, id`
+	if filter.Limit > 0 {
+		query += " LIMIT " + strconv.Itoa(filter.Limit)
+	}
+
+	rows, err := ls.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []WebhookEvent
+	for rows.Next() {
+		var event WebhookEvent
+		var processedAt sql.NullTime
+		err := rows.Scan(&event.ID, &event.DeliveryKey, &event.EventName, &event.ResourceID,
+			&event.Payload, &event.ReceivedAt, &event.Status, &event.Error, &event.Attempts, &processedAt)
+		if err != nil {
+			return nil, err
+		}
+		if processedAt.Valid {
+			event.ProcessedAt = &processedAt.Time
+		}
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+func (ls *LemonSqueezyService) GetWebhookEvent(id int64) (*WebhookEvent, error) {
+	events, err := ls.ListWebhookEvents(WebhookEventFilter{ID: id})
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &events[0], nil
+}
+
+// ReplayWebhookEvents re-applies the matching events in arrival order through
+// the same handlers as live deliveries. Replays are deliberate, so events are
+// applied even if the subscription has seen a newer one. With dryRun set each
+// event's changes are computed and rolled back. Otherwise every replay counts
+// as an attempt, and failures are recorded on the event like failed live
+// deliveries. The changes are logged as the actor's.
+func (ls *LemonSqueezyService) ReplayWebhookEvents(actor AuditActor, filter WebhookEventFilter, dryRun bool) ([]ReplayResult, error) {
+	events, err := ls.ListWebhookEvents(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []ReplayResult{}
+	for _, event := range events {
+		result, err := ls.replayWebhookEvent(actor, event, dryRun)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, *result)
+	}
+
+	return results, nil
+}
+
+func (ls *LemonSqueezyService) replayWebhookEvent(actor AuditActor, event WebhookEvent, dryRun bool) (*ReplayResult, error) {
+	result := &ReplayResult{EventID: event.ID, EventName: event.EventName, Changes: []StateChange{}}
+
+	var webhook LemonSqueezyWebhookPayload
+	if err := json.Unmarshal(event.Payload, &webhook); err != nil {
+		return nil, err
+	}
+
+	tx, err := ls.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := setAuditContext(tx, actor, "webhooks.replay"); err != nil {
+		return nil, err
+	}
+
+	before, err := webhookState(tx, webhook)
+	if err != nil {
+		return nil, err
+	}
+
+	result.Status, err = ls.applyWebhook(tx, event.Payload, false)
+	if err != nil {
+		result.Status = WebhookStatusFailed
+		result.Error = err.Error()
+		if dryRun {
+			return result, nil
+		}
+		tx.Rollback()
+		return result, ls.recordWebhookFailure(event.ID, err)
+	}
+	if result.Status == WebhookStatusIgnored {
+		return result, nil
+	}
+
+	after, err := webhookState(tx, webhook)
+	if err != nil {
+		return nil, err
+	}
+	result.Changes = diffState(before, after)
+
+	if dryRun {
+		return result, nil
+	}
+
+	_, err = tx.Exec(`
+		UPDATE webhook_events
+		SET status = $1, error = NULL, processed_at = NOW(), attempts = attempts + 1
+		WHERE id = $2
+	`, result.Status, event.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, tx.Commit()
+}
+
+// webhookState snapshots the local state an event can touch: the subscription
+// it refers to and the user it belongs to.
+func webhookState(tx *sql.Tx, webhook LemonSqueezyWebhookPayload) (map[string]string, error) {
+	var resource struct {
+		ID         string `json:"id"`
+		Attributes struct {
+			UserEmail      string `json:"user_email"`
+			SubscriptionID int    `json:"subscription_id"`
+		} `json:"attributes"`
+	}
+	if err := json.Unmarshal(webhook.Data, &resource); err != nil {
+		return nil, err
+	}
+
+	// Invoices refer to their subscription by attribute
+	subscriptionID := resource.ID
+	if resource.Attributes.SubscriptionID != 0 {
+		subscriptionID = strconv.Itoa(resource.Attributes.SubscriptionID)
+	}
+
+	state := map[string]string{}
+	userID := webhook.Meta.UserID()
+
+	var status, periodEnd, subscriptionUser sql.NullString
+	err := tx.QueryRow(`
+		SELECT status, current_period_end::text, user_id::text
+		FROM subscriptions
+		WHERE lemonsqueezy_subscription_id = $1
+	`, subscriptionID).Scan(&status, &periodEnd, &subscriptionUser)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if err == nil {
+		state["subscription.status"] = status.String
+		state["subscription.current_period_end"] = periodEnd.String
+		state["subscription.user_id"] = subscriptionUser.String
+		if subscriptionUser.Valid {
+			userID = subscriptionUser.String
+		}
+
+		var expiresAt sql.NullString
+		err := tx.QueryRow(`
+			SELECT expires_at::text FROM entitlements WHERE source = $1 AND source_id = $2
+		`, EntitlementSourceSubscription, subscriptionID).Scan(&expiresAt)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		state["entitlement.expires_at"] = expiresAt.String
+	}
+
+	if userID == "" {
+		err := tx.QueryRow(`
+			SELECT id FROM users WHERE email = $1
+		`, resource.Attributes.UserEmail).Scan(&userID)
+		if err == sql.ErrNoRows {
+			return state, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var isPro bool
+	var planID string
+	err = tx.QueryRow(`
+		SELECT is_pro, plan_id FROM users WHERE id = $1
+	`, userID).Scan(&isPro, &planID)
+	if err == sql.ErrNoRows {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	balance, err := creditBalance(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	state["user.id"] = userID
+	state["user.is_pro"] = strconv.FormatBool(isPro)
+	state["user.plan_id"] = planID
+	state["user.credit_balance"] = strconv.Itoa(balance)
+
+	return state, nil
+}
+
+func diffState(before, after map[string]string) []StateChange {
+	changes := []StateChange{}
+	for field, value := range after {
+		if before[field] != value {
+			changes = append(changes, StateChange{Field: field, Before: before[field], After: value})
+		}
+	}
+	for field, value := range before {
+		if _, ok := after[field]; !ok {
+			changes = append(changes, StateChange{Field: field, Before: value})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes
+}
@@ -0,0 +1,474 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Workspace roles. Owners and admins manage members; the owner can't be removed.
+const (
+	WorkspaceRoleOwner  = "owner"
+	WorkspaceRoleAdmin  = "admin"
+	WorkspaceRoleMember = "member"
+)
+
+// invitationTTL is how long an invitation can be accepted.
+const invitationTTL = 7 * 24 * time.Hour
+
+var (
+	// ErrWorkspaceNotFound is returned for workspaces that don't exist or
+	// that the user isn't a member of.
+	ErrWorkspaceNotFound = errors.New("workspace not found")
+	// ErrWorkspaceForbidden is returned when a member without the owner or
+	// admin role tries to manage the workspace.
+	ErrWorkspaceForbidden = errors.New("not allowed to manage workspace")
+	// ErrNoSeatsAvailable is returned when every seat is taken.
+	ErrNoSeatsAvailable = errors.New("no seats available")
+	// ErrInvitationNotFound is returned for unknown, expired, revoked or
+	// already accepted invitation tokens.
+	ErrInvitationNotFound = errors.New("invitation not found")
+	// ErrInvitationEmailMismatch is returned when accepting an invitation
+	// sent to an email other than the user's.
+	ErrInvitationEmailMismatch = errors.New("invitation is for another email")
+	// ErrInvalidRole is returned for roles that can't be given by invitation.
+	ErrInvalidRole = errors.New("invalid role")
+	// ErrCannotRemoveOwner is returned when removing a workspace's owner.
+	ErrCannotRemoveOwner = errors.New("cannot remove workspace owner")
+)
+
+type Workspace struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	OwnerID   string    `json:"owner_id"`
+	Seats     int       `json:"seats"`
+	Members   int       `json:"members"`
+	Role      string    `json:"role"` // of the requesting user
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WorkspaceMember is a member of a workspace. Members who joined after the
+// workspace's seats ran out, e.g. because seats were removed on a downgrade,
+// are OverSeatLimit and don't get the workspace's plan.
+type WorkspaceMember struct {
+	UserID        string    `json:"user_id"`
+	Email         string    `json:"email"`
+	Role          string    `json:"role"`
+	JoinedAt      time.Time `json:"joined_at"`
+	OverSeatLimit bool      `json:"over_seat_limit"`
+}
+
+// Invitation asks someone to join a workspace. Its accept token is only sent
+// to the invitee, by email.
+type Invitation struct {
+	ID          int64     `json:"id"`
+	WorkspaceID int64     `json:"workspace_id"`
+	Email       string    `json:"email"`
+	Role        string    `json:"role"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+type WorkspaceService struct {
+	DB     *sql.DB
+	Mailer Mailer
+	// InvitationURL is the app page that accepts invitations. The token is
+	// added to it as the token query parameter.
+	InvitationURL string
+}
+
+func NewWorkspaceService(db *sql.DB) *WorkspaceService {
+	return &WorkspaceService{DB: db, Mailer: LogMailer{}}
+}
+
+// CreateWorkspace creates a workspace owned by the user, with one seat until
+// a subscription is bought for it.
+func (ws *WorkspaceService) CreateWorkspace(actor AuditActor, ownerID, name string) (*Workspace, error) {
+	tx, err := ws.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := setAuditContext(tx, actor, "workspace.create"); err != nil {
+		return nil, err
+	}
+
+	var exists bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE id::text = $1)`, ownerID).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrUserNotFound
+	}
+
+	workspace := Workspace{Name: name, OwnerID: ownerID, Members: 1, Role: WorkspaceRoleOwner}
+	err = tx.QueryRow(`
+		INSERT INTO workspaces (name, owner_id)
+		VALUES ($1, $2)
+		RETURNING id, seats, created_at
+	`, name, ownerID).Scan(&workspace.ID, &workspace.Seats, &workspace.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO workspace_members (workspace_id, user_id, role)
+		VALUES ($1, $2, $3)
+	`, workspace.ID, ownerID, WorkspaceRoleOwner)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &workspace, nil
+}
+
+const workspaceColumns = `w.id, w.name, w.owner_id, w.seats,
+	(SELECT COUNT(*) FROM workspace_members c WHERE c.workspace_id = w.id), m.role, w.created_at`
+
+func scanWorkspace(row rowScanner) (*Workspace, error) {
+	var workspace Workspace
+	err := row.Scan(&workspace.ID, &workspace.Name, &workspace.OwnerID, &workspace.Seats,
+		&workspace.Members, &workspace.Role, &workspace.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &workspace, nil
+}
+
+// ListWorkspaces returns the workspaces the user is a member of.
+func (ws *WorkspaceService) ListWorkspaces(userID string) ([]Workspace, error) {
+	rows, err := ws.DB.Query(`
+		SELECT `+workspaceColumns+`
+		FROM workspaces w JOIN workspace_members m ON m.workspace_id = w.id
+		WHERE m.user_id = $1
+		ORDER BY w.created_at
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	workspaces := []Workspace{}
+	for rows.Next() {
+		workspace, err := scanWorkspace(rows)
+		if err != nil {
+			return nil, err
+		}
+		workspaces = append(workspaces, *workspace)
+	}
+	return workspaces, rows.Err()
+}
+
+// GetWorkspace returns a workspace and its members as seen by one of them.
+func (ws *WorkspaceService) GetWorkspace(workspaceID int64, userID string) (*Workspace, []WorkspaceMember, error) {
+	workspace, err := getMemberWorkspace(ws.DB, workspaceID, userID, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rows, err := ws.DB.Query(`
+		SELECT m.user_id, COALESCE(u.email, ''), m.role, m.joined_at, NOT `+seatedMemberSQL+`
+		FROM workspace_members m
+		JOIN users u ON u.id = m.user_id
+		JOIN workspaces w ON w.id = m.workspace_id
+		WHERE m.workspace_id = $1
+		ORDER BY m.joined_at
+	`, workspaceID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	members := []WorkspaceMember{}
+	for rows.Next() {
+		var member WorkspaceMember
+		if err := rows.Scan(&member.UserID, &member.Email, &member.Role, &member.JoinedAt, &member.OverSeatLimit); err != nil {
+			return nil, nil, err
+		}
+		members = append(members, member)
+	}
+	return workspace, members, rows.Err()
+}
+
+// getMemberWorkspace loads a workspace the user belongs to. lock holds the
+// workspace row until the transaction ends, serialising seat changes.
+func getMemberWorkspace(q queryer, workspaceID int64, userID string, lock bool) (*Workspace, error) {
+	query := `
+		SELECT ` + workspaceColumns + `
+		FROM workspaces w JOIN workspace_members m ON m.workspace_id = w.id
+		WHERE w.id = $1 AND m.user_id = $2`
+	if lock {
+		query += ` FOR UPDATE OF w`
+	}
+
+	workspace, err := scanWorkspace(q.QueryRow(query, workspaceID, userID))
+	if err == sql.ErrNoRows {
+		return nil, ErrWorkspaceNotFound
+	}
+	return workspace, err
+}
+
+// CanManage reports whether the user may manage the workspace's members and
+// billing.
+func (ws *WorkspaceService) CanManage(workspaceID int64, userID string) (bool, error) {
+	workspace, err := getMemberWorkspace(ws.DB, workspaceID, userID, false)
+	if errors.Is(err, ErrWorkspaceNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return canManage(workspace.Role), nil
+}
+
+func canManage(role string) bool {
+	return role == WorkspaceRoleOwner || role == WorkspaceRoleAdmin
+}
+
+// InviteMember creates an invitation for email and mails its accept link to
+// the invitee. Pending invitations hold a seat, and inviting the same email
+// again replaces the earlier invitation.
+func (ws *WorkspaceService) InviteMember(workspaceID int64, inviterID, email, role string) (*Invitation, error) {
+	if role == "" {
+		role = WorkspaceRoleMember
+	}
+	if role != WorkspaceRoleMember && role != WorkspaceRoleAdmin {
+		return nil, ErrInvalidRole
+	}
+
+	tx, err := ws.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	workspace, err := getMemberWorkspace(tx, workspaceID, inviterID, true)
+	if err != nil {
+		return nil, err
+	}
+	if !canManage(workspace.Role) {
+		return nil, ErrWorkspaceForbidden
+	}
+
+	email = strings.ToLower(strings.TrimSpace(email))
+	_, err = tx.Exec(`
+		UPDATE workspace_invitations
+		SET revoked_at = NOW()
+		WHERE workspace_id = $1 AND lower(email) = $2
+			AND accepted_at IS NULL AND revoked_at IS NULL
+	`, workspaceID, email)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending int
+	err = tx.QueryRow(`
+		SELECT COUNT(*) FROM workspace_invitations
+		WHERE workspace_id = $1 AND accepted_at IS NULL AND revoked_at IS NULL AND expires_at > NOW()
+	`, workspaceID).Scan(&pending)
+	if err != nil {
+		return nil, err
+	}
+	if workspace.Members+pending >= workspace.Seats {
+		return nil, ErrNoSeatsAvailable
+	}
+
+	token, err := newInvitationToken()
+	if err != nil {
+		return nil, err
+	}
+
+	invitation := Invitation{WorkspaceID: workspaceID, Email: email, Role: role}
+	err = tx.QueryRow(`
+		INSERT INTO workspace_invitations (workspace_id, email, role, token_hash, invited_by, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at, expires_at
+	`, workspaceID, email, role, hashInvitationToken(token), inviterID, time.Now().Add(invitationTTL)).Scan(
+		&invitation.ID, &invitation.CreatedAt, &invitation.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	// The invitation is only kept if its email went out
+	if err := ws.Mailer.Send(ws.invitationMessage(workspace, &invitation, token)); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &invitation, nil
+}
+
+// AcceptInvitation adds the user to the invitation's workspace, where they
+// get the workspace's plan. Only the user with the invited email can accept.
+func (ws *WorkspaceService) AcceptInvitation(actor AuditActor, token, userID string) (*Workspace, error) {
+	tx, err := ws.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := setAuditContext(tx, actor, "workspace.member_join"); err != nil {
+		return nil, err
+	}
+
+	var invitationID, workspaceID int64
+	var role, invitedEmail string
+	err = tx.QueryRow(`
+		SELECT id, workspace_id, role, email
+		FROM workspace_invitations
+		WHERE token_hash = $1 AND accepted_at IS NULL AND revoked_at IS NULL AND expires_at > NOW()
+		FOR UPDATE
+	`, hashInvitationToken(token)).Scan(&invitationID, &workspaceID, &role, &invitedEmail)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvitationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var userEmail string
+	err = tx.QueryRow(`SELECT COALESCE(email, '') FROM users WHERE id::text = $1`, userID).Scan(&userEmail)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if userEmail == "" || !strings.EqualFold(strings.TrimSpace(userEmail), invitedEmail) {
+		return nil, ErrInvitationEmailMismatch
+	}
+
+	// Lock the workspace so concurrent joins can't overfill it
+	var seats int
+	err = tx.QueryRow(`SELECT seats FROM workspaces WHERE id = $1 FOR UPDATE`, workspaceID).Scan(&seats)
+	if err != nil {
+		return nil, err
+	}
+
+	var members int
+	var alreadyMember bool
+	err = tx.QueryRow(`
+		SELECT COUNT(*), COALESCE(BOOL_OR(user_id::text = $2), FALSE)
+		FROM workspace_members WHERE workspace_id = $1
+	`, workspaceID, userID).Scan(&members, &alreadyMember)
+	if err != nil {
+		return nil, err
+	}
+
+	if !alreadyMember {
+		if members >= seats {
+			return nil, ErrNoSeatsAvailable
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO workspace_members (workspace_id, user_id, role)
+			VALUES ($1, $2, $3)
+		`, workspaceID, userID, role)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = tx.Exec(`
+		UPDATE workspace_invitations SET accepted_at = NOW(), accepted_by = $2 WHERE id = $1
+	`, invitationID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syncUserEntitlements(tx, userID); err != nil {
+		return nil, err
+	}
+
+	workspace, err := getMemberWorkspace(tx, workspaceID, userID, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return workspace, nil
+}
+
+// RemoveMember removes memberID from the workspace. Owners and admins can
+// remove anyone but the owner; members can only remove themselves.
+func (ws *WorkspaceService) RemoveMember(actor AuditActor, workspaceID int64, actorID, memberID string) error {
+	tx, err := ws.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := setAuditContext(tx, actor, "workspace.member_remove"); err != nil {
+		return err
+	}
+
+	workspace, err := getMemberWorkspace(tx, workspaceID, actorID, true)
+	if err != nil {
+		return err
+	}
+	if actorID != memberID && !canManage(workspace.Role) {
+		return ErrWorkspaceForbidden
+	}
+	if memberID == workspace.OwnerID {
+		return ErrCannotRemoveOwner
+	}
+
+	result, err := tx.Exec(`
+		DELETE FROM workspace_members WHERE workspace_id = $1 AND user_id::text = $2
+	`, workspaceID, memberID)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return ErrUserNotFound
+	}
+
+	if err := syncUserEntitlements(tx, memberID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (ws *WorkspaceService) invitationMessage(workspace *Workspace, invitation *Invitation, token string) MailMessage {
+	link := token
+	if ws.InvitationURL != "" {
+		link = ws.InvitationURL + "?token=" + url.QueryEscape(token)
+	}
+	return MailMessage{
+		To:      invitation.Email,
+		Subject: fmt.Sprintf("You're invited to join %s on EmailDrip", workspace.Name),
+		Body: fmt.Sprintf("You've been invited to join the %s workspace on EmailDrip as %s.\n\n"+
+			"Accept the invitation before %s:\n\n%s",
+			workspace.Name, invitation.Role, invitation.ExpiresAt.Format("January 2, 2006"), link),
+	}
+}
+
+func newInvitationToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashInvitationToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}